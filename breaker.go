@@ -0,0 +1,107 @@
+package simplerelic
+
+import (
+	"sync"
+	"time"
+)
+
+// BreakerState is the state of the circuit breaker around the sends to NewRelic
+type BreakerState int
+
+const (
+	// BreakerClosed sends the metrics as usual
+	BreakerClosed BreakerState = iota
+
+	// BreakerOpen skips the sends until the cooldown passes,
+	// the collected metrics are dropped meanwhile
+	BreakerOpen
+
+	// BreakerHalfOpen tries a single send to test if NewRelic recovered
+	BreakerHalfOpen
+)
+
+// circuitBreaker stops sending to a persistently failing backend
+type circuitBreaker struct {
+	lock sync.Mutex
+
+	// consecutive failures opening the circuit, 0 disables the breaker
+	threshold int
+	cooldown  time.Duration
+
+	failures int
+	state    BreakerState
+	openedAt time.Time
+
+	now func() time.Time
+}
+
+func newCircuitBreaker() *circuitBreaker {
+	return &circuitBreaker{now: time.Now}
+}
+
+// configure sets the failures threshold and the cooldown
+// and closes the circuit
+func (b *circuitBreaker) configure(threshold int, cooldown time.Duration) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	b.threshold = threshold
+	b.cooldown = cooldown
+	b.failures = 0
+	b.state = BreakerClosed
+}
+
+// allow reports whether a send should be attempted
+func (b *circuitBreaker) allow() bool {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	if b.state == BreakerOpen {
+		if b.now().Sub(b.openedAt) < b.cooldown {
+			return false
+		}
+		b.state = BreakerHalfOpen
+	}
+
+	return true
+}
+
+// record the outcome of a send attempt
+func (b *circuitBreaker) record(success bool) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	if success {
+		b.failures = 0
+		b.state = BreakerClosed
+		return
+	}
+
+	b.failures++
+	if b.threshold > 0 && (b.state == BreakerHalfOpen || b.failures >= b.threshold) {
+		if b.state != BreakerOpen {
+			Log.Printf("sending to NewRelic failed %d times in a row, pausing for %v", b.failures, b.cooldown)
+		}
+		b.state = BreakerOpen
+		b.openedAt = b.now()
+	}
+}
+
+func (b *circuitBreaker) enabled() bool {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	return b.threshold > 0
+}
+
+// settings returns the failures threshold and the cooldown
+func (b *circuitBreaker) settings() (int, time.Duration) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	return b.threshold, b.cooldown
+}
+
+func (b *circuitBreaker) State() BreakerState {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	return b.state
+}
@@ -0,0 +1,94 @@
+package simplerelic
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestCircuitBreaker(t *testing.T) {
+
+	_, restore := captureLog()
+	defer restore()
+
+	var requests int
+	statusCode := http.StatusServiceUnavailable
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		w.WriteHeader(statusCode)
+	}))
+	defer server.Close()
+
+	now := time.Now()
+	reporter := newServerReporter(t, server.URL)
+	reporter.SetCircuitBreaker(3, time.Minute)
+	reporter.breaker.now = func() time.Time { return now }
+
+	expectState := func(expected BreakerState, expectedRequests int) {
+		t.Helper()
+		if state := reporter.BreakerState(); state != expected {
+			t.Errorf("error: expected state %d, got %d", expected, state)
+		}
+		if requests != expectedRequests {
+			t.Errorf("error: expected %d requests, got %d", expectedRequests, requests)
+		}
+	}
+
+	reporter.sendMetrics()
+	reporter.sendMetrics()
+	expectState(BreakerClosed, 2)
+	reporter.sendMetrics()
+	expectState(BreakerOpen, 3)
+
+	// skipped while open
+	reporter.sendMetrics()
+	expectState(BreakerOpen, 3)
+
+	// a failed trial after the cooldown opens the circuit again
+	now = now.Add(time.Minute)
+	reporter.sendMetrics()
+	expectState(BreakerOpen, 4)
+	reporter.sendMetrics()
+	expectState(BreakerOpen, 4)
+
+	// a successful trial closes it
+	now = now.Add(time.Minute)
+	statusCode = http.StatusOK
+	if !reporter.breaker.allow() || reporter.BreakerState() != BreakerHalfOpen {
+		t.Errorf("error: expected half open state, got %d", reporter.BreakerState())
+	}
+	reporter.sendMetrics()
+	expectState(BreakerClosed, 5)
+}
+
+func TestCircuitBreakerDisabled(t *testing.T) {
+
+	_, restore := captureLog()
+	defer restore()
+
+	reporter := newServerReporter(t, "")
+	for i := 0; i < 10; i++ {
+		reporter.sendMetrics()
+	}
+	if state := reporter.BreakerState(); state != BreakerClosed {
+		t.Errorf("error: expected state %d, got %d", BreakerClosed, state)
+	}
+	if _, ok := reporter.selfStats()["Component/Reporter/CircuitBreaker[state]"]; ok {
+		t.Error("error: expected no breaker state when disabled")
+	}
+}
+
+func TestCircuitBreakerSelfStats(t *testing.T) {
+
+	_, restore := captureLog()
+	defer restore()
+
+	reporter := newServerReporter(t, "")
+	reporter.SetCircuitBreaker(1, time.Minute)
+	reporter.breaker.record(false)
+
+	if value, ok := reporter.selfStats()["Component/Reporter/CircuitBreaker[state]"]; !ok || value != float32(BreakerOpen) {
+		t.Errorf("error: expected breaker state %d, got %f", BreakerOpen, value)
+	}
+}
@@ -0,0 +1,107 @@
+package simplerelic
+
+import (
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// ReporterConfig is the effective configuration of a reporter, e.g. for
+// logging it when diagnosing a misconfiguration. The licences are masked.
+type ReporterConfig struct {
+	AppName     string `json:"appName"`
+	Environment string `json:"environment,omitempty"`
+	Component   string `json:"component"`
+	GUID        string `json:"guid"`
+	Version     string `json:"version"`
+	Host        string `json:"host"`
+	PID         int    `json:"pid"`
+
+	URL        string   `json:"url"`
+	Licence    string   `json:"licence"`
+	Licences   []string `json:"additionalLicences,omitempty"`
+	AuthHeader string   `json:"authHeader"`
+	UserAgent  string   `json:"userAgent"`
+	Sinks      int      `json:"sinks"`
+
+	Interval  time.Duration `json:"interval"`
+	Jitter    float64       `json:"jitter"`
+	Alignment time.Duration `json:"alignment"`
+
+	Verbose              bool   `json:"verbose"`
+	Compress             bool   `json:"compress"`
+	DryRun               bool   `json:"dryRun"`
+	Enabled              bool   `json:"enabled"`
+	MaxMetricsPerRequest int    `json:"maxMetricsPerRequest"`
+	FlushThreshold       int    `json:"flushThreshold"`
+	Precision            *int   `json:"precision,omitempty"`
+	SpoolDir             string `json:"spoolDir,omitempty"`
+
+	BreakerThreshold int           `json:"breakerThreshold"`
+	BreakerCooldown  time.Duration `json:"breakerCooldown"`
+
+	// Metrics are the type names of the registered metrics, see MetricNames
+	Metrics []string `json:"metrics"`
+}
+
+// Config returns a copy of the effective configuration of the reporter
+// with the licences masked but for their last 4 characters
+func (reporter *Reporter) Config() ReporterConfig {
+
+	threshold, cooldown := reporter.breaker.settings()
+	config := ReporterConfig{
+		Interval:         reportingFreq,
+		Compress:         reporter.Compress,
+		DryRun:           reporter.DryRun,
+		FlushThreshold:   int(atomic.LoadInt64(&reporter.flushThreshold)),
+		BreakerThreshold: threshold,
+		BreakerCooldown:  cooldown,
+	}
+
+	config.Metrics = reporter.MetricNames()
+
+	reporter.lock.Lock()
+	defer reporter.lock.Unlock()
+
+	config.AppName = reporter.appName
+	config.Environment = reporter.environment
+	config.Component = reporter.componentName()
+	config.GUID = reporter.guid
+	config.Version = reporter.version
+	config.Host = reporter.host
+	config.PID = reporter.pid
+	config.URL = reporter.url
+	config.Licence = maskLicence(reporter.licence)
+	config.AuthHeader = reporter.authHeader
+	config.UserAgent = reporter.userAgent
+	config.Sinks = len(reporter.sinks)
+	config.Jitter = reporter.jitter
+	config.Alignment = reporter.alignment
+	config.Verbose = reporter.verbose
+	config.Enabled = !reporter.disabled
+	config.MaxMetricsPerRequest = reporter.maxMetricsPerRequest
+	if reporter.round {
+		precision := reporter.precision
+		config.Precision = &precision
+	}
+	if reporter.spool != nil {
+		config.SpoolDir = reporter.spool.dir
+	}
+
+	for _, sink := range reporter.sinks {
+		if sink, ok := sink.(*newRelicSink); ok && sink.licence != "" {
+			config.Licences = append(config.Licences, maskLicence(sink.licence))
+		}
+	}
+
+	return config
+}
+
+// maskLicence hides all but the last 4 characters of the licence,
+// a licence that short is hidden completely
+func maskLicence(licence string) string {
+	if len(licence) <= 4 {
+		return strings.Repeat("*", len(licence))
+	}
+	return strings.Repeat("*", len(licence)-4) + licence[len(licence)-4:]
+}
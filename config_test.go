@@ -0,0 +1,46 @@
+package simplerelic
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+func TestConfig(t *testing.T) {
+
+	reporter, err := NewReporter("test", "0123456789abcdef", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	reporter.SetEnvironment("staging")
+	reporter.AddLicence("fedcba9876543210")
+	reporter.AddMetric(NewReqPerEndpoint())
+
+	config := reporter.Config()
+	if config.Licence != "************cdef" {
+		t.Errorf("error: expected the licence to be masked, got %q", config.Licence)
+	}
+	if len(config.Licences) != 1 || config.Licences[0] != "************3210" {
+		t.Errorf("error: expected the additional licence to be masked, got %v", config.Licences)
+	}
+	if config.Component != "test (staging)" || config.Interval != reportingFreq || config.Sinks != 2 {
+		t.Errorf("error: unexpected config %+v", config)
+	}
+	if len(config.Metrics) != 1 || config.Metrics[0] != "ReqPerEndpoint" {
+		t.Errorf("error: expected the registered metric, got %v", config.Metrics)
+	}
+
+	b, err := json.Marshal(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, licence := range []string{"0123456789abcdef", "fedcba9876543210"} {
+		if strings.Contains(string(b), licence) {
+			t.Errorf("error: expected no licence in the config, got %s", b)
+		}
+	}
+
+	if masked := maskLicence("abc"); masked != "***" {
+		t.Errorf("error: expected a short licence to be hidden, got %q", masked)
+	}
+}
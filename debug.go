@@ -0,0 +1,96 @@
+package simplerelic
+
+import (
+	"encoding/json"
+	"errors"
+	"expvar"
+	"net/http"
+	"sync"
+	"sync/atomic"
+)
+
+// name of the expvar published by PublishExpvar
+const expvarName = "simplerelic"
+
+// the expvar is published once per process and reads the values of the
+// reporter published last
+var (
+	expvarLock      sync.Mutex
+	expvarPublished bool
+	expvarReporter  atomic.Value
+)
+
+// peekValues collects the current values of the metrics without
+// interfering with the reporting cycle. The names are mapped and the values
+// reported under the same name are summed as in the reports. Metrics not
+// implementing Peeker can't be read without clearing them and are left out.
+func (reporter *Reporter) peekValues() map[string]float32 {
+	mapName := reporter.nameMapper()
+
+	values := make(map[string]float32)
+	for _, metric := range reporter.metrics() {
+		peeker, ok := metric.(Peeker)
+		if !ok {
+			continue
+		}
+		for name, value := range peeker.Peek() {
+			if mapName != nil {
+				if name = mapName(name); name == "" {
+					continue
+				}
+			}
+			values[name] += value
+		}
+	}
+	return values
+}
+
+// debugValues returns the current values with the invalid floats replaced
+// by 0, so that they can be encoded as JSON
+func (reporter *Reporter) debugValues() map[string]float32 {
+	values := reporter.peekValues()
+	for name, value := range values {
+		if isInvalidFloat(value) {
+			values[name] = 0
+		}
+	}
+	return values
+}
+
+// PublishExpvar publishes the current metric values as the expvar
+// "simplerelic", served at /debug/vars by the expvar handler. Like
+// DebugHandler it does not clear the values. The expvar shows the values
+// of the reporter published last, e.g. of the one re-created after Reset.
+// It fails only when another package already published the name.
+func (reporter *Reporter) PublishExpvar() error {
+	expvarLock.Lock()
+	defer expvarLock.Unlock()
+
+	if !expvarPublished {
+		if expvar.Get(expvarName) != nil {
+			return errors.New("Expvar " + expvarName + " is already published by another package")
+		}
+		expvar.Publish(expvarName, expvar.Func(func() interface{} {
+			return expvarReporter.Load().(*Reporter).debugValues()
+		}))
+		expvarPublished = true
+	}
+	expvarReporter.Store(reporter)
+	return nil
+}
+
+// DebugHandler serves the current metric values as JSON, e.g. mounted
+// at /debug/metrics. Reading the values does not clear them so the
+// reporting to NewRelic is not affected. Only the metrics implementing
+// Peeker are shown, the standard metrics and FuncMetric among them.
+func (reporter *Reporter) DebugHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		values := reporter.debugValues()
+
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(values); err != nil {
+			Log.Println("error encoding debug metrics")
+			Log.Println(err)
+		}
+	}
+}
@@ -0,0 +1,93 @@
+package simplerelic
+
+import (
+	"encoding/json"
+	"expvar"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestDebugHandler(t *testing.T) {
+
+	reporter, err := NewTestReporter("test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := NewReqPerEndpoint()
+	reporter.AddMetric(m)
+	reporter.AddMetric(&countingMetric{})
+	// reported under the same name, the values are summed
+	for i := 0; i < 2; i++ {
+		reporter.AddMetric(NewFuncMetric(func() map[string]float32 {
+			return map[string]float32{"Component/Shared[count]": 1}
+		}))
+	}
+	m.Update(map[string]interface{}{"endpointName": endpointName})
+
+	for i := 0; i < 2; i++ {
+		recorder := httptest.NewRecorder()
+		req, _ := http.NewRequest("GET", "/debug/metrics", nil)
+		reporter.DebugHandler()(recorder, req)
+
+		var values map[string]float32
+		if err := json.NewDecoder(recorder.Body).Decode(&values); err != nil {
+			t.Fatal(err)
+		}
+		if value := values["Component/ReqPerEndpoint/log[requests]"]; value != 1 {
+			t.Errorf("error: expected %f, got %f", 1., value)
+		}
+		if _, ok := values["Component/Extracted[count]"]; ok {
+			t.Error("error: expected metrics which can not be peeked to be skipped")
+		}
+		if value := values["Component/Shared[count]"]; value != 2 {
+			t.Errorf("error: expected the values under the same name to be summed to %f, got %f", 2., value)
+		}
+	}
+
+	// the names are mapped as in the reports
+	reporter.SetMetricNameMapper(func(name string) string {
+		if name == "Component/Shared[count]" {
+			return ""
+		}
+		return name
+	})
+	if _, ok := reporter.debugValues()["Component/Shared[count]"]; ok {
+		t.Error("error: expected the names dropped by the mapper to be left out")
+	}
+	reporter.SetMetricNameMapper(nil)
+
+	// the values are still reported
+	reporter.Flush()
+	if value := reporter.LastValues()["Component/ReqPerEndpoint/log[requests]"]; value != 1 {
+		t.Errorf("error: expected %f, got %f", 1., value)
+	}
+}
+
+func TestPublishExpvar(t *testing.T) {
+
+	// published again by every run of the test
+	for run := 0; run < 2; run++ {
+		reporter, err := NewTestReporter("test")
+		if err != nil {
+			t.Fatal(err)
+		}
+		m := NewReqPerEndpoint()
+		reporter.AddMetric(m)
+		if err := reporter.PublishExpvar(); err != nil {
+			t.Fatal(err)
+		}
+
+		for i := 1; i <= 2; i++ {
+			m.Update(map[string]interface{}{"endpointName": endpointName})
+
+			var values map[string]float32
+			if err := json.Unmarshal([]byte(expvar.Get("simplerelic").String()), &values); err != nil {
+				t.Fatal(err)
+			}
+			if value := values["Component/ReqPerEndpoint/log[requests]"]; value != float32(i) {
+				t.Errorf("error: expected %f of the reporter published last, got %f", float32(i), value)
+			}
+		}
+	}
+}
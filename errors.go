@@ -0,0 +1,96 @@
+package simplerelic
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// The categories of failed requests to NewRelic, matched with errors.Is
+// against the errors returned by Flush and the sinks
+var (
+	// ErrUnauthorized means the licence key was rejected (401, 403), retrying won't help
+	ErrUnauthorized = errors.New("NewRelic rejected the licence key")
+
+	// ErrRateLimited means NewRelic throttled the requests (429)
+	ErrRateLimited = errors.New("NewRelic rate limited the request")
+
+	// ErrServerError means NewRelic failed to process the request (5xx)
+	ErrServerError = errors.New("NewRelic server error")
+
+	// ErrRejected means NewRelic rejected the payload (other 4xx), e.g. too many metrics
+	ErrRejected = errors.New("NewRelic rejected the payload")
+
+	// ErrTransport means the request did not get a response, e.g. a timeout
+	ErrTransport = errors.New("request to NewRelic failed")
+
+	// ErrCircuitOpen means the sending is paused after repeated failures
+	ErrCircuitOpen = errors.New("sending to NewRelic is paused by the circuit breaker")
+
+	// ErrDisabled means the reporting is paused by SetEnabled
+	ErrDisabled = errors.New("reporting is disabled")
+)
+
+// RequestError is a failed request to NewRelic
+type RequestError struct {
+
+	// StatusCode of the response, 0 when there was none
+	StatusCode int
+
+	// Kind is the category of the failure, one of the Err sentinels
+	Kind error
+
+	// Err is the underlying transport error if any
+	Err error
+}
+
+func (e *RequestError) Error() string {
+	if e.StatusCode == 0 {
+		return fmt.Sprintf("%v: %v", e.Kind, e.Err)
+	}
+	return fmt.Sprintf("%v, status code %d", e.Kind, e.StatusCode)
+}
+
+// Is matches the category of the failure
+func (e *RequestError) Is(target error) bool {
+	return target == e.Kind
+}
+
+// Unwrap returns the underlying transport error
+func (e *RequestError) Unwrap() error {
+	return e.Err
+}
+
+// UpdateErrors are the errors returned by the metrics updated with a request,
+// e.g. when a parameter is missing or has a wrong type
+type UpdateErrors []error
+
+func (e UpdateErrors) Error() string {
+	messages := make([]string, len(e))
+	for i, err := range e {
+		messages[i] = err.Error()
+	}
+	return "metric update failed: " + strings.Join(messages, "; ")
+}
+
+// Unwrap returns the errors of the metrics
+func (e UpdateErrors) Unwrap() []error {
+	return e
+}
+
+// statusError maps the status code of a failed response to its category
+func statusError(statusCode int) *RequestError {
+	var kind error
+	switch {
+	case statusCode == http.StatusUnauthorized || statusCode == http.StatusForbidden:
+		kind = ErrUnauthorized
+	case statusCode == http.StatusTooManyRequests:
+		kind = ErrRateLimited
+	case statusCode >= 500:
+		kind = ErrServerError
+	default:
+		kind = ErrRejected
+	}
+	return &RequestError{StatusCode: statusCode, Kind: kind}
+}
@@ -0,0 +1,368 @@
+package simplerelic
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func isStopped(reporter *Reporter) bool {
+	reporter.lock.Lock()
+	defer reporter.lock.Unlock()
+	return reporter.stopped
+}
+
+func newStatusServer(statusCode int) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(statusCode)
+	}))
+}
+
+func TestRequestErrors(t *testing.T) {
+
+	_, restore := captureLog()
+	defer restore()
+
+	expected := map[int]error{
+		http.StatusUnauthorized:        ErrUnauthorized,
+		http.StatusForbidden:           ErrUnauthorized,
+		http.StatusTooManyRequests:     ErrRateLimited,
+		http.StatusInternalServerError: ErrServerError,
+		http.StatusServiceUnavailable:  ErrServerError,
+		http.StatusBadRequest:          ErrRejected,
+	}
+
+	for statusCode, kind := range expected {
+		server := newStatusServer(statusCode)
+		reporter := newServerReporter(t, server.URL)
+
+		err := reporter.Flush()
+		if !errors.Is(err, kind) {
+			t.Errorf("error: expected %v for status code %d, got %v", kind, statusCode, err)
+		}
+
+		var requestErr *RequestError
+		if !errors.As(err, &requestErr) || requestErr.StatusCode != statusCode {
+			t.Errorf("error: expected RequestError with status code %d, got %v", statusCode, err)
+		}
+
+		server.Close()
+	}
+}
+
+func TestValidate(t *testing.T) {
+
+	_, restore := captureLog()
+	defer restore()
+
+	server := newStatusServer(http.StatusUnauthorized)
+	defer server.Close()
+
+	reporter := newServerReporter(t, server.URL)
+	if err := reporter.Validate(); !errors.Is(err, ErrUnauthorized) {
+		t.Errorf("error: expected %v, got %v", ErrUnauthorized, err)
+	}
+
+	var received newRelicData
+	valid := newTestServer(t, func(r *http.Request) {
+		json.NewDecoder(r.Body).Decode(&received)
+	})
+	defer valid.Close()
+
+	reporter = newServerReporter(t, valid.URL)
+	if err := reporter.Validate(); err != nil {
+		t.Errorf("error: expected the licence to be valid, got %v", err)
+	}
+	if len(received.Components) != 1 || len(received.Components[0].Metrics) != 0 {
+		t.Errorf("error: expected a payload without metrics, got %+v", received)
+	}
+}
+
+func TestTransportError(t *testing.T) {
+
+	_, restore := captureLog()
+	defer restore()
+
+	server := newStatusServer(http.StatusOK)
+	server.Close()
+
+	reporter := newServerReporter(t, server.URL)
+	err := reporter.Flush()
+	if !errors.Is(err, ErrTransport) {
+		t.Errorf("error: expected %v, got %v", ErrTransport, err)
+	}
+	if errors.Is(err, ErrServerError) {
+		t.Errorf("error: expected only %v, got %v", ErrTransport, err)
+	}
+	if errors.Unwrap(err) == nil {
+		t.Error("error: expected the underlying error")
+	}
+}
+
+func TestFlushSuccess(t *testing.T) {
+
+	server := newStatusServer(http.StatusOK)
+	defer server.Close()
+
+	reporter := newServerReporter(t, server.URL)
+	if err := reporter.Flush(); err != nil {
+		t.Errorf("error: expected no error, got %v", err)
+	}
+}
+
+func TestFlushCircuitOpen(t *testing.T) {
+
+	_, restore := captureLog()
+	defer restore()
+
+	server := newStatusServer(http.StatusInternalServerError)
+	defer server.Close()
+
+	reporter := newServerReporter(t, server.URL)
+	reporter.SetCircuitBreaker(1, time.Hour)
+
+	reporter.Flush()
+	if err := reporter.Flush(); !errors.Is(err, ErrCircuitOpen) {
+		t.Errorf("error: expected %v, got %v", ErrCircuitOpen, err)
+	}
+}
+
+func TestStopOnUnauthorized(t *testing.T) {
+
+	buf, restore := captureLog()
+	defer restore()
+
+	server := newStatusServer(http.StatusUnauthorized)
+	defer server.Close()
+
+	reporter := newServerReporter(t, server.URL)
+	reporter.Start()
+	defer reporter.Stop()
+
+	for i := 0; i < maxAuthFailures-1; i++ {
+		reporter.Flush()
+	}
+	if isStopped(reporter) {
+		t.Fatal("error: expected the reporter to retry before stopping")
+	}
+
+	reporter.Flush()
+	if !isStopped(reporter) {
+		t.Error("error: expected the reporter to stop on repeated unauthorized responses")
+	}
+	if !strings.Contains(buf.String(), "licence key") {
+		t.Errorf("error: expected the invalid licence key to be logged, got %q", buf.String())
+	}
+}
+
+func TestUnauthorizedCountReset(t *testing.T) {
+
+	_, restore := captureLog()
+	defer restore()
+
+	statusCode := http.StatusForbidden
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(statusCode)
+	}))
+	defer server.Close()
+
+	reporter := newServerReporter(t, server.URL)
+	for i := 0; i < maxAuthFailures*2-1; i++ {
+		// a successful report in between, e.g. a transient failure at NewRelic
+		statusCode = http.StatusForbidden
+		if i == maxAuthFailures-1 {
+			statusCode = http.StatusOK
+		}
+		reporter.Flush()
+	}
+	if isStopped(reporter) {
+		t.Error("error: expected only failures in a row to stop the reporter")
+	}
+}
+
+func TestLastReport(t *testing.T) {
+
+	_, restore := captureLog()
+	defer restore()
+
+	start := time.Date(2020, 1, 1, 12, 0, 0, 0, time.UTC)
+	now := start
+	nowFunc = func() time.Time { return now }
+	defer func() { nowFunc = time.Now }()
+
+	server := newStatusServer(http.StatusOK)
+	defer server.Close()
+
+	reporter := newServerReporter(t, server.URL)
+	if reporter.LastError() != nil || !reporter.LastReportTime().Equal(start) {
+		t.Errorf("error: expected no error and the creation time, got %v and %v", reporter.LastError(), reporter.LastReportTime())
+	}
+
+	now = start.Add(time.Minute)
+	if err := reporter.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if !reporter.LastReportTime().Equal(now) {
+		t.Errorf("error: expected the last report at %v, got %v", now, reporter.LastReportTime())
+	}
+
+	// a failed send keeps the time of the last successful one
+	failing := newStatusServer(http.StatusInternalServerError)
+	defer failing.Close()
+	reporter.url = failing.URL
+	now = start.Add(2 * time.Minute)
+	reporter.Flush()
+	if !errors.Is(reporter.LastError(), ErrServerError) {
+		t.Errorf("error: expected %v, got %v", ErrServerError, reporter.LastError())
+	}
+	if !reporter.LastReportTime().Equal(start.Add(time.Minute)) {
+		t.Errorf("error: expected the last report at %v, got %v", start.Add(time.Minute), reporter.LastReportTime())
+	}
+
+	reporter.url = server.URL
+	reporter.Flush()
+	if reporter.LastError() != nil {
+		t.Errorf("error: expected the error to be cleared by a successful send, got %v", reporter.LastError())
+	}
+}
+
+func TestUpdateErrors(t *testing.T) {
+
+	buf, restore := captureLog()
+	defer restore()
+
+	start := time.Date(2020, 1, 1, 12, 0, 0, 0, time.UTC)
+	now := start
+	nowFunc = func() time.Time { return now }
+	defer func() { nowFunc = time.Now }()
+
+	reporter, err := NewTestReporter("test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	reporter.AddMetric(NewReqPerEndpoint())
+	reporter.AddMetric(NewResponseTimePerEndpoint())
+
+	// the request start is missing
+	params := map[string]interface{}{ParamEndpointName: endpointName, ParamStatusCode: 200}
+	err = reporter.UpdateMetrics(params)
+	var updateErrs UpdateErrors
+	if !errors.As(err, &updateErrs) || len(updateErrs) != 1 {
+		t.Fatalf("error: expected the error of the response time metric, got %v", err)
+	}
+	if !strings.Contains(buf.String(), "reqStart time should be time.Time") {
+		t.Errorf("error: expected the error to be logged, got %q", buf.String())
+	}
+
+	// logged at most once a minute
+	buf.Reset()
+	reporter.UpdateMetrics(params)
+	if buf.Len() != 0 {
+		t.Errorf("error: expected the repeated error not to be logged, got %q", buf.String())
+	}
+	now = start.Add(2 * time.Minute)
+	reporter.UpdateMetrics(params)
+	if !strings.Contains(buf.String(), "1 more errors since the last log") {
+		t.Errorf("error: expected the suppressed errors to be counted, got %q", buf.String())
+	}
+
+	if err := reporter.UpdateMetrics(DefaultReqParams(endpointName)); err != nil {
+		t.Errorf("error: expected no error for valid params, got %v", err)
+	}
+}
+
+// formattedError counts how often it is formatted
+type formattedError struct {
+	formatted *int32
+}
+
+func (e formattedError) Error() string {
+	atomic.AddInt32(e.formatted, 1)
+	return "update failed"
+}
+
+// failingMetric fails every update with the error
+type failingMetric struct {
+	err error
+}
+
+func (m failingMetric) Update(params map[string]interface{}) error {
+	return m.err
+}
+
+func (m failingMetric) ValueMap() map[string]float32 {
+	return nil
+}
+
+func TestUpdateErrorsFormattedOnlyWhenLogged(t *testing.T) {
+
+	_, restore := captureLog()
+	defer restore()
+
+	reporter, err := NewTestReporter("test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var formatted int32
+	reporter.AddMetric(failingMetric{formattedError{&formatted}})
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				reporter.UpdateMetrics(DefaultReqParams(endpointName))
+			}
+		}()
+	}
+	wg.Wait()
+
+	if formatted != 1 {
+		t.Errorf("error: expected the error to be formatted once for the log, got %d", formatted)
+	}
+	if suppressed := atomic.LoadInt64(&reporter.suppressedUpdateErrors); suppressed != 799 {
+		t.Errorf("error: expected %d suppressed errors, got %d", 799, suppressed)
+	}
+}
+
+func TestUpdateInvalidParams(t *testing.T) {
+
+	_, restore := captureLog()
+	defer restore()
+
+	reporter, err := NewTestReporter("test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	reporter.AddMetric(NewReqPerEndpoint())
+	reporter.AddMetric(NewErrorRatePerEndpoint())
+	reporter.AddMetric(NewStatusCodePerEndpoint())
+	reporter.AddMetric(NewHTTPEndpointMetric())
+
+	tests := []struct {
+		name   string
+		params map[string]interface{}
+		errors int
+	}{
+		{"missing status code", map[string]interface{}{ParamEndpointName: endpointName, ParamReqStartTime: time.Now()}, 3},
+		{"status code of the wrong type", map[string]interface{}{ParamEndpointName: endpointName, ParamStatusCode: "200", ParamReqStartTime: time.Now()}, 3},
+		{"endpoint name of the wrong type", map[string]interface{}{ParamEndpointName: 42, ParamStatusCode: 200, ParamReqStartTime: time.Now()}, 4},
+	}
+	for _, test := range tests {
+		var updateErrs UpdateErrors
+		if err := reporter.UpdateMetrics(test.params); !errors.As(err, &updateErrs) || len(updateErrs) != test.errors {
+			t.Errorf("error: expected %d errors for the %s, got %v", test.errors, test.name, err)
+		}
+	}
+
+	if value := reporter.Collect()["Component/ErrorCount/overall[errors]"]; value != 0 {
+		t.Errorf("error: expected the invalid requests not to be counted, got %f errors", value)
+	}
+}
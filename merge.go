@@ -0,0 +1,95 @@
+package simplerelic
+
+import "strings"
+
+// units of the values which are averaged when merged, the others are counts and summed
+var averagedUnits = []string{"[ms]", "[sec]", "[ratio]", "[percent]", "[state]", "[requests/connection]"}
+
+// units of the values identifying rather than measuring, e.g. the build id
+// of SetBuildInfo, the highest of them is kept when merged
+var identifierUnits = []string{"[id]"}
+
+// MergeValueMaps merges the values collected by several processes, e.g. the
+// workers of a prefork server, into the values of a single reporter.
+// Counts (e.g. [requests], [errors]) are summed. Averages and rates
+// (e.g. [ms], [ratio], [percent]) are averaged weighted by the number of
+// requests of the endpoint, Component/ReqPerEndpoint/<endpoint>[requests],
+// or equally when a map has no such count. Percentiles can only be
+// approximated this way. Identifiers (e.g. [id]) are not summed, the highest is kept.
+func MergeValueMaps(maps ...map[string]float32) map[string]float32 {
+
+	merged := make(map[string]float32)
+	weights := make(map[string]float32)
+	for _, values := range maps {
+		for name, value := range values {
+			if isIdentifier(name) {
+				if current, ok := merged[name]; !ok || value > current {
+					merged[name] = value
+				}
+				continue
+			}
+			if !isAveraged(name) {
+				merged[name] += value
+				continue
+			}
+
+			weight := float32(1)
+			if requests, ok := values[requestCountName(name)]; ok {
+				weight = requests
+			}
+			merged[name] += weight * value
+			weights[name] += weight
+		}
+	}
+
+	for name, weight := range weights {
+		if weight > 0 {
+			merged[name] /= weight
+		} else {
+			// none of the processes had requests
+			merged[name] = 0
+		}
+	}
+
+	return merged
+}
+
+// isAveraged reports whether the value is an average or a rate
+func isAveraged(name string) bool {
+	if strings.HasPrefix(name, "Component/ResponseTimeSum/") {
+		return false
+	}
+	for _, unit := range averagedUnits {
+		if strings.HasSuffix(name, unit) {
+			return true
+		}
+	}
+	return false
+}
+
+// isIdentifier reports whether the value identifies rather than measures
+func isIdentifier(name string) bool {
+	for _, unit := range identifierUnits {
+		if strings.HasSuffix(name, unit) {
+			return true
+		}
+	}
+	return false
+}
+
+// requestCountName is the name of the request count of the endpoint of the value,
+// e.g. Component/ReqPerEndpoint/log[requests] for Component/ResponseTimePerEndpoint/log[ms]
+func requestCountName(name string) string {
+	if i := strings.LastIndex(name, "["); i >= 0 {
+		name = name[:i]
+	}
+
+	parts := strings.SplitN(name, "/", 3)
+	if len(parts) < 3 {
+		return ""
+	}
+	if endpoint := parts[2]; endpoint != "overall" {
+		return "Component/ReqPerEndpoint/" + endpoint + "[requests]"
+	}
+	return "Component/Req/overall[requests]"
+}
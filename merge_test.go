@@ -0,0 +1,93 @@
+package simplerelic
+
+import (
+	"math"
+	"testing"
+)
+
+func TestMergeValueMaps(t *testing.T) {
+
+	first := map[string]float32{
+		"Component/ReqPerEndpoint/log[requests]":             30,
+		"Component/Req/overall[requests]":                    30,
+		"Component/ErrorCount/log[errors]":                   3,
+		"Component/ResponseTimePerEndpoint/log[ms]":          10,
+		"Component/ResponseTime/overall[ms]":                 10,
+		"Component/ResponseTimeSum/log[ms]":                  300,
+		"Component/ErrorRatePerEndpoint/log[ratio]":          0.1,
+		"Component/ResponseTimePerEndpoint/search[ms]":       40,
+		"Component/Reporter/SendLatency[ms]":                 20,
+		"Component/ResponseTimePerEndpoint/idle[ms]":         0,
+		"Component/ReqPerEndpoint/idle[requests]":            0,
+		"Component/ResponseTimeP95PerEndpoint/search[ms]":    80,
+		"Component/ReqPerEndpoint/search/tenant=a[requests]": 1,
+
+		"Component/ReqPerConnection/overall[requests/connection]": 2,
+	}
+	second := map[string]float32{
+		"Component/ReqPerEndpoint/log[requests]":     10,
+		"Component/Req/overall[requests]":            10,
+		"Component/ErrorCount/log[errors]":           5,
+		"Component/ResponseTimePerEndpoint/log[ms]":  30,
+		"Component/ResponseTime/overall[ms]":         30,
+		"Component/ResponseTimeSum/log[ms]":          300,
+		"Component/ErrorRatePerEndpoint/log[ratio]":  0.5,
+		"Component/Reporter/SendLatency[ms]":         40,
+		"Component/ResponseTimePerEndpoint/idle[ms]": 0,
+		"Component/ReqPerEndpoint/idle[requests]":    0,
+
+		"Component/ReqPerConnection/overall[requests/connection]": 6,
+	}
+
+	merged := MergeValueMaps(first, second)
+	expected := map[string]float32{
+		// counts are summed
+		"Component/ReqPerEndpoint/log[requests]":             40,
+		"Component/Req/overall[requests]":                    40,
+		"Component/ErrorCount/log[errors]":                   8,
+		"Component/ResponseTimeSum/log[ms]":                  600,
+		"Component/ReqPerEndpoint/search/tenant=a[requests]": 1,
+
+		// averages are weighted by the requests of the endpoint
+		"Component/ResponseTimePerEndpoint/log[ms]": 15,
+		"Component/ResponseTime/overall[ms]":        15,
+		"Component/ErrorRatePerEndpoint/log[ratio]": 0.2,
+
+		"Component/ReqPerConnection/overall[requests/connection]": 3,
+
+		// without the request count equally
+		"Component/Reporter/SendLatency[ms]": 30,
+
+		// only in one of the maps
+		"Component/ResponseTimePerEndpoint/search[ms]":    40,
+		"Component/ResponseTimeP95PerEndpoint/search[ms]": 80,
+
+		// no requests at all
+		"Component/ResponseTimePerEndpoint/idle[ms]": 0,
+	}
+	for name, value := range expected {
+		if math.Abs(float64(merged[name]-value)) > 1e-5 {
+			t.Errorf("error: expected %s to be %f, got %f", name, value, merged[name])
+		}
+	}
+	if len(merged) != len(expected)+1 {
+		t.Errorf("error: expected %d values, got %d", len(expected)+1, len(merged))
+	}
+
+	if merged := MergeValueMaps(); len(merged) != 0 {
+		t.Errorf("error: expected no values, got %v", merged)
+	}
+}
+
+func TestMergeBuildID(t *testing.T) {
+
+	// the workers of a deploy in progress report different builds
+	merged := MergeValueMaps(
+		map[string]float32{"Component/Build/Deployed[id]": 7},
+		map[string]float32{"Component/Build/Deployed[id]": 7},
+		map[string]float32{"Component/Build/Deployed[id]": 5},
+	)
+	if value := merged["Component/Build/Deployed[id]"]; value != 7 {
+		t.Errorf("error: expected the build id %f, got %f", 7., value)
+	}
+}
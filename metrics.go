@@ -1,7 +1,14 @@
 package simplerelic
 
 import (
+	"container/list"
 	"errors"
+	"math/rand"
+	"mime"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
 	"sync"
 	"time"
 )
@@ -24,8 +31,135 @@ type AppMetric interface {
 	ValueMap() map[string]float32
 }
 
+// SummaryMetric is an optional interface for metrics reporting summary values
+// (total, count, min, max and sum of squares) rather than a single float.
+// Summaries let NewRelic aggregate the values correctly across harvests.
+type SummaryMetric interface {
+	AppMetric
+
+	// SummaryMap extracts all summary values to be reported to NewRelic.
+	// It is called right before ValueMap in every reporting cycle and must
+	// not clear the values, ValueMap is still responsible for that.
+	// A summary takes precedence over the value of the same name
+	// returned by ValueMap.
+	SummaryMap() map[string]*MetricSummary
+}
+
+// MetricSummary is a metric value in the summary form of NewRelic plugin API
+type MetricSummary struct {
+	Total        float32 `json:"total"`
+	Count        int     `json:"count"`
+	Min          float32 `json:"min"`
+	Max          float32 `json:"max"`
+	SumOfSquares float32 `json:"sum_of_squares"`
+}
+
+// NewMetricSummary creates a summary of the given values
+func NewMetricSummary(values []float32) *MetricSummary {
+	summary := &MetricSummary{}
+	for _, value := range values {
+		summary.Add(value)
+	}
+	return summary
+}
+
+// Add a single value to the summary
+func (s *MetricSummary) Add(value float32) {
+	if s.Count == 0 || value < s.Min {
+		s.Min = value
+	}
+	if s.Count == 0 || value > s.Max {
+		s.Max = value
+	}
+	s.Total += value
+	s.SumOfSquares += value * value
+	s.Count++
+}
+
+// Peeker is an optional interface for metrics whose values can be read
+// outside of the reporting cycle, e.g. for debugging
+type Peeker interface {
+
+	// Peek returns the same values as ValueMap would,
+	// but without clearing them
+	Peek() map[string]float32
+}
+
+// Clearer is an optional interface for metrics which can discard
+// their values without extracting them
+type Clearer interface {
+	Clear()
+}
+
+// SnapshotMetric is an optional interface for metrics which retain the values
+// extracted by ValueMap as snapshots until the report was sent. The reporter
+// calls ClearSnapshots once the report was sent or spooled, also partly, after
+// a failed one the snapshots are reported again together with the new values.
+type SnapshotMetric interface {
+	BufferedSnapshots() int
+	ClearSnapshots()
+}
+
+// freezer is implemented by the standard metrics. freeze takes the values
+// of the interval out of the metric and returns the function computing
+// them, which the reporter calls without holding back the updates.
+type freezer interface {
+	freeze() func() map[string]float32
+}
+
+// summaryFreezer is implemented by the standard metrics reporting summaries,
+// freezeSummaries is freeze computing also the summaries of the interval
+type summaryFreezer interface {
+	freezeSummaries() func() (map[string]float32, map[string]*MetricSummary)
+}
+
+// overallReporter is implemented by the standard metrics, isOverall tells
+// the values aggregating all the endpoints apart from the ones per endpoint
+type overallReporter interface {
+	isOverall(name string) bool
+}
+
+// BufferedMetric is an optional interface for metrics which can tell how
+// many requests they have buffered since the last report. It is used
+// by the reporter to flush early when too many requests accumulate.
+type BufferedMetric interface {
+	BufferedCount() int
+}
+
+// RequestStarter is implemented by metrics tracking the start of the requests.
+// RequestStarted is called with the parameters created by DefaultReqParams
+// when the request begins, Update when it ends.
+type RequestStarter interface {
+	RequestStarted(params map[string]interface{})
+}
+
+// Names of the request parameters used by the standard metrics
+const (
+	ParamEndpointName = "endpointName"
+	ParamStatusCode   = "statusCode"
+	ParamReqStartTime = "reqStartTime"
+	ParamContentType  = "contentType"
+	ParamRequestID    = "requestID"
+	ParamLabels       = "labels"
+	ParamConnectionID = "connectionID"
+)
+
+// ParamKeys overrides the names of the request parameters read by a metric,
+// for integrations that already populate the parameters under other names.
+// Empty names fall back to the defaults.
+type ParamKeys struct {
+	EndpointName string
+	StatusCode   string
+	ReqStartTime string
+	ContentType  string
+	Labels       string
+}
+
 const (
 	unknownEndpoint = "other"
+
+	// response times above this are considered a misconfigured start time
+	maxResponseTime = time.Hour
 )
 
 // StandardMetric is a base for metrics dealing with endpoints
@@ -36,252 +170,2593 @@ type StandardMetric struct {
 	namePrefix      string
 	allEPNamePrefix string
 	metricUnit      string
+
+	// when set, the number of distinct endpoints is reported under this name
+	cardinalityName string
+
+	// when set, the overall requests per second since the interval start
+	// are reported under this name
+	rateName      string
+	intervalStart time.Time
+
+	paramKeys ParamKeys
+
+	// endpoints which are neither counted nor reported. The map is replaced
+	// instead of modified, the reports read it without the lock.
+	excluded map[string]bool
+
+	// sum of reqCount so that BufferedCount doesn't iterate the endpoints
+	// on every request
+	buffered int
+
+	// values left out of the report, see SetEmitOverall and SetEmitPerEndpoint
+	omitOverall     bool
+	omitPerEndpoint bool
+
+	// harvestLock guards the values kept across the reports, which only the
+	// reports use, so that computing a report doesn't hold up the updates.
+	// It is taken after lock, never before.
+	harvestLock sync.Mutex
+
+	// counts extracted by the reports not sent yet, at most maxSnapshots
+	snapshots    []countSnapshot
+	maxSnapshots int
+
+	// endpoints requested before, reported as 0 when quiet, at most maxQuiet
+	seen     map[string]bool
+	maxQuiet int
+
+	// names of the reported values aggregating all the endpoints
+	overallNames map[string]bool
+}
+
+// countSnapshot holds the counts extracted by a report
+type countSnapshot struct {
+	start  time.Time
+	counts []map[string]int
+}
+
+// countFrame holds the counts of an interval taken out of a metric together
+// with the settings needed to report them without the lock
+type countFrame struct {
+	counts     map[string]int
+	reset      bool
+	start, end time.Time
+	excluded   map[string]bool
+
+	namePrefix      string
+	allEPNamePrefix string
+	metricUnit      string
+	cardinalityName string
+	rateName        string
+}
+
+// name of the metric reported for the endpoint
+func (frame *countFrame) name(endpoint string) string {
+	return frame.namePrefix + endpoint + frame.metricUnit
+}
+
+// overallName is the name of the metric aggregating all the endpoints
+func (frame *countFrame) overallName() string {
+	return frame.allEPNamePrefix + frame.metricUnit
+}
+
+// SetParamKeys overrides the names of the request parameters the metric reads.
+// It must be called before the metric is updated for the first time.
+func (m *StandardMetric) SetParamKeys(keys ParamKeys) {
+	m.paramKeys = keys
+}
+
+// param returns the request parameter under the key or the default key
+func (m *StandardMetric) param(params map[string]interface{}, key string, defaultKey string) (interface{}, bool) {
+	if key == "" {
+		key = defaultKey
+	}
+	value, ok := params[key]
+	return value, ok
+}
+
+func (m *StandardMetric) statusCode(params map[string]interface{}) (int, error) {
+	param, _ := m.param(params, m.paramKeys.StatusCode, ParamStatusCode)
+	statusCode, ok := param.(int)
+	if !ok {
+		return 0, errors.New("status code should be int")
+	}
+	return statusCode, nil
+}
+
+// name of the metric reported for the endpoint,
+// e.g. Component/ReqPerEndpoint/search[requests]
+func (m *StandardMetric) name(endpoint string) string {
+	return m.namePrefix + endpoint + m.metricUnit
+}
+
+// overallName is the name of the metric aggregating all the endpoints,
+// e.g. Component/Req/overall[requests]
+func (m *StandardMetric) overallName() string {
+	return m.allEPNamePrefix + m.metricUnit
+}
+
+// Exclude stops counting and reporting the endpoint, e.g. to keep
+// health checks from dominating the request counts
+func (m *StandardMetric) Exclude(endpoint string) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	excluded := make(map[string]bool, len(m.excluded)+1)
+	for name := range m.excluded {
+		excluded[name] = true
+	}
+	excluded[endpoint] = true
+	m.excluded = excluded
+	m.buffered -= m.reqCount[endpoint]
+	delete(m.reqCount, endpoint)
+}
+
+// SetEmitOverall enables (the default) or disables reporting of the values
+// aggregating all the endpoints, e.g. to keep only the per endpoint
+// response times when the overall one is charted elsewhere
+func (m *StandardMetric) SetEmitOverall(enable bool) {
+	m.lock.Lock()
+	m.omitOverall = !enable
+	m.lock.Unlock()
+}
+
+// SetEmitPerEndpoint enables (the default) or disables reporting of the values
+// per endpoint, e.g. to keep only the overall request count to save series
+func (m *StandardMetric) SetEmitPerEndpoint(enable bool) {
+	m.lock.Lock()
+	m.omitPerEndpoint = !enable
+	m.lock.Unlock()
+}
+
+// emitted merges the values per endpoint and the ones aggregating all the
+// endpoints, leaving out the ones disabled by SetEmitOverall and SetEmitPerEndpoint.
+// The names of the overall values are remembered for isOverall.
+func (m *StandardMetric) emitted(values map[string]float32, overall map[string]float32) map[string]float32 {
+	m.lock.RLock()
+	omitOverall, omitPerEndpoint := m.omitOverall, m.omitPerEndpoint
+	m.lock.RUnlock()
+
+	m.harvestLock.Lock()
+	for name := range overall {
+		if !m.overallNames[name] {
+			if m.overallNames == nil {
+				m.overallNames = make(map[string]bool)
+			}
+			m.overallNames[name] = true
+		}
+	}
+	m.harvestLock.Unlock()
+
+	if omitPerEndpoint {
+		values = make(map[string]float32, len(overall))
+	}
+	if !omitOverall {
+		for name, value := range overall {
+			values[name] = value
+		}
+	}
+	return values
+}
+
+// isOverall reports whether the metric reported the value of the name
+// as one aggregating all the endpoints, e.g. Component/Req/overall[requests]
+func (m *StandardMetric) isOverall(name string) bool {
+	m.harvestLock.Lock()
+	defer m.harvestLock.Unlock()
+
+	return m.overallNames[name]
+}
+
+// isExcluded reports whether the endpoint is excluded, the lock must be held
+func (m *StandardMetric) isExcluded(endpoint string) bool {
+	return m.excluded[endpoint]
+}
+
+func (m *StandardMetric) initReqCount() {
+	// initialize the metrics
+	for endpoint := range m.endpoints {
+		m.reqCount[endpoint] = 0
+	}
+	m.reqCount[unknownEndpoint] = 0
+}
+
+// BufferedCount returns number of requests counted since the last report
+func (m *StandardMetric) BufferedCount() int {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+
+	return m.buffered
+}
+
+// countRequest counts a request of the endpoint, the lock must be held
+func (m *StandardMetric) countRequest(endpoint string) {
+	m.reqCount[endpoint]++
+	m.buffered++
+}
+
+// resetCounts discards the request counts, the lock must be held
+func (m *StandardMetric) resetCounts() {
+	m.reqCount = make(map[string]int)
+	m.buffered = 0
+	m.intervalStart = nowFunc()
+}
+
+// Clear discards the values counted since the last report
+func (m *StandardMetric) Clear() {
+	m.lock.Lock()
+	m.resetCounts()
+	m.lock.Unlock()
+
+	m.ClearSnapshots()
+}
+
+// ClearEndpoint discards the values of the endpoint, e.g. once it is retired,
+// so that it isn't reported anymore until it is requested again
+func (m *StandardMetric) ClearEndpoint(endpoint string) {
+	m.lock.Lock()
+	m.clearCounts(func(key string) bool { return key == endpoint })
+	m.lock.Unlock()
+}
+
+// clearCounts discards the counts of the matching keys, also the retained
+// and the remembered quiet ones. The lock must be held.
+func (m *StandardMetric) clearCounts(match func(key string) bool) {
+	for key, count := range m.reqCount {
+		if match(key) {
+			m.buffered -= count
+			delete(m.reqCount, key)
+		}
+	}
+
+	m.harvestLock.Lock()
+	defer m.harvestLock.Unlock()
+
+	for _, snapshot := range m.snapshots {
+		for _, counts := range snapshot.counts {
+			for key := range counts {
+				if match(key) {
+					delete(counts, key)
+				}
+			}
+		}
+	}
+	for key := range m.seen {
+		if match(key) {
+			delete(m.seen, key)
+		}
+	}
+}
+
+// setMaxSnapshots enables retaining the counts of up to max unsent reports,
+// 0 disables it
+func (m *StandardMetric) setMaxSnapshots(max int) {
+	m.harvestLock.Lock()
+	defer m.harvestLock.Unlock()
+
+	if max < 0 {
+		max = 0
+	}
+	m.maxSnapshots = max
+	if len(m.snapshots) > max {
+		m.snapshots = m.snapshots[len(m.snapshots)-max:]
+	}
+}
+
+// setMaxQuietEndpoints enables remembering up to max endpoints requested
+// before, which are reported as 0 in the intervals without requests.
+// 0 disables it and forgets the endpoints.
+func (m *StandardMetric) setMaxQuietEndpoints(max int) {
+	m.harvestLock.Lock()
+	defer m.harvestLock.Unlock()
+
+	if max <= 0 {
+		m.maxQuiet = 0
+		m.seen = nil
+		return
+	}
+	m.maxQuiet = max
+	if m.seen == nil {
+		m.seen = make(map[string]bool)
+	}
+}
+
+// reportQuiet remembers the requested endpoints and adds 0 for the
+// remembered ones without requests to the values. The harvest lock must be held.
+func (m *StandardMetric) reportQuiet(frame *countFrame, counts map[string]int, metricMap map[string]float32) {
+	if m.maxQuiet == 0 {
+		return
+	}
+
+	for endpoint, value := range counts {
+		if value > 0 && !m.seen[endpoint] && len(m.seen) < m.maxQuiet {
+			m.seen[endpoint] = true
+		}
+	}
+	for endpoint := range m.seen {
+		if _, ok := counts[endpoint]; !ok && !frame.excluded[endpoint] {
+			metricMap[frame.name(endpoint)] = 0
+		}
+	}
+}
+
+// retainsSnapshots reports whether the metric retains unsent reports
+func (m *StandardMetric) retainsSnapshots() bool {
+	m.harvestLock.Lock()
+	defer m.harvestLock.Unlock()
+
+	return m.maxSnapshots > 0
+}
+
+// BufferedSnapshots returns number of reports retained until they are sent
+func (m *StandardMetric) BufferedSnapshots() int {
+	m.harvestLock.Lock()
+	defer m.harvestLock.Unlock()
+
+	return len(m.snapshots)
+}
+
+// ClearSnapshots discards the retained reports once they were sent
+func (m *StandardMetric) ClearSnapshots() {
+	m.harvestLock.Lock()
+	m.snapshots = nil
+	m.harvestLock.Unlock()
+}
+
+// retain moves the counts of the interval starting at start into a new snapshot
+// when reset is set, dropping the oldest snapshots beyond maxSnapshots. It returns
+// the sums of the snapshots (and of the counts without reset) and the start of
+// the oldest of them. The harvest lock must be held, the counts must have been
+// taken out of the metric after a reset.
+func (m *StandardMetric) retain(reset bool, start time.Time, counts ...map[string]int) ([]map[string]int, time.Time) {
+	if reset {
+		m.snapshots = append(m.snapshots, countSnapshot{start: start, counts: counts})
+		if len(m.snapshots) > m.maxSnapshots {
+			m.snapshots = m.snapshots[len(m.snapshots)-m.maxSnapshots:]
+		}
+	}
+
+	sums := make([]map[string]int, len(counts))
+	for i := range sums {
+		sums[i] = make(map[string]int)
+	}
+	add := func(counts []map[string]int) {
+		for i, count := range counts {
+			for endpoint, value := range count {
+				sums[i][endpoint] += value
+			}
+		}
+	}
+
+	for _, snapshot := range m.snapshots {
+		add(snapshot.counts)
+	}
+	if len(m.snapshots) > 0 {
+		start = m.snapshots[0].start
+	}
+	if !reset {
+		add(counts)
+	}
+
+	return sums, start
+}
+
+// takeCounts takes the request counts of the interval out of the metric when
+// reset is set, or copies them. The lock must be held.
+func (m *StandardMetric) takeCounts(reset bool) countFrame {
+	frame := countFrame{
+		counts:          m.reqCount,
+		reset:           reset,
+		start:           m.intervalStart,
+		end:             nowFunc(),
+		excluded:        m.excluded,
+		namePrefix:      m.namePrefix,
+		allEPNamePrefix: m.allEPNamePrefix,
+		metricUnit:      m.metricUnit,
+		cardinalityName: m.cardinalityName,
+		rateName:        m.rateName,
+	}
+
+	if reset {
+		m.resetCounts()
+	} else {
+		frame.counts = copyCounts(m.reqCount)
+	}
+	return frame
+}
+
+// copyCounts returns a copy of the counts
+func copyCounts(counts map[string]int) map[string]int {
+	copied := make(map[string]int, len(counts))
+	for key, value := range counts {
+		copied[key] = value
+	}
+	return copied
+}
+
+// freezeCounts takes the request counts of the interval out of the metric,
+// the returned function reports them without holding up the updates
+func (m *StandardMetric) freezeCounts() func() map[string]float32 {
+	m.lock.Lock()
+	frame := m.takeCounts(true)
+	m.lock.Unlock()
+
+	return func() map[string]float32 {
+		return m.emitted(m.countValues(&frame))
+	}
+}
+
+// peekCounts reports the request counts without clearing them
+func (m *StandardMetric) peekCounts() map[string]float32 {
+	m.lock.Lock()
+	frame := m.takeCounts(false)
+	m.lock.Unlock()
+
+	return m.emitted(m.countValues(&frame))
+}
+
+// countValues reports the request counts of the frame per endpoint and overall
+func (m *StandardMetric) countValues(frame *countFrame) (map[string]float32, map[string]float32) {
+
+	metricMap := make(map[string]float32)
+	overall := make(map[string]float32)
+
+	m.harvestLock.Lock()
+	counts, start := frame.counts, frame.start
+	if m.maxSnapshots > 0 {
+		var sums []map[string]int
+		sums, start = m.retain(frame.reset, start, counts)
+		counts = sums[0]
+	}
+	m.reportQuiet(frame, counts, metricMap)
+	m.harvestLock.Unlock()
+
+	var numReqAllEndpoints int
+	var numEndpoints int
+	for endpoint, value := range counts {
+		if frame.excluded[endpoint] {
+			continue
+		}
+
+		metricName := frame.name(endpoint)
+		metricMap[metricName] = float32(value)
+
+		numReqAllEndpoints += value
+		if value > 0 {
+			numEndpoints++
+		}
+	}
+
+	if frame.cardinalityName != "" {
+		overall[frame.cardinalityName] = float32(numEndpoints)
+	}
+
+	if frame.rateName != "" {
+		overall[frame.rateName] = 0.
+		if seconds := frame.end.Sub(start).Seconds(); seconds > 0 {
+			overall[frame.rateName] = float32(float64(numReqAllEndpoints) / seconds)
+		}
+	}
+
+	overall[frame.overallName()] = float32(numReqAllEndpoints)
+
+	return metricMap, overall
+}
+
+// responseTime returns the time elapsed since the start of the request,
+// ok is false when the response time is missing or should be ignored
+func (m *StandardMetric) responseTime(params map[string]interface{}) (elapsed time.Duration, ok bool, err error) {
+	param, _ := m.param(params, m.paramKeys.ReqStartTime, ParamReqStartTime)
+	startTime, ok := param.(time.Time)
+	if !ok {
+		return 0, false, errors.New("reqStart time should be time.Time")
+	}
+
+	elapsed = nowFunc().Sub(startTime)
+	if elapsed < 0 {
+		// the clock was adjusted during the request
+		Log.Printf("negative response time %v, using 0 instead", elapsed)
+		elapsed = 0
+	}
+	if elapsed > maxResponseTime {
+		Log.Printf("response time %v exceeds %v, ignoring it", elapsed, maxResponseTime)
+		return 0, false, nil
+	}
+
+	return elapsed, true, nil
+}
+
+// endpointName returns the name of the endpoint, "other" when it is missing
+func (m *StandardMetric) endpointName(params map[string]interface{}) (string, error) {
+	param, ok := m.param(params, m.paramKeys.EndpointName, ParamEndpointName)
+	if !ok {
+		return unknownEndpoint, nil
+	}
+
+	endpointName, ok := param.(string)
+	if !ok {
+		return "", errors.New("endpoint name should be string")
+	}
+	return endpointName, nil
+}
+
+/************************************
+ * requests per endpoint
+ ***********************************/
+
+// ReqPerEndpoint holds number of requests per endpoint
+type ReqPerEndpoint struct {
+	*StandardMetric
+
+	// requests per endpoint and combination of the labels, see SetReportLabels
+	labelKeys      []string
+	maxLabelSeries int
+	labelSeries    map[string]map[string]bool
+	labelCount     map[string]int
+}
+
+// NewReqPerEndpoint creates new ReqPerEndpoint metric
+func NewReqPerEndpoint() *ReqPerEndpoint {
+
+	metric := &ReqPerEndpoint{
+		StandardMetric: &StandardMetric{
+			reqCount:        make(map[string]int),
+			namePrefix:      "Component/ReqPerEndpoint/",
+			allEPNamePrefix: "Component/Req/overall",
+			metricUnit:      "[requests]",
+		},
+	}
+
+	metric.initReqCount()
+
+	return metric
+}
+
+// SetReportCardinality enables reporting of the number of distinct endpoints
+// requested within the interval. A sudden growth usually means that ids
+// ended up in the endpoint names.
+func (m *ReqPerEndpoint) SetReportCardinality(enable bool) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	m.cardinalityName = ""
+	if enable {
+		m.cardinalityName = "Component/Cardinality/endpoints[endpoints]"
+	}
+}
+
+// SetReportOverallRate enables reporting of all the requests per second
+// within the interval, Component/Req/overall[requests/sec], next to the count
+func (m *ReqPerEndpoint) SetReportOverallRate(enable bool) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	m.rateName = ""
+	if enable {
+		m.rateName = m.allEPNamePrefix + "[requests/sec]"
+		m.intervalStart = nowFunc()
+	}
+}
+
+// SetMaxSnapshots retains the counts of up to max reports which failed to be
+// sent, so that they are reported again with the next one. Beyond max the
+// oldest are dropped, 0 (the default) disables the retention.
+func (m *ReqPerEndpoint) SetMaxSnapshots(max int) {
+	m.setMaxSnapshots(max)
+}
+
+// SetReportQuietEndpoints reports the endpoints requested before as 0 in
+// the intervals without any of their requests, so that the charts show zero
+// instead of no data. At most max endpoints are remembered, the ones
+// requested after that are reported only when requested. 0 (the default)
+// disables it.
+func (m *ReqPerEndpoint) SetReportQuietEndpoints(max int) {
+	m.setMaxQuietEndpoints(max)
+}
+
+// SetReportLabels enables counting the requests per endpoint and combination
+// of the labels passed in the labels parameter (map[string]string), e.g.
+// Component/ReqPerEndpoint/log/tenant=acme[requests] for the key tenant.
+// The characters /, [ and ] of the labels are reported as _.
+// At most maxSeries combinations are reported per endpoint, the requests
+// with any further combination are reported as Component/ReqPerEndpoint/log/other[requests].
+func (m *ReqPerEndpoint) SetReportLabels(maxSeries int, keys ...string) error {
+	if len(keys) == 0 {
+		return errors.New("Please specify label keys")
+	}
+	if maxSeries < 1 {
+		return errors.New("Please specify at least 1 label series")
+	}
+
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	m.labelKeys = append([]string(nil), keys...)
+	sort.Strings(m.labelKeys)
+	m.maxLabelSeries = maxSeries
+	m.labelSeries = make(map[string]map[string]bool)
+	m.labelCount = make(map[string]int)
+	return nil
+}
+
+// Clear discards the values counted since the last report
+func (m *ReqPerEndpoint) Clear() {
+	m.StandardMetric.Clear()
+
+	m.lock.Lock()
+	if m.labelCount != nil {
+		m.labelCount = make(map[string]int)
+	}
+	m.lock.Unlock()
+}
+
+// ClearEndpoint discards the values of the endpoint including its label series
+func (m *ReqPerEndpoint) ClearEndpoint(endpoint string) {
+	m.StandardMetric.ClearEndpoint(endpoint)
+
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	for name := range m.labelSeries[endpoint] {
+		delete(m.labelCount, endpoint+"/"+name)
+	}
+	delete(m.labelCount, endpoint+"/"+unknownEndpoint)
+	delete(m.labelSeries, endpoint)
+}
+
+// labelReplacer keeps the labels from adding segments or a unit to the metric names
+var labelReplacer = strings.NewReplacer("/", "_", "[", "_", "]", "_")
+
+// labelSeriesName returns the labels of the series counting the request,
+// empty without any of the label keys. The lock must be held.
+func (m *ReqPerEndpoint) labelSeriesName(endpoint string, params map[string]interface{}) string {
+	param, _ := m.param(params, m.paramKeys.Labels, ParamLabels)
+	labels, _ := param.(map[string]string)
+
+	var parts []string
+	for _, key := range m.labelKeys {
+		if value, ok := labels[key]; ok {
+			parts = append(parts, labelReplacer.Replace(key)+"="+labelReplacer.Replace(value))
+		}
+	}
+	if len(parts) == 0 {
+		return ""
+	}
+
+	name := strings.Join(parts, "/")
+	series, ok := m.labelSeries[endpoint]
+	if !ok {
+		series = make(map[string]bool)
+		m.labelSeries[endpoint] = series
+	}
+	if !series[name] && len(series) >= m.maxLabelSeries {
+		return unknownEndpoint
+	}
+	series[name] = true
+	return name
+}
+
+// Update the metric values
+func (m *ReqPerEndpoint) Update(params map[string]interface{}) error {
+	endpointName, err := m.endpointName(params)
+	if err != nil {
+		return err
+	}
+	m.lock.Lock()
+	if !m.isExcluded(endpointName) {
+		m.countRequest(endpointName)
+		if len(m.labelKeys) > 0 {
+			if name := m.labelSeriesName(endpointName, params); name != "" {
+				m.labelCount[endpointName+"/"+name]++
+			}
+		}
+	}
+	m.lock.Unlock()
+
+	return nil
+}
+
+// ValueMap extract all the metrics to be reported
+func (m *ReqPerEndpoint) ValueMap() map[string]float32 {
+	return m.freeze()()
+}
+
+// Peek returns the current values without clearing them
+func (m *ReqPerEndpoint) Peek() map[string]float32 {
+	m.lock.Lock()
+	frame := m.takeCounts(false)
+	labelCount := copyCounts(m.labelCount)
+	m.lock.Unlock()
+
+	return m.emitted(m.values(&frame, labelCount))
+}
+
+// freeze takes the counts of the interval out of the metric, the returned
+// function reports them without holding up the updates
+func (m *ReqPerEndpoint) freeze() func() map[string]float32 {
+	m.lock.Lock()
+	frame := m.takeCounts(true)
+	labelCount := m.labelCount
+	if labelCount != nil {
+		m.labelCount = make(map[string]int)
+	}
+	m.lock.Unlock()
+
+	return func() map[string]float32 {
+		return m.emitted(m.values(&frame, labelCount))
+	}
+}
+
+func (m *ReqPerEndpoint) values(frame *countFrame, labelCount map[string]int) (map[string]float32, map[string]float32) {
+
+	metrics, overall := m.countValues(frame)
+	for series, count := range labelCount {
+		metrics[frame.name(series)] = float32(count)
+	}
+
+	return metrics, overall
+}
+
+/**************************************************
+* Error rate per endpoint
+**************************************************/
+
+// RateFormat selects how a rate is represented in the reported values
+type RateFormat int
+
+const (
+	// RateLegacy reports a ratio in [0,1] under the [percent] unit.
+	// Kept as the default for backward compatibility.
+	RateLegacy RateFormat = iota
+
+	// RatePercent reports a real percentage in [0,100] under the [percent] unit
+	RatePercent
+
+	// RateRatio reports a ratio in [0,1] under the [ratio] unit
+	RateRatio
+)
+
+// OverallAggregation selects how the overall rate is computed
+type OverallAggregation int
+
+const (
+	// AggregateWeighted divides all errors by all requests so busy endpoints
+	// weigh more (default)
+	AggregateWeighted OverallAggregation = iota
+
+	// AggregateMean is the simple mean of the rates of endpoints with traffic
+	AggregateMean
+)
+
+// ErrorRatePerEndpoint holds the percentage of error requests per endpoint
+type ErrorRatePerEndpoint struct {
+	*StandardMetric
+	errorRateSettings
+	errorCount map[string]int
+
+	// ErrorStatusThreshold is the lowest status code counted as an error,
+	// 400 by default and 500 for NewServerErrorRatePerEndpoint. Set it to
+	// e.g. 401 to not count bad requests. It must be set before the metric
+	// is updated for the first time.
+	ErrorStatusThreshold int
+
+	// do not count rate limited (429) requests as errors
+	ignoreRateLimited bool
+
+	// client (4xx) and server (5xx) errors, see SetReportErrorClasses
+	clientErrorCount map[string]int
+	serverErrorCount map[string]int
+
+	// endpoints reported before, reported as 0 in the intervals without
+	// requests. Guarded by the harvest lock.
+	reported map[string]bool
+}
+
+// errorRateSettings are the settings of ErrorRatePerEndpoint the report
+// depends on, copied into every frame so it is computed without the lock
+type errorRateSettings struct {
+	rateScale float32
+
+	// absolute number of errors is reported under this prefix
+	countNamePrefix string
+
+	// the client, server, burn and success rates are reported under this
+	// prefix of the metric, e.g. Component/ErrorRate/, so that several error
+	// rate metrics don't report them under the same names
+	ratePrefix string
+
+	overallAggregation OverallAggregation
+
+	// when set, client (4xx) and server (5xx) errors are counted and reported separately
+	reportErrorClasses bool
+
+	// when set, the complement of the error rate is reported as success rate
+	reportSuccessRate bool
+
+	// acceptable error ratio of the burn rate, 0 disables it
+	errorBudget float64
+}
+
+// errorFrame holds the counts of an interval taken out of ErrorRatePerEndpoint
+type errorFrame struct {
+	countFrame
+	errorRateSettings
+	errorCount       map[string]int
+	clientErrorCount map[string]int
+	serverErrorCount map[string]int
+}
+
+// NewErrorRatePerEndpoint creates new POEPerEndpoint metric
+func NewErrorRatePerEndpoint() *ErrorRatePerEndpoint {
+	return newErrorRate("Component/ErrorRatePerEndpoint/", "Component/ErrorRate/overall", "Component/ErrorCount/", 400)
+}
+
+// NewServerErrorRatePerEndpoint creates new error rate metric
+// counting only server errors (5xx) as errors
+func NewServerErrorRatePerEndpoint() *ErrorRatePerEndpoint {
+	return newErrorRate("Component/ServerErrorRatePerEndpoint/", "Component/ServerErrorRate/overall", "Component/ServerErrorCount/", 500)
+}
+
+func newErrorRate(namePrefix string, allEPNamePrefix string, countNamePrefix string, errorThreshold int) *ErrorRatePerEndpoint {
+
+	metric := &ErrorRatePerEndpoint{
+		StandardMetric: &StandardMetric{
+			reqCount:        make(map[string]int),
+			namePrefix:      namePrefix,
+			allEPNamePrefix: allEPNamePrefix,
+			metricUnit:      "[percent]",
+		},
+		errorRateSettings: errorRateSettings{
+			rateScale:       1.,
+			countNamePrefix: countNamePrefix,
+			ratePrefix:      strings.TrimSuffix(allEPNamePrefix, "overall"),
+		},
+		errorCount:           make(map[string]int),
+		clientErrorCount:     make(map[string]int),
+		serverErrorCount:     make(map[string]int),
+		ErrorStatusThreshold: errorThreshold,
+		reported:             make(map[string]bool),
+	}
+
+	// initialize the metrics
+	metric.initReqCount()
+	for endpoint := range metric.endpoints {
+		metric.errorCount[endpoint] = 0
+	}
+	metric.errorCount[unknownEndpoint] = 0
+
+	return metric
+}
+
+// SetRateFormat sets the representation of the reported error rates
+func (m *ErrorRatePerEndpoint) SetRateFormat(format RateFormat) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	switch format {
+	case RatePercent:
+		m.rateScale = 100.
+		m.metricUnit = "[percent]"
+	case RateRatio:
+		m.rateScale = 1.
+		m.metricUnit = "[ratio]"
+	default:
+		m.rateScale = 1.
+		m.metricUnit = "[percent]"
+	}
+}
+
+// Clear discards the values counted since the last report
+func (m *ErrorRatePerEndpoint) Clear() {
+	m.lock.Lock()
+	m.resetCounts()
+	m.errorCount = make(map[string]int)
+	m.clientErrorCount = make(map[string]int)
+	m.serverErrorCount = make(map[string]int)
+	m.lock.Unlock()
+
+	m.harvestLock.Lock()
+	m.snapshots = nil
+	m.reported = make(map[string]bool)
+	m.harvestLock.Unlock()
+}
+
+// ClearEndpoint discards the requests and errors of the endpoint
+func (m *ErrorRatePerEndpoint) ClearEndpoint(endpoint string) {
+	m.lock.Lock()
+	m.clearCounts(func(key string) bool { return key == endpoint })
+	delete(m.errorCount, endpoint)
+	delete(m.clientErrorCount, endpoint)
+	delete(m.serverErrorCount, endpoint)
+	m.lock.Unlock()
+
+	m.harvestLock.Lock()
+	delete(m.reported, endpoint)
+	m.harvestLock.Unlock()
+}
+
+// SetOverallAggregation sets how the overall error rate is computed
+func (m *ErrorRatePerEndpoint) SetOverallAggregation(aggregation OverallAggregation) {
+	m.lock.Lock()
+	m.overallAggregation = aggregation
+	m.lock.Unlock()
+}
+
+// SetReportErrorClasses enables reporting of the client (4xx) and server (5xx)
+// error rates next to the combined one, e.g. Component/ErrorRate/ClientErrorRate/log[ratio]
+// and Component/ErrorRate/ServerErrorRate/log[ratio]
+func (m *ErrorRatePerEndpoint) SetReportErrorClasses(enable bool) {
+	m.lock.Lock()
+	m.reportErrorClasses = enable
+	m.lock.Unlock()
+}
+
+// SetReportSuccessRate enables reporting of the ratio of the requests which are
+// not errors by the threshold of the metric, e.g. Component/ErrorRate/SuccessRate/log[ratio].
+// It's reported only for the endpoints with requests.
+func (m *ErrorRatePerEndpoint) SetReportSuccessRate(enable bool) {
+	m.lock.Lock()
+	m.reportSuccessRate = enable
+	m.lock.Unlock()
+}
+
+// SetReportBurnRate enables reporting of the error rate relative to the error
+// budget of the SLO, e.g. 0.001 when 0.1% of the requests may fail, as
+// Component/ErrorRate/BurnRate/log[ratio]. Above 1 the budget is used up before the end
+// of the SLO period. Endpoints without requests burn at 0. Budget 0 disables it.
+func (m *ErrorRatePerEndpoint) SetReportBurnRate(budget float64) error {
+	if budget < 0 || budget > 1 {
+		return errors.New("Please specify error budget between 0 and 1")
+	}
+
+	m.lock.Lock()
+	m.errorBudget = budget
+	m.lock.Unlock()
+	return nil
+}
+
+// burnRate is the ratio of the errors to the requests relative to the error budget
+func (s *errorRateSettings) burnRate(errorCount int, requests int) float32 {
+	return ratio(errorCount, requests) / float32(s.errorBudget)
+}
+
+// SetMaxSnapshots retains the counts of up to max reports which failed to be
+// sent, so that they are reported again with the next one. Beyond max the
+// oldest are dropped, 0 (the default) disables the retention.
+func (m *ErrorRatePerEndpoint) SetMaxSnapshots(max int) {
+	m.setMaxSnapshots(max)
+}
+
+// SetIgnoreRateLimited excludes rate limited (429) requests from errors,
+// useful when they are already tracked by RateLimitedPerEndpoint
+func (m *ErrorRatePerEndpoint) SetIgnoreRateLimited(ignore bool) {
+	m.lock.Lock()
+	m.ignoreRateLimited = ignore
+	m.lock.Unlock()
+}
+
+// Update the metric values
+func (m *ErrorRatePerEndpoint) Update(params map[string]interface{}) error {
+	endpointName, err := m.endpointName(params)
+	if err != nil {
+		return err
+	}
+	statusCode, err := m.statusCode(params)
+	if err != nil {
+		return err
+	}
+	m.lock.Lock()
+	if m.isExcluded(endpointName) {
+		m.lock.Unlock()
+		return nil
+	}
+	rateLimited := m.ignoreRateLimited && statusCode == http.StatusTooManyRequests
+	if statusCode >= m.ErrorStatusThreshold && !rateLimited {
+		m.errorCount[endpointName]++
+	}
+	if m.reportErrorClasses && !rateLimited {
+		if statusCode >= 500 {
+			m.serverErrorCount[endpointName]++
+		} else if statusCode >= 400 {
+			m.clientErrorCount[endpointName]++
+		}
+	}
+	m.countRequest(endpointName)
+	m.lock.Unlock()
+
+	return nil
+}
+
+// ValueMap extract all the metrics to be reported
+func (m *ErrorRatePerEndpoint) ValueMap() map[string]float32 {
+	return m.freeze()()
+}
+
+// Peek returns the current values without clearing them
+func (m *ErrorRatePerEndpoint) Peek() map[string]float32 {
+	m.lock.Lock()
+	frame := m.take(false)
+	m.lock.Unlock()
+
+	return m.emitted(m.values(&frame))
+}
+
+// freeze takes the counts of the interval out of the metric, the returned
+// function reports them without holding up the updates
+func (m *ErrorRatePerEndpoint) freeze() func() map[string]float32 {
+	m.lock.Lock()
+	frame := m.take(true)
+	m.lock.Unlock()
+
+	return func() map[string]float32 {
+		return m.emitted(m.values(&frame))
+	}
+}
+
+// take takes the counts of the interval out of the metric when reset is set,
+// or copies them. The lock must be held.
+func (m *ErrorRatePerEndpoint) take(reset bool) errorFrame {
+	frame := errorFrame{
+		countFrame:        m.takeCounts(reset),
+		errorRateSettings: m.errorRateSettings,
+		errorCount:        m.errorCount,
+		clientErrorCount:  m.clientErrorCount,
+		serverErrorCount:  m.serverErrorCount,
+	}
+
+	if reset {
+		m.errorCount = make(map[string]int)
+		m.clientErrorCount = make(map[string]int)
+		m.serverErrorCount = make(map[string]int)
+	} else {
+		frame.errorCount = copyCounts(m.errorCount)
+		frame.clientErrorCount = copyCounts(m.clientErrorCount)
+		frame.serverErrorCount = copyCounts(m.serverErrorCount)
+	}
+	return frame
+}
+
+func (m *ErrorRatePerEndpoint) values(frame *errorFrame) (map[string]float32, map[string]float32) {
+
+	metrics := make(map[string]float32)
+	overall := make(map[string]float32)
+
+	reqCount, errorCount := frame.counts, frame.errorCount
+	clientErrorCount, serverErrorCount := frame.clientErrorCount, frame.serverErrorCount
+
+	m.harvestLock.Lock()
+	if m.maxSnapshots > 0 {
+		sums, _ := m.retain(frame.reset, frame.start, reqCount, errorCount, clientErrorCount, serverErrorCount)
+		reqCount, errorCount, clientErrorCount, serverErrorCount = sums[0], sums[1], sums[2], sums[3]
+	} else {
+		// the endpoints stay reported, as 0 without requests
+		for endpoint := range m.reported {
+			if _, ok := reqCount[endpoint]; !ok {
+				reqCount[endpoint] = 0
+			}
+		}
+		if frame.reset {
+			for endpoint := range reqCount {
+				m.reported[endpoint] = true
+			}
+		}
+	}
+	m.harvestLock.Unlock()
+
+	var allEPErrors int
+	var reqAllEndpoints int
+	var rateSum float32
+	var numEndpoints int
+	var allEPClientErrors, allEPServerErrors int
+	for endpoint := range reqCount {
+		if frame.excluded[endpoint] {
+			continue
+		}
+
+		metricName := frame.name(endpoint)
+
+		metrics[metricName] = 0.
+		if overallReq := float32(reqCount[endpoint]); overallReq > 0.0 {
+			metrics[metricName] = frame.rateScale * float32(errorCount[endpoint]) / overallReq
+			rateSum += metrics[metricName]
+			numEndpoints++
+		}
+		metrics[frame.countNamePrefix+endpoint+"[errors]"] = float32(errorCount[endpoint])
+
+		if frame.reportErrorClasses {
+			metrics[frame.ratePrefix+"ClientErrorRate/"+endpoint+"[ratio]"] = ratio(clientErrorCount[endpoint], reqCount[endpoint])
+			metrics[frame.ratePrefix+"ServerErrorRate/"+endpoint+"[ratio]"] = ratio(serverErrorCount[endpoint], reqCount[endpoint])
+			allEPClientErrors += clientErrorCount[endpoint]
+			allEPServerErrors += serverErrorCount[endpoint]
+		}
+
+		if frame.errorBudget > 0 {
+			metrics[frame.ratePrefix+"BurnRate/"+endpoint+"[ratio]"] = frame.burnRate(errorCount[endpoint], reqCount[endpoint])
+		}
+
+		if frame.reportSuccessRate && reqCount[endpoint] > 0 {
+			metrics[frame.ratePrefix+"SuccessRate/"+endpoint+"[ratio]"] = ratio(reqCount[endpoint]-errorCount[endpoint], reqCount[endpoint])
+		}
+
+		allEPErrors += errorCount[endpoint]
+		reqAllEndpoints += reqCount[endpoint]
+	}
+
+	overallName := frame.overallName()
+	overall[overallName] = 0.
+	if frame.overallAggregation == AggregateMean {
+		if numEndpoints > 0 {
+			overall[overallName] = rateSum / float32(numEndpoints)
+		}
+	} else if reqAllEndpoints > 0 {
+		overall[overallName] = frame.rateScale * float32(allEPErrors) / float32(reqAllEndpoints)
+	}
+	overall[frame.countNamePrefix+"overall[errors]"] = float32(allEPErrors)
+
+	if frame.reportErrorClasses {
+		overall[frame.ratePrefix+"ClientErrorRate/overall[ratio]"] = ratio(allEPClientErrors, reqAllEndpoints)
+		overall[frame.ratePrefix+"ServerErrorRate/overall[ratio]"] = ratio(allEPServerErrors, reqAllEndpoints)
+	}
+
+	if frame.errorBudget > 0 {
+		overall[frame.ratePrefix+"BurnRate/overall[ratio]"] = frame.burnRate(allEPErrors, reqAllEndpoints)
+	}
+
+	if frame.reportSuccessRate && reqAllEndpoints > 0 {
+		overall[frame.ratePrefix+"SuccessRate/overall[ratio]"] = ratio(reqAllEndpoints-allEPErrors, reqAllEndpoints)
+	}
+
+	return metrics, overall
+}
+
+// ratio of the count to the total, 0 for no total
+func ratio(count int, total int) float32 {
+	if total == 0 {
+		return 0.
+	}
+	return float32(count) / float32(total)
+}
+
+/**************************************************
+* Rate limited requests per endpoint
+**************************************************/
+
+// RateLimitedPerEndpoint holds number of rate limited (429) requests per endpoint.
+// Rate limited requests are still counted as errors by ErrorRatePerEndpoint
+// unless it is configured with SetIgnoreRateLimited.
+type RateLimitedPerEndpoint struct {
+	*StandardMetric
+}
+
+// NewRateLimitedPerEndpoint creates new RateLimitedPerEndpoint metric
+func NewRateLimitedPerEndpoint() *RateLimitedPerEndpoint {
+
+	metric := &RateLimitedPerEndpoint{
+		StandardMetric: &StandardMetric{
+			reqCount:        make(map[string]int),
+			namePrefix:      "Component/RateLimited/",
+			allEPNamePrefix: "Component/RateLimited/overall",
+			metricUnit:      "[requests]",
+		},
+	}
+
+	metric.initReqCount()
+
+	return metric
+}
+
+// Update the metric values
+func (m *RateLimitedPerEndpoint) Update(params map[string]interface{}) error {
+	statusCode, err := m.statusCode(params)
+	if err != nil || statusCode != http.StatusTooManyRequests {
+		return err
+	}
+
+	endpointName, err := m.endpointName(params)
+	if err != nil {
+		return err
+	}
+	m.lock.Lock()
+	if !m.isExcluded(endpointName) {
+		m.countRequest(endpointName)
+	}
+	m.lock.Unlock()
+
+	return nil
+}
+
+// ValueMap extract all the metrics to be reported
+func (m *RateLimitedPerEndpoint) ValueMap() map[string]float32 {
+	return m.freeze()()
+}
+
+// Peek returns the current values without clearing them
+func (m *RateLimitedPerEndpoint) Peek() map[string]float32 {
+	return m.peekCounts()
+}
+
+// freeze takes the counts of the interval out of the metric
+func (m *RateLimitedPerEndpoint) freeze() func() map[string]float32 {
+	return m.freezeCounts()
+}
+
+/**************************************************
+* Requests per content type
+**************************************************/
+
+// ReqPerContentType holds number of requests per content type of the response,
+// e.g. Component/ContentType/application/json[requests]. The content type
+// is read from the contentType parameter, without the charset and
+// other parameters.
+type ReqPerContentType struct {
+	*StandardMetric
+}
+
+// NewReqPerContentType creates new ReqPerContentType metric
+func NewReqPerContentType() *ReqPerContentType {
+
+	metric := &ReqPerContentType{
+		StandardMetric: &StandardMetric{
+			reqCount:        make(map[string]int),
+			namePrefix:      "Component/ContentType/",
+			allEPNamePrefix: "Component/ContentType/overall",
+			metricUnit:      "[requests]",
+		},
+	}
+
+	metric.initReqCount()
+
+	return metric
+}
+
+// contentType normalizes the content type, "other" when it is unknown
+func contentType(value string) string {
+	mediaType, _, err := mime.ParseMediaType(value)
+	if err == mime.ErrInvalidMediaParameter {
+		// only the parameters are malformed
+		err = nil
+	}
+	if err != nil || mediaType == "" {
+		return unknownEndpoint
+	}
+	return mediaType
+}
+
+// Update the metric values
+func (m *ReqPerContentType) Update(params map[string]interface{}) error {
+	value, _ := m.param(params, m.paramKeys.ContentType, ParamContentType)
+	name, _ := value.(string)
+	name = contentType(name)
+
+	m.lock.Lock()
+	if !m.isExcluded(name) {
+		m.countRequest(name)
+	}
+	m.lock.Unlock()
+
+	return nil
+}
+
+// ValueMap extract all the metrics to be reported
+func (m *ReqPerContentType) ValueMap() map[string]float32 {
+	return m.freeze()()
+}
+
+// Peek returns the current values without clearing them
+func (m *ReqPerContentType) Peek() map[string]float32 {
+	return m.peekCounts()
+}
+
+// freeze takes the counts of the interval out of the metric
+func (m *ReqPerContentType) freeze() func() map[string]float32 {
+	return m.freezeCounts()
+}
+
+/**************************************************
+* Slow requests per endpoint
+**************************************************/
+
+// SlowRequestCount holds number of requests per endpoint
+// slower than the threshold, e.g. the latency SLO
+type SlowRequestCount struct {
+	*StandardMetric
+	threshold time.Duration
+}
+
+// NewSlowRequestCount creates new SlowRequestCount metric counting
+// the requests with response time above the threshold
+func NewSlowRequestCount(threshold time.Duration) *SlowRequestCount {
+
+	metric := &SlowRequestCount{
+		StandardMetric: &StandardMetric{
+			reqCount:        make(map[string]int),
+			namePrefix:      "Component/SlowRequests/",
+			allEPNamePrefix: "Component/SlowRequests/overall",
+			metricUnit:      "[count]",
+		},
+		threshold: threshold,
+	}
+
+	metric.initReqCount()
+
+	return metric
+}
+
+// Update the metric values
+func (m *SlowRequestCount) Update(params map[string]interface{}) error {
+
+	elapsed, ok, err := m.responseTime(params)
+	if !ok || elapsed <= m.threshold {
+		return err
+	}
+
+	endpointName, err := m.endpointName(params)
+	if err != nil {
+		return err
+	}
+	m.lock.Lock()
+	if !m.isExcluded(endpointName) {
+		m.countRequest(endpointName)
+	}
+	m.lock.Unlock()
+
+	return nil
+}
+
+// ValueMap extract all the metrics to be reported
+func (m *SlowRequestCount) ValueMap() map[string]float32 {
+	return m.freeze()()
+}
+
+// Peek returns the current values without clearing them
+func (m *SlowRequestCount) Peek() map[string]float32 {
+	return m.peekCounts()
+}
+
+// freeze takes the counts of the interval out of the metric
+func (m *SlowRequestCount) freeze() func() map[string]float32 {
+	return m.freezeCounts()
+}
+
+/**************************************************
+* Requests per status code
+**************************************************/
+
+// defaultMaxStatusCodes is the number of distinct status codes reported per endpoint
+const defaultMaxStatusCodes = 10
+
+// otherStatusCode is reported for the codes beyond the cap of the endpoint
+const otherStatusCode = "other"
+
+// StatusCodePerEndpoint holds number of requests per endpoint and exact status code,
+// e.g. Component/StatusCode/log/502[requests]
+type StatusCodePerEndpoint struct {
+	*StandardMetric
+
+	// codes seen per endpoint, the ones beyond maxCodes are counted as other
+	codes    map[string]map[int]bool
+	maxCodes int
+}
+
+// NewStatusCodePerEndpoint creates new StatusCodePerEndpoint metric
+func NewStatusCodePerEndpoint() *StatusCodePerEndpoint {
+
+	metric := &StatusCodePerEndpoint{
+		StandardMetric: &StandardMetric{
+			reqCount:        make(map[string]int),
+			namePrefix:      "Component/StatusCode/",
+			allEPNamePrefix: "Component/StatusCode/overall",
+			metricUnit:      "[requests]",
+		},
+		codes:    make(map[string]map[int]bool),
+		maxCodes: defaultMaxStatusCodes,
+	}
+
+	return metric
+}
+
+// SetMaxStatusCodes limits the number of distinct status codes reported per endpoint,
+// the requests with any further code are reported as Component/StatusCode/log/other[requests]
+func (m *StatusCodePerEndpoint) SetMaxStatusCodes(max int) error {
+	if max < 1 {
+		return errors.New("Please specify at least 1 status code")
+	}
+
+	m.lock.Lock()
+	m.maxCodes = max
+	m.lock.Unlock()
+	return nil
+}
+
+// SetMaxSnapshots retains the counts of up to max reports which failed to be
+// sent, so that they are reported again with the next one. Beyond max the
+// oldest are dropped, 0 (the default) disables the retention.
+func (m *StatusCodePerEndpoint) SetMaxSnapshots(max int) {
+	m.setMaxSnapshots(max)
+}
+
+// Exclude stops counting and reporting the endpoint
+func (m *StatusCodePerEndpoint) Exclude(endpoint string) {
+	m.StandardMetric.Exclude(endpoint)
+
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	m.clearCounts(statusCodeKeys(endpoint))
+	delete(m.codes, endpoint)
+}
+
+// ClearEndpoint discards the requests of the endpoint for all the status codes
+func (m *StatusCodePerEndpoint) ClearEndpoint(endpoint string) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	m.clearCounts(statusCodeKeys(endpoint))
+	delete(m.codes, endpoint)
+}
+
+// statusCodeKeys matches the keys of the endpoint for all the status codes
+// but not the ones of the endpoints nested in it, e.g. api/200 but not api/users/200
+func statusCodeKeys(endpoint string) func(key string) bool {
+	prefix := endpoint + "/"
+	return func(key string) bool {
+		// the status code is the last part of the key
+		return strings.HasPrefix(key, prefix) && !strings.Contains(key[len(prefix):], "/")
+	}
+}
+
+// Update the metric values
+func (m *StatusCodePerEndpoint) Update(params map[string]interface{}) error {
+
+	statusCode, err := m.statusCode(params)
+	if err != nil {
+		return err
+	}
+	endpointName, err := m.endpointName(params)
+	if err != nil {
+		return err
+	}
+
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	if m.isExcluded(endpointName) {
+		return nil
+	}
+
+	codes, ok := m.codes[endpointName]
+	if !ok {
+		codes = make(map[int]bool)
+		m.codes[endpointName] = codes
+	}
+
+	code := otherStatusCode
+	if codes[statusCode] || len(codes) < m.maxCodes {
+		codes[statusCode] = true
+		code = strconv.Itoa(statusCode)
+	}
+	m.countRequest(endpointName + "/" + code)
+
+	return nil
+}
+
+// ValueMap extract all the metrics to be reported
+func (m *StatusCodePerEndpoint) ValueMap() map[string]float32 {
+	return m.freeze()()
+}
+
+// Peek returns the current values without clearing them
+func (m *StatusCodePerEndpoint) Peek() map[string]float32 {
+	return m.peekCounts()
+}
+
+// freeze takes the counts of the interval out of the metric
+func (m *StatusCodePerEndpoint) freeze() func() map[string]float32 {
+	return m.freezeCounts()
+}
+
+/**************************************************
+* Response time per endpoint
+**************************************************/
+
+// OverflowPolicy selects what happens to a response time
+// once the buffer of the endpoint is full
+type OverflowPolicy int
+
+const (
+	// OverflowDrop stops recording response times, but the requests are still counted
+	OverflowDrop OverflowPolicy = iota
+
+	// OverflowReservoir replaces recorded response times at random (reservoir sampling)
+	// so the samples stay representative of the whole interval
+	OverflowReservoir
+)
+
+// ResponseTimePerEndpoint tracks the response time per endpoint
+type ResponseTimePerEndpoint struct {
+	*StandardMetric
+	responseTimeMap map[string][]float32
+
+	// sum of the samples per endpoint, kept up to date by Update so that
+	// the report doesn't iterate the samples while holding the lock
+	sums map[string]float32
+
+	// fraction of requests whose response time is recorded
+	sampleRate float64
+	random     func() float64
+
+	// max number of response times buffered per endpoint, 0 is unlimited
+	maxSamples     int
+	overflowPolicy OverflowPolicy
+
+	// number of response times offered to the full buffer,
+	// needed for the reservoir sampling
+	seenSamples map[string]int
+
+	// response times are recorded in ms and scaled to the reported unit
+	timeScale float32
+
+	// report the sum and the number of the response times next to the average
+	reportSum bool
+
+	// report the response times in the summary form instead of the average
+	reportSummary bool
+
+	// response times below are recorded as 0, 0 disables it
+	minResponseTime time.Duration
+
+	// weight of the interval average in the moving average, 0 disables it.
+	// The averages are guarded by the harvest lock.
+	ewmaAlpha float64
+	ewma      map[string]float32
+
+	// endpoints reported before, reported as 0 in the intervals without
+	// requests. Guarded by the harvest lock.
+	reported map[string]bool
+
+	// at most maxEndpoints are tracked, the least recently updated one is
+	// folded into "other" first. The front of lru is the most recent one.
+	// The evicted endpoints are forgotten by the next report.
+	maxEndpoints int
+	lru          *list.List
+	lruElements  map[string]*list.Element
+	evicted      map[string]bool
+}
+
+// responseTimeFrame holds the response times of an interval taken out of
+// ResponseTimePerEndpoint with the settings needed to report them
+type responseTimeFrame struct {
+	countFrame
+	samples   map[string][]float32
+	sums      map[string]float32
+	evicted   map[string]bool
+	timeScale float32
+	reportSum bool
+	ewmaAlpha float64
+
+	reportSummary   bool
+	omitOverall     bool
+	omitPerEndpoint bool
+}
+
+// ewmaName is the name of the moving average of the endpoint
+func (frame *responseTimeFrame) ewmaName(endpoint string) string {
+	return "Component/ResponseTimeEWMA/" + endpoint + frame.metricUnit
+}
+
+// NewResponseTimePerEndpoint creates new ResponseTimePerEndpoint metric
+func NewResponseTimePerEndpoint() *ResponseTimePerEndpoint {
+
+	metric := &ResponseTimePerEndpoint{
+		StandardMetric: &StandardMetric{
+			reqCount:        make(map[string]int),
+			namePrefix:      "Component/ResponseTimePerEndpoint/",
+			allEPNamePrefix: "Component/ResponseTime/overall",
+			metricUnit:      "[ms]",
+		},
+
+		responseTimeMap: make(map[string][]float32),
+		sums:            make(map[string]float32),
+		sampleRate:      1.,
+		random:          rand.Float64,
+		seenSamples:     make(map[string]int),
+		timeScale:       1.,
+		ewma:            make(map[string]float32),
+		reported:        make(map[string]bool),
+		evicted:         make(map[string]bool),
+	}
+
+	// initialize the metrics
+	metric.initReqCount()
+	for endpoint := range metric.endpoints {
+		metric.responseTimeMap[endpoint] = make([]float32, 0)
+	}
+	metric.responseTimeMap[unknownEndpoint] = make([]float32, 0)
+
+	return metric
+}
+
+// SetSampleRate sets the fraction of requests in (0,1] whose response time
+// is recorded, e.g. 0.1 records one in ten requests. All requests are still
+// counted, but the average response time is computed from the recorded
+// samples only. Defaults to 1 (every request is recorded).
+func (m *ResponseTimePerEndpoint) SetSampleRate(rate float64) {
+	if rate <= 0 || rate > 1 {
+		rate = 1
+	}
+
+	m.lock.Lock()
+	m.sampleRate = rate
+	m.lock.Unlock()
+}
+
+// Clear discards the response times recorded since the last report
+func (m *ResponseTimePerEndpoint) Clear() {
+	m.lock.Lock()
+	m.resetCounts()
+	m.responseTimeMap = make(map[string][]float32)
+	m.sums = make(map[string]float32)
+	m.seenSamples = make(map[string]int)
+	m.evicted = make(map[string]bool)
+	if m.lru != nil {
+		m.lru.Init()
+		m.lruElements = make(map[string]*list.Element)
+	}
+	m.lock.Unlock()
+
+	m.harvestLock.Lock()
+	m.ewma = make(map[string]float32)
+	m.reported = make(map[string]bool)
+	m.harvestLock.Unlock()
+}
+
+// ClearEndpoint discards the response times of the endpoint including its moving average
+func (m *ResponseTimePerEndpoint) ClearEndpoint(endpoint string) {
+	m.lock.Lock()
+	m.clearCounts(func(key string) bool { return key == endpoint })
+	m.drop(endpoint)
+	m.lock.Unlock()
+
+	m.harvestLock.Lock()
+	delete(m.ewma, endpoint)
+	delete(m.reported, endpoint)
+	m.harvestLock.Unlock()
+}
+
+// Exclude stops recording and reporting the response times of the endpoint
+func (m *ResponseTimePerEndpoint) Exclude(endpoint string) {
+	m.StandardMetric.Exclude(endpoint)
+
+	m.lock.Lock()
+	m.drop(endpoint)
+	m.lock.Unlock()
+
+	m.harvestLock.Lock()
+	delete(m.ewma, endpoint)
+	delete(m.reported, endpoint)
+	m.harvestLock.Unlock()
+}
+
+// drop discards the response times of the endpoint, the lock must be held
+func (m *ResponseTimePerEndpoint) drop(endpoint string) {
+	delete(m.responseTimeMap, endpoint)
+	delete(m.sums, endpoint)
+	delete(m.seenSamples, endpoint)
+	m.forget(endpoint)
+}
+
+// SetMaxEndpoints bounds the memory of the response times by tracking at most
+// max endpoints. Beyond max the least recently updated endpoint is dropped and
+// its response times and requests are folded into Component/ResponseTimePerEndpoint/other[ms]
+// until it is requested again. The "other" endpoint is not part of the limit.
+// Max 0 (default) means no limit.
+func (m *ResponseTimePerEndpoint) SetMaxEndpoints(max int) error {
+	if max < 0 {
+		return errors.New("Please specify a positive number of endpoints")
+	}
+
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	m.maxEndpoints = max
+	if max == 0 {
+		m.lru, m.lruElements = nil, nil
+		return nil
+	}
+
+	if m.lru == nil {
+		m.lru = list.New()
+		m.lruElements = make(map[string]*list.Element)
+		for endpoint := range m.responseTimeMap {
+			m.touch(endpoint)
+		}
+	}
+	for m.lru.Len() > max {
+		m.evict(m.lru.Back().Value.(string))
+	}
+	return nil
+}
+
+// touch marks the endpoint as the most recently updated one, evicting the
+// least recently updated one beyond maxEndpoints. The lock must be held.
+func (m *ResponseTimePerEndpoint) touch(endpoint string) {
+	if m.lru == nil || endpoint == unknownEndpoint {
+		return
+	}
+
+	if element, ok := m.lruElements[endpoint]; ok {
+		m.lru.MoveToFront(element)
+		return
+	}
+	delete(m.evicted, endpoint)
+	m.lruElements[endpoint] = m.lru.PushFront(endpoint)
+	if m.lru.Len() > m.maxEndpoints {
+		m.evict(m.lru.Back().Value.(string))
+	}
+}
+
+// evict drops the endpoint, folding its requests and response times
+// into the "other" endpoint. The lock must be held.
+func (m *ResponseTimePerEndpoint) evict(endpoint string) {
+	for _, value := range m.responseTimeMap[endpoint] {
+		m.addSample(unknownEndpoint, value)
+	}
+	if count, ok := m.reqCount[endpoint]; ok {
+		m.reqCount[unknownEndpoint] += count
+		delete(m.reqCount, endpoint)
+	}
+
+	m.drop(endpoint)
+	m.evicted[endpoint] = true
+}
+
+// forget removes the endpoint from the recently updated ones, the lock must be held
+func (m *ResponseTimePerEndpoint) forget(endpoint string) {
+	if element, ok := m.lruElements[endpoint]; ok {
+		m.lru.Remove(element)
+		delete(m.lruElements, endpoint)
+	}
+}
+
+// SetTimeUnit sets the unit of the reported response times,
+// either time.Millisecond (default) or time.Second
+func (m *ResponseTimePerEndpoint) SetTimeUnit(unit time.Duration) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	switch unit {
+	case time.Millisecond:
+		m.timeScale = 1.
+		m.metricUnit = "[ms]"
+	case time.Second:
+		m.timeScale = 0.001
+		m.metricUnit = "[sec]"
+	default:
+		return errors.New("response time unit should be time.Millisecond or time.Second")
+	}
+
+	return nil
+}
+
+// SetReportSum enables reporting of the sum and the number of the recorded response times,
+// e.g. Component/ResponseTimeSum/log[ms] and Component/ResponseTimeCount/log[requests].
+// Unlike averaging the averages, they aggregate correctly across several hosts.
+func (m *ResponseTimePerEndpoint) SetReportSum(enable bool) {
+	m.lock.Lock()
+	m.reportSum = enable
+	m.lock.Unlock()
+}
+
+// SetReportSummary enables reporting of the response times in the summary form
+// (total, count, min, max and sum of squares) under the names of the averages,
+// so that NewRelic keeps the min and max and averages correctly across harvests.
+// When sampling, the summary covers only the recorded samples.
+func (m *ResponseTimePerEndpoint) SetReportSummary(enable bool) {
+	m.lock.Lock()
+	m.reportSummary = enable
+	m.lock.Unlock()
+}
+
+// SummaryMap returns the summaries of the response times recorded since the
+// last report per endpoint and overall when enabled by SetReportSummary
+func (m *ResponseTimePerEndpoint) SummaryMap() map[string]*MetricSummary {
+	m.lock.Lock()
+	if !m.reportSummary {
+		m.lock.Unlock()
+		return make(map[string]*MetricSummary)
+	}
+	frame := m.take(false)
+	m.lock.Unlock()
+
+	return frame.summaries()
+}
+
+// summaries of the response times of the frame per endpoint and overall
+func (frame *responseTimeFrame) summaries() map[string]*MetricSummary {
+
+	summaries := make(map[string]*MetricSummary)
+	if !frame.reportSummary {
+		return summaries
+	}
+
+	overall := &MetricSummary{}
+	for endpoint, values := range frame.samples {
+		if len(values) == 0 || frame.excluded[endpoint] {
+			continue
+		}
+
+		summary := &MetricSummary{}
+		for _, value := range values {
+			summary.Add(frame.timeScale * value)
+			overall.Add(frame.timeScale * value)
+		}
+		if !frame.omitPerEndpoint {
+			summaries[frame.name(endpoint)] = summary
+		}
+	}
+	if overall.Count > 0 && !frame.omitOverall {
+		summaries[frame.overallName()] = overall
+	}
+
+	return summaries
+}
+
+// SetMinResponseTime records the response times below the min as 0,
+// e.g. to keep the noise of very fast handlers like 0.002ms off the dashboards.
+// Min 0 (default) records the response times as they are.
+func (m *ResponseTimePerEndpoint) SetMinResponseTime(min time.Duration) {
+	m.lock.Lock()
+	m.minResponseTime = min
+	m.lock.Unlock()
+}
+
+// SetEWMA enables reporting of an exponentially weighted moving average of the
+// response time, e.g. Component/ResponseTimeEWMA/log[ms], smoother than the plain
+// average on endpoints with little traffic. Every report weights the average of
+// the interval by alpha in (0,1] and the previous value by 1-alpha. Unlike the
+// other values it persists across the reports, only Clear discards it, and the
+// last value is reported again for intervals without requests. Alpha 0 disables it.
+func (m *ResponseTimePerEndpoint) SetEWMA(alpha float64) error {
+	if alpha < 0 || alpha > 1 {
+		return errors.New("Please specify alpha between 0 and 1")
+	}
+
+	m.lock.Lock()
+	m.ewmaAlpha = alpha
+	m.lock.Unlock()
+
+	if alpha == 0 {
+		m.harvestLock.Lock()
+		m.ewma = make(map[string]float32)
+		m.harvestLock.Unlock()
+	}
+	return nil
+}
+
+// SetMaxSamples limits the number of response times buffered per endpoint
+// within a reporting interval to bound the memory used on high traffic
+// endpoints. The policy decides what happens once the limit is reached.
+// Max 0 (default) means no limit.
+func (m *ResponseTimePerEndpoint) SetMaxSamples(max int, policy OverflowPolicy) {
+	m.lock.Lock()
+	m.maxSamples = max
+	m.overflowPolicy = policy
+	m.lock.Unlock()
+}
+
+// addSample records the response time while respecting the buffer limit,
+// the lock must be held
+func (m *ResponseTimePerEndpoint) addSample(endpointName string, value float32) {
+	samples := m.responseTimeMap[endpointName]
+	m.seenSamples[endpointName]++
+
+	if m.maxSamples <= 0 || len(samples) < m.maxSamples {
+		m.responseTimeMap[endpointName] = append(samples, value)
+		m.sums[endpointName] += value
+		return
+	}
+
+	if m.overflowPolicy == OverflowReservoir {
+		if i := int(m.random() * float64(m.seenSamples[endpointName])); i < len(samples) {
+			m.sums[endpointName] += value - samples[i]
+			samples[i] = value
+		}
+	}
+}
+
+// Update the metric values
+func (m *ResponseTimePerEndpoint) Update(params map[string]interface{}) error {
+
+	elapsed, ok, err := m.responseTime(params)
+	if !ok {
+		return err
+	}
+
+	endpointName, err := m.endpointName(params)
+	if err != nil {
+		return err
+	}
+	m.lock.Lock()
+	if m.isExcluded(endpointName) {
+		m.lock.Unlock()
+		return nil
+	}
+	if elapsed < m.minResponseTime {
+		elapsed = 0
+	}
+	elaspsedTimeInMs := milliseconds(elapsed)
+
+	m.touch(endpointName)
+	m.countRequest(endpointName)
+	if m.sampleRate >= 1 || m.random() < m.sampleRate {
+		m.addSample(endpointName, elaspsedTimeInMs)
+	}
+	m.lock.Unlock()
+
+	return nil
+}
+
+// Samples returns a snapshot copy of the response times (in ms) recorded
+// per endpoint since the last report. The samples are not cleared and
+// modifying the returned map does not affect the metric.
+func (m *ResponseTimePerEndpoint) Samples() map[string][]float32 {
+
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+
+	samples := make(map[string][]float32, len(m.responseTimeMap))
+	for endpoint, values := range m.responseTimeMap {
+		samples[endpoint] = append([]float32(nil), values...)
+	}
+
+	return samples
+}
+
+// ValueMap extract all the metrics to be reported
+func (m *ResponseTimePerEndpoint) ValueMap() map[string]float32 {
+	return m.freeze()()
+}
+
+// Peek returns the current values without clearing them
+func (m *ResponseTimePerEndpoint) Peek() map[string]float32 {
+	m.lock.Lock()
+	frame := m.take(false)
+	m.lock.Unlock()
+
+	return m.emitted(m.values(&frame))
+}
+
+// freeze takes the response times of the interval out of the metric, the
+// returned function reports them without holding up the updates
+func (m *ResponseTimePerEndpoint) freeze() func() map[string]float32 {
+	compute := m.freezeSummaries()
+	return func() map[string]float32 {
+		values, _ := compute()
+		return values
+	}
+}
+
+// freezeSummaries is freeze computing also the summaries of the response times
+func (m *ResponseTimePerEndpoint) freezeSummaries() func() (map[string]float32, map[string]*MetricSummary) {
+	m.lock.Lock()
+	frame := m.take(true)
+	m.lock.Unlock()
+
+	return func() (map[string]float32, map[string]*MetricSummary) {
+		values := m.emitted(m.values(&frame))
+		return values, frame.summaries()
+	}
+}
+
+// take takes the response times of the interval out of the metric when reset
+// is set, or copies them. The lock must be held.
+func (m *ResponseTimePerEndpoint) take(reset bool) responseTimeFrame {
+	frame := responseTimeFrame{
+		countFrame: m.takeCounts(reset),
+		samples:    m.responseTimeMap,
+		sums:       m.sums,
+		evicted:    m.evicted,
+		timeScale:  m.timeScale,
+		reportSum:  m.reportSum,
+		ewmaAlpha:  m.ewmaAlpha,
+
+		reportSummary:   m.reportSummary,
+		omitOverall:     m.omitOverall,
+		omitPerEndpoint: m.omitPerEndpoint,
+	}
+
+	if reset {
+		m.responseTimeMap = make(map[string][]float32)
+		m.sums = make(map[string]float32)
+		m.seenSamples = make(map[string]int)
+		m.evicted = make(map[string]bool)
+		return frame
+	}
+
+	// the reservoir replaces the samples in place
+	frame.samples = make(map[string][]float32, len(m.responseTimeMap))
+	for endpoint, values := range m.responseTimeMap {
+		frame.samples[endpoint] = append([]float32(nil), values...)
+	}
+	frame.sums = make(map[string]float32, len(m.sums))
+	for endpoint, sum := range m.sums {
+		frame.sums[endpoint] = sum
+	}
+	frame.evicted = nil
+	return frame
 }
 
-func (m *StandardMetric) initReqCount() {
-	// initialize the metrics
-	for endpoint := range m.endpoints {
-		m.reqCount[endpoint] = 0
+func (m *ResponseTimePerEndpoint) values(frame *responseTimeFrame) (map[string]float32, map[string]float32) {
+
+	metrics := make(map[string]float32)
+	overall := make(map[string]float32)
+
+	m.harvestLock.Lock()
+	defer m.harvestLock.Unlock()
+
+	for endpoint := range frame.evicted {
+		delete(m.ewma, endpoint)
+		delete(m.reported, endpoint)
 	}
-	m.reqCount[unknownEndpoint] = 0
-}
 
-func (m *StandardMetric) endpointName(params map[string]interface{}) string {
-	endpointName, ok := params["endpointName"]
-	if !ok {
-		return unknownEndpoint
+	// the endpoints stay reported, as 0 without requests
+	samples := frame.samples
+	for endpoint := range m.reported {
+		if _, ok := samples[endpoint]; !ok {
+			samples[endpoint] = nil
+		}
+	}
+	if frame.reset {
+		for endpoint := range samples {
+			m.reported[endpoint] = true
+		}
+	}
+
+	var responseTimeAllEndpoints float32
+	var numSamplesAllEndpoints int
+
+	for endpoint, values := range samples {
+		if frame.excluded[endpoint] {
+			continue
+		}
+
+		responseTimeSum := frame.sums[endpoint]
+
+		metricName := frame.name(endpoint)
+		metrics[metricName] = 0.
+
+		// average over the recorded samples which, when sampling,
+		// are only a part of all the requests
+		if numSamples := float32(len(values)); numSamples > 0 {
+			metrics[metricName] = frame.timeScale * responseTimeSum / numSamples
+		}
+
+		if frame.reportSum {
+			metrics["Component/ResponseTimeSum/"+endpoint+frame.metricUnit] = frame.timeScale * responseTimeSum
+			metrics["Component/ResponseTimeCount/"+endpoint+"[requests]"] = float32(len(values))
+		}
+
+		if frame.ewmaAlpha > 0 && len(values) > 0 {
+			ewma := responseTimeSum / float32(len(values))
+			if previous, ok := m.ewma[endpoint]; ok {
+				ewma = float32(frame.ewmaAlpha)*ewma + float32(1-frame.ewmaAlpha)*previous
+			}
+			metrics[frame.ewmaName(endpoint)] = frame.timeScale * ewma
+			if frame.reset {
+				m.ewma[endpoint] = ewma
+			}
+		}
+
+		responseTimeAllEndpoints += responseTimeSum
+		numSamplesAllEndpoints += len(values)
+	}
+
+	// the moving average carries over the intervals without requests
+	for endpoint, ewma := range m.ewma {
+		if _, ok := metrics[frame.ewmaName(endpoint)]; !ok && !frame.excluded[endpoint] {
+			metrics[frame.ewmaName(endpoint)] = frame.timeScale * ewma
+		}
+	}
+
+	overallName := frame.overallName()
+	overall[overallName] = 0.
+	if numSamplesAllEndpoints > 0 {
+		overall[overallName] = frame.timeScale * responseTimeAllEndpoints / float32(numSamplesAllEndpoints)
+	}
+	if frame.reportSum {
+		overall["Component/ResponseTimeSum/overall"+frame.metricUnit] = frame.timeScale * responseTimeAllEndpoints
+		overall["Component/ResponseTimeCount/overall[requests]"] = float32(numSamplesAllEndpoints)
 	}
 
-	return endpointName.(string)
+	return metrics, overall
 }
 
-/************************************
- * requests per endpoint
- ***********************************/
+/**************************************************
+* Requests, errors and response time per endpoint
+**************************************************/
 
-// ReqPerEndpoint holds number of requests per endpoint
-type ReqPerEndpoint struct {
-	*StandardMetric
+// endpointStats are the values of a single endpoint of HTTPEndpointMetric
+type endpointStats struct {
+	requests        int
+	errors          int
+	responseTimeSum float32
+	samples         int
 }
 
-// NewReqPerEndpoint creates new ReqPerEndpoint metric
-func NewReqPerEndpoint() *ReqPerEndpoint {
+// HTTPEndpointMetric tracks the number of requests, the error rate and the response time
+// per endpoint in a single Update under a single lock. It reports the same values
+// as ReqPerEndpoint, ErrorRatePerEndpoint and ResponseTimePerEndpoint together
+// and is cheaper for busy services than the three metrics.
+type HTTPEndpointMetric struct {
+	*StandardMetric
+	stats map[string]*endpointStats
+}
 
-	metric := &ReqPerEndpoint{
+// NewHTTPEndpointMetric creates new HTTPEndpointMetric metric
+func NewHTTPEndpointMetric() *HTTPEndpointMetric {
+	return &HTTPEndpointMetric{
 		StandardMetric: &StandardMetric{
-			reqCount:        make(map[string]int),
-			namePrefix:      "Component/ReqPerEndpoint/",
-			allEPNamePrefix: "Component/Req/overall",
-			metricUnit:      "[requests]",
+			reqCount: make(map[string]int),
 		},
+		stats: make(map[string]*endpointStats),
 	}
+}
 
-	metric.initReqCount()
+// names of the values of HTTPEndpointMetric, the ones of ReqPerEndpoint,
+// ErrorRatePerEndpoint and ResponseTimePerEndpoint
+var (
+	httpRequestNames = countFrame{
+		namePrefix:      "Component/ReqPerEndpoint/",
+		allEPNamePrefix: "Component/Req/overall",
+		metricUnit:      "[requests]",
+	}
+	httpErrorRateNames = countFrame{
+		namePrefix:      "Component/ErrorRatePerEndpoint/",
+		allEPNamePrefix: "Component/ErrorRate/overall",
+		metricUnit:      "[percent]",
+	}
+	httpErrorCountNames = countFrame{
+		namePrefix:      "Component/ErrorCount/",
+		allEPNamePrefix: "Component/ErrorCount/overall",
+		metricUnit:      "[errors]",
+	}
+	httpResponseTimeNames = countFrame{
+		namePrefix:      "Component/ResponseTimePerEndpoint/",
+		allEPNamePrefix: "Component/ResponseTime/overall",
+		metricUnit:      "[ms]",
+	}
+)
 
-	return metric
+// Clear discards the values counted since the last report
+func (m *HTTPEndpointMetric) Clear() {
+	m.lock.Lock()
+	m.stats = make(map[string]*endpointStats)
+	m.buffered = 0
+	m.lock.Unlock()
 }
 
-// Update the metric values
-func (m *ReqPerEndpoint) Update(params map[string]interface{}) error {
-	endpointName := m.endpointName(params)
+// ClearEndpoint discards the values of the endpoint
+func (m *HTTPEndpointMetric) ClearEndpoint(endpoint string) {
 	m.lock.Lock()
-	m.reqCount[endpointName]++
+	if stats, ok := m.stats[endpoint]; ok {
+		m.buffered -= stats.requests
+		delete(m.stats, endpoint)
+	}
 	m.lock.Unlock()
-
-	return nil
 }
 
-// ValueMap extract all the metrics to be reported
-func (m *ReqPerEndpoint) ValueMap() map[string]float32 {
+// Update the metric values
+func (m *HTTPEndpointMetric) Update(params map[string]interface{}) error {
 
-	metricMap := make(map[string]float32)
+	endpointName, err := m.endpointName(params)
+	if err != nil {
+		return err
+	}
+	statusCode, err := m.statusCode(params)
+	if err != nil {
+		return err
+	}
+	elapsed, hasResponseTime, err := m.responseTime(params)
 
 	m.lock.Lock()
 	defer m.lock.Unlock()
 
-	var numReqAllEndpoints int
-	for endpoint, value := range m.reqCount {
-		metricName := m.namePrefix + endpoint + m.metricUnit
-		metricMap[metricName] = float32(value)
+	if m.isExcluded(endpointName) {
+		return nil
+	}
 
-		numReqAllEndpoints += value
+	stats, ok := m.stats[endpointName]
+	if !ok {
+		stats = &endpointStats{}
+		m.stats[endpointName] = stats
 	}
 
-	m.reqCount = make(map[string]int)
+	stats.requests++
+	m.buffered++
+	if statusCode >= 400 {
+		stats.errors++
+	}
+	if hasResponseTime {
+		stats.responseTimeSum += milliseconds(elapsed)
+		stats.samples++
+	}
 
-	metricMap[m.allEPNamePrefix+m.metricUnit] = float32(numReqAllEndpoints)
+	return err
+}
 
-	return metricMap
+// ValueMap extract all the metrics to be reported
+func (m *HTTPEndpointMetric) ValueMap() map[string]float32 {
+	return m.freeze()()
 }
 
-/**************************************************
-* Error rate per endpoint
-**************************************************/
+// Peek returns the current values without clearing them
+func (m *HTTPEndpointMetric) Peek() map[string]float32 {
+	m.lock.Lock()
+	stats := make(map[string]*endpointStats, len(m.stats))
+	for endpoint, endpointStats := range m.stats {
+		copied := *endpointStats
+		stats[endpoint] = &copied
+	}
+	excluded := m.excluded
+	m.lock.Unlock()
 
-// ErrorRatePerEndpoint holds the percentage of error requests per endpoint
-type ErrorRatePerEndpoint struct {
-	*StandardMetric
-	errorCount map[string]int
+	return m.emitted(m.values(stats, excluded))
 }
 
-// NewErrorRatePerEndpoint creates new POEPerEndpoint metric
-func NewErrorRatePerEndpoint() *ErrorRatePerEndpoint {
+// freeze takes the values of the interval out of the metric, the returned
+// function reports them without holding up the updates
+func (m *HTTPEndpointMetric) freeze() func() map[string]float32 {
+	m.lock.Lock()
+	stats, excluded := m.stats, m.excluded
+	m.stats = make(map[string]*endpointStats)
+	m.buffered = 0
+	m.lock.Unlock()
 
-	metric := &ErrorRatePerEndpoint{
-		StandardMetric: &StandardMetric{
-			reqCount:        make(map[string]int),
-			namePrefix:      "Component/ErrorRatePerEndpoint/",
-			allEPNamePrefix: "Component/ErrorRate/overall",
-			metricUnit:      "[percent]",
-		},
-		errorCount: make(map[string]int),
+	return func() map[string]float32 {
+		return m.emitted(m.values(stats, excluded))
 	}
+}
 
-	// initialize the metrics
-	metric.initReqCount()
-	for endpoint := range metric.endpoints {
-		metric.errorCount[endpoint] = 0
+func (m *HTTPEndpointMetric) values(stats map[string]*endpointStats, excluded map[string]bool) (map[string]float32, map[string]float32) {
+
+	metrics := make(map[string]float32)
+
+	var overall endpointStats
+	for endpoint, stats := range stats {
+		if excluded[endpoint] {
+			continue
+		}
+
+		metrics[httpRequestNames.name(endpoint)] = float32(stats.requests)
+
+		errorRateName := httpErrorRateNames.name(endpoint)
+		metrics[errorRateName] = 0.
+		if stats.requests > 0 {
+			metrics[errorRateName] = float32(stats.errors) / float32(stats.requests)
+		}
+		metrics[httpErrorCountNames.name(endpoint)] = float32(stats.errors)
+
+		responseTimeName := httpResponseTimeNames.name(endpoint)
+		metrics[responseTimeName] = 0.
+		if stats.samples > 0 {
+			metrics[responseTimeName] = stats.responseTimeSum / float32(stats.samples)
+		}
+
+		overall.requests += stats.requests
+		overall.errors += stats.errors
+		overall.responseTimeSum += stats.responseTimeSum
+		overall.samples += stats.samples
 	}
-	metric.errorCount[unknownEndpoint] = 0
 
-	return metric
+	overallMetrics := map[string]float32{
+		httpRequestNames.overallName():      float32(overall.requests),
+		httpErrorRateNames.overallName():    0.,
+		httpErrorCountNames.overallName():   float32(overall.errors),
+		httpResponseTimeNames.overallName(): 0.,
+	}
+	if overall.requests > 0 {
+		overallMetrics[httpErrorRateNames.overallName()] = float32(overall.errors) / float32(overall.requests)
+	}
+	if overall.samples > 0 {
+		overallMetrics[httpResponseTimeNames.overallName()] = overall.responseTimeSum / float32(overall.samples)
+	}
+
+	return metrics, overallMetrics
 }
 
-// Update the metric values
-func (m *ErrorRatePerEndpoint) Update(params map[string]interface{}) error {
-	endpointName := m.endpointName(params)
+/**************************************************
+* Unfinished requests
+**************************************************/
+
+// UnfinishedRequests counts the requests which started but did not finish
+// within the timeout, e.g. handlers which never return and leak goroutines.
+// The requests are paired by the request id set by DefaultReqParams,
+// a leaked request is reported once as Component/UnfinishedRequests[count].
+type UnfinishedRequests struct {
+	lock    sync.Mutex
+	timeout time.Duration
+	started map[uint64]time.Time
+}
+
+// NewUnfinishedRequests creates new UnfinishedRequests metric
+func NewUnfinishedRequests(timeout time.Duration) *UnfinishedRequests {
+	return &UnfinishedRequests{
+		timeout: timeout,
+		started: make(map[uint64]time.Time),
+	}
+}
+
+// RequestStarted records the start of the request
+func (m *UnfinishedRequests) RequestStarted(params map[string]interface{}) {
+	id, ok := params[ParamRequestID].(uint64)
+	if !ok {
+		return
+	}
+
 	m.lock.Lock()
-	if params["statusCode"].(int) >= 400 {
-		m.errorCount[endpointName]++
+	m.started[id] = nowFunc()
+	m.lock.Unlock()
+}
+
+// Update marks the request as finished
+func (m *UnfinishedRequests) Update(params map[string]interface{}) error {
+	id, ok := params[ParamRequestID].(uint64)
+	if !ok {
+		return nil
 	}
-	m.reqCount[endpointName]++
+
+	m.lock.Lock()
+	delete(m.started, id)
 	m.lock.Unlock()
 
 	return nil
 }
 
 // ValueMap extract all the metrics to be reported
-func (m *ErrorRatePerEndpoint) ValueMap() map[string]float32 {
+func (m *UnfinishedRequests) ValueMap() map[string]float32 {
+	return m.values(true)
+}
 
-	metrics := make(map[string]float32)
+// Peek returns the current values without clearing them
+func (m *UnfinishedRequests) Peek() map[string]float32 {
+	return m.values(false)
+}
+
+func (m *UnfinishedRequests) values(reset bool) map[string]float32 {
 
 	m.lock.Lock()
-	var allEPErrors int
-	var reqAllEndpoints int
-	for endpoint := range m.errorCount {
-		metricName := m.namePrefix + endpoint + m.metricUnit
+	defer m.lock.Unlock()
 
-		metrics[metricName] = 0.
-		if overallReq := float32(m.reqCount[endpoint]); overallReq > 0.0 {
-			metrics[metricName] = float32(m.errorCount[endpoint]) / overallReq
+	now := nowFunc()
+	var unfinished int
+	for id, started := range m.started {
+		if now.Sub(started) > m.timeout {
+			unfinished++
+
+			// reported once, it is not expected to finish anymore
+			if reset {
+				delete(m.started, id)
+			}
 		}
+	}
 
-		allEPErrors += m.errorCount[endpoint]
-		reqAllEndpoints += m.reqCount[endpoint]
+	return map[string]float32{"Component/UnfinishedRequests[count]": float32(unfinished)}
+}
 
-		m.errorCount[endpoint] = 0
-		m.reqCount[endpoint] = 0
+/**************************************************
+* Requests per connection
+**************************************************/
+
+// ReqPerConnection reports the average number of requests served per
+// connection as Component/ReqPerConnection/overall[requests/connection], showing how
+// well the keep-alive connections are reused. The connections are told apart
+// by the id set under ParamConnectionID, see ConnContext. Requests without
+// the id are not counted and nothing is reported when none of them had it.
+// A connection is counted in every reporting interval it served requests in,
+// so connections kept alive across the intervals lower the average.
+type ReqPerConnection struct {
+	lock     sync.Mutex
+	requests map[uint64]int
+}
+
+// NewReqPerConnection creates new ReqPerConnection metric
+func NewReqPerConnection() *ReqPerConnection {
+	return &ReqPerConnection{
+		requests: make(map[uint64]int),
 	}
+}
 
-	metrics[m.allEPNamePrefix+m.metricUnit] = 0.
-	if reqAllEndpoints > 0 {
-		metrics[m.allEPNamePrefix+m.metricUnit] = float32(allEPErrors) / float32(reqAllEndpoints)
+// Update counts the request for its connection
+func (m *ReqPerConnection) Update(params map[string]interface{}) error {
+	id, ok := params[ParamConnectionID].(uint64)
+	if !ok {
+		return nil
 	}
 
+	m.lock.Lock()
+	m.requests[id]++
 	m.lock.Unlock()
 
-	return metrics
+	return nil
 }
 
-/**************************************************
-* Response time per endpoint
-**************************************************/
+// ValueMap extract all the metrics to be reported
+func (m *ReqPerConnection) ValueMap() map[string]float32 {
+	return m.freeze()()
+}
 
-// ResponseTimePerEndpoint tracks the response time per endpoint
-type ResponseTimePerEndpoint struct {
-	*StandardMetric
-	responseTimeMap map[string][]float32
+// Peek returns the current values without clearing them
+func (m *ReqPerConnection) Peek() map[string]float32 {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	return connectionValues(m.requests)
 }
 
-// NewResponseTimePerEndpoint creates new ResponseTimePerEndpoint metric
-func NewResponseTimePerEndpoint() *ResponseTimePerEndpoint {
+// freeze takes the requests of the interval out of the metric, the returned
+// function reports them without holding up the updates
+func (m *ReqPerConnection) freeze() func() map[string]float32 {
+	m.lock.Lock()
+	requests := m.requests
+	m.requests = make(map[uint64]int)
+	m.lock.Unlock()
 
-	metric := &ResponseTimePerEndpoint{
-		StandardMetric: &StandardMetric{
-			reqCount:        make(map[string]int),
-			namePrefix:      "Component/ResponseTimePerEndpoint/",
-			allEPNamePrefix: "Component/ResponseTime/overall",
-			metricUnit:      "[ms]",
-		},
+	return func() map[string]float32 {
+		return connectionValues(requests)
+	}
+}
 
-		responseTimeMap: make(map[string][]float32),
+// isOverall reports whether the name is the average over all the connections
+func (m *ReqPerConnection) isOverall(name string) bool {
+	return name == reqPerConnectionName
+}
+
+// Clear discards the counted requests
+func (m *ReqPerConnection) Clear() {
+	m.lock.Lock()
+	m.requests = make(map[uint64]int)
+	m.lock.Unlock()
+}
+
+// reqPerConnectionName is the name of the average of the requests per connection
+const reqPerConnectionName = "Component/ReqPerConnection/overall[requests/connection]"
+
+// connectionValues reports the average of the requests per connection
+func connectionValues(requests map[uint64]int) map[string]float32 {
+
+	metrics := make(map[string]float32)
+	if len(requests) == 0 {
+		return metrics
 	}
 
-	// initialize the metrics
-	metric.initReqCount()
-	for endpoint := range metric.endpoints {
-		metric.responseTimeMap[endpoint] = make([]float32, 1)
+	var total int
+	for _, count := range requests {
+		total += count
 	}
-	metric.responseTimeMap[unknownEndpoint] = make([]float32, 1)
+	metrics[reqPerConnectionName] = float32(total) / float32(len(requests))
 
-	return metric
+	return metrics
 }
 
-// Update the metric values
-func (m *ResponseTimePerEndpoint) Update(params map[string]interface{}) error {
+/**************************************************
+* Ratio of hits and misses
+**************************************************/
 
-	startTime, ok := params["reqStartTime"]
-	if !ok {
-		return errors.New("reqStart time should be time.Time")
+// RatioMetric counts hits and misses outside of the requests, e.g. of an in-process
+// cache, and reports the hit ratio of the interval as Component/<name>/HitRatio[ratio]
+// next to Component/<name>/Hits[count] and Component/<name>/Misses[count].
+// It fits any success and failure ratio. The ratio is left out of the intervals
+// without hits and misses.
+type RatioMetric struct {
+	lock   sync.Mutex
+	name   string
+	hits   int
+	misses int
+}
+
+// NewRatioMetric creates new RatioMetric reported under the name, e.g. Cache
+func NewRatioMetric(name string) (*RatioMetric, error) {
+	name = strings.Trim(name, "/ ")
+	if name == "" {
+		return nil, errors.New("Please specify name of the ratio metric")
 	}
+	return &RatioMetric{name: name}, nil
+}
 
-	elaspsedTimeInMs := float32(time.Since(startTime.(time.Time))) / float32(time.Millisecond)
+// RecordHit counts a hit, safe to call from any goroutine
+func (m *RatioMetric) RecordHit() {
+	m.lock.Lock()
+	m.hits++
+	m.lock.Unlock()
+}
 
-	endpointName := m.endpointName(params)
+// RecordMiss counts a miss, safe to call from any goroutine
+func (m *RatioMetric) RecordMiss() {
 	m.lock.Lock()
-	m.reqCount[endpointName]++
-	m.responseTimeMap[endpointName] = append(m.responseTimeMap[endpointName], elaspsedTimeInMs)
+	m.misses++
 	m.lock.Unlock()
+}
 
+// Update does nothing, the hits and misses are recorded directly
+func (m *RatioMetric) Update(params map[string]interface{}) error {
 	return nil
 }
 
 // ValueMap extract all the metrics to be reported
-func (m *ResponseTimePerEndpoint) ValueMap() map[string]float32 {
+func (m *RatioMetric) ValueMap() map[string]float32 {
+	return m.values(true)
+}
 
-	metrics := make(map[string]float32)
+// Peek returns the current values without clearing them
+func (m *RatioMetric) Peek() map[string]float32 {
+	return m.values(false)
+}
+
+// Clear discards the hits and misses recorded since the last report
+func (m *RatioMetric) Clear() {
+	m.lock.Lock()
+	m.hits, m.misses = 0, 0
+	m.lock.Unlock()
+}
+
+func (m *RatioMetric) values(reset bool) map[string]float32 {
 
 	m.lock.Lock()
 	defer m.lock.Unlock()
 
-	var responseTimeAllEndpoints float32
-	var numReqAllEndpoints int
+	metrics := map[string]float32{
+		"Component/" + m.name + "/Hits[count]":   float32(m.hits),
+		"Component/" + m.name + "/Misses[count]": float32(m.misses),
+	}
+	if total := m.hits + m.misses; total > 0 {
+		metrics["Component/"+m.name+"/HitRatio[ratio]"] = float32(m.hits) / float32(total)
+	}
 
-	for endpoint, values := range m.responseTimeMap {
+	if reset {
+		m.hits, m.misses = 0, 0
+	}
 
-		var responseTimeSum float32
-		for _, value := range values {
-			responseTimeSum += value
-		}
+	return metrics
+}
 
-		metricName := m.namePrefix + endpoint + m.metricUnit
-		metrics[metricName] = 0.
+/**************************************************
+* Custom metrics from a callback
+**************************************************/
 
-		if numReq := float32(m.reqCount[endpoint]); numReq > 0 {
-			metrics[metricName] = float32(responseTimeSum) / numReq
-		}
+// FuncMetric reports the values returned by a callback, e.g. the stats
+// of a connection pool, without implementing the whole AppMetric
+type FuncMetric struct {
+	fn func() map[string]float32
+}
 
-		responseTimeAllEndpoints += responseTimeSum
-		numReqAllEndpoints += m.reqCount[endpoint]
+// NewFuncMetric creates new FuncMetric reporting the values of fn.
+// fn is called on the reporting goroutine in every reporting cycle and
+// on every read of DebugHandler, it must be fast and must not block
+// or the report is delayed.
+func NewFuncMetric(fn func() map[string]float32) *FuncMetric {
+	return &FuncMetric{fn: fn}
+}
 
-		m.reqCount[endpoint] = 0
-		m.responseTimeMap[endpoint] = make([]float32, 1)
-	}
+// Update does nothing, the values come from the callback
+func (m *FuncMetric) Update(params map[string]interface{}) error {
+	return nil
+}
 
-	metrics[m.allEPNamePrefix+m.metricUnit] = 0.
-	if numReqAllEndpoints > 0 {
-		metrics[m.allEPNamePrefix+m.metricUnit] = responseTimeAllEndpoints / float32(numReqAllEndpoints)
-	}
+// ValueMap returns the values of the callback
+func (m *FuncMetric) ValueMap() map[string]float32 {
+	return m.fn()
+}
 
-	return metrics
+// Peek returns the values of the callback, it keeps no values to be cleared
+func (m *FuncMetric) Peek() map[string]float32 {
+	return m.fn()
+}
+
+// freeze defers the callback until the reporter released the updates
+func (m *FuncMetric) freeze() func() map[string]float32 {
+	return m.fn
 }
+
+// Clear does nothing, the callback has no values to discard
+func (m *FuncMetric) Clear() {}
@@ -1,10 +1,14 @@
 package simplerelic
 
 import (
+	"math"
 	"net/http"
 	"net/http/httptest"
+	"strconv"
 	"strings"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/gin-gonic/gin"
 )
@@ -27,13 +31,17 @@ func setup() {
 }
 
 func checkCalc(t *testing.T, values map[string]float32, expected float32) {
+	checkCalcUnit(t, values, "[percent]", expected)
+}
+
+func checkCalcUnit(t *testing.T, values map[string]float32, unit string, expected float32) {
 	for name, value := range values {
-		if strings.HasSuffix(name, endpointName+"[percent]") {
+		if strings.HasSuffix(name, endpointName+unit) {
 			if value != expected {
 				t.Errorf("error: expected %f, got %f", expected, value)
 			}
 		}
-		if strings.HasSuffix(name, "overall[percent]") {
+		if strings.HasSuffix(name, "overall"+unit) {
 			if value != expected {
 				t.Errorf("error: expected %f, got %f", expected, value)
 			}
@@ -72,6 +80,28 @@ func TestReq(t *testing.T) {
 
 }
 
+func TestReqCardinality(t *testing.T) {
+
+	m := NewReqPerEndpoint()
+	if _, ok := m.ValueMap()["Component/Cardinality/endpoints[endpoints]"]; ok {
+		t.Error("error: expected cardinality not to be reported by default")
+	}
+
+	m.SetReportCardinality(true)
+	for i := 0; i < 50; i++ {
+		m.Update(map[string]interface{}{"endpointName": "user" + strconv.Itoa(i)})
+		m.Update(map[string]interface{}{"endpointName": "user" + strconv.Itoa(i)})
+	}
+
+	values := m.ValueMap()
+	if value := values["Component/Cardinality/endpoints[endpoints]"]; value != 50 {
+		t.Errorf("error: expected %f, got %f", 50., value)
+	}
+	if value := m.ValueMap()["Component/Cardinality/endpoints[endpoints]"]; value != 0 {
+		t.Errorf("error: expected %f, got %f", 0., value)
+	}
+}
+
 func TestErrorRate(t *testing.T) {
 
 	setup()
@@ -102,6 +132,183 @@ func TestErrorRate(t *testing.T) {
 	checkIsCleared(t, m)
 }
 
+func TestServerErrorRate(t *testing.T) {
+
+	metrics := []struct {
+		metric   *ErrorRatePerEndpoint
+		overall  string
+		expected float32
+	}{
+		{NewErrorRatePerEndpoint(), "Component/ErrorRate/overall[percent]", 0.5},
+		{NewServerErrorRatePerEndpoint(), "Component/ServerErrorRate/overall[percent]", 0.25},
+	}
+
+	for _, m := range metrics {
+		params := map[string]interface{}{"endpointName": endpointName}
+		for _, statusCode := range []int{404, 500, 200, 200} {
+			params["statusCode"] = statusCode
+			m.metric.Update(params)
+		}
+
+		values := m.metric.ValueMap()
+		if value, ok := values[m.overall]; !ok || value != m.expected {
+			t.Errorf("error: expected %s to be %f, got %f", m.overall, m.expected, value)
+		}
+		checkCalc(t, values, m.expected)
+	}
+}
+
+func TestErrorStatusThreshold(t *testing.T) {
+
+	thresholds := []struct {
+		threshold int
+		expected  map[int]float32
+	}{
+		{0, map[int]float32{399: 0, 400: 1, 401: 1, 499: 1, 500: 1}},
+		{500, map[int]float32{399: 0, 400: 0, 401: 0, 499: 0, 500: 1}},
+	}
+
+	for _, th := range thresholds {
+		for statusCode, expected := range th.expected {
+			m := NewErrorRatePerEndpoint()
+			if th.threshold > 0 {
+				m.ErrorStatusThreshold = th.threshold
+			}
+			m.Update(map[string]interface{}{"endpointName": endpointName, "statusCode": statusCode})
+
+			if value := m.ValueMap()["Component/ErrorCount/log[errors]"]; value != expected {
+				t.Errorf("error: expected %f errors for status %d with threshold %d, got %f", expected, statusCode, th.threshold, value)
+			}
+		}
+	}
+
+	if threshold := NewServerErrorRatePerEndpoint().ErrorStatusThreshold; threshold != 500 {
+		t.Errorf("error: expected server error threshold 500, got %d", threshold)
+	}
+}
+
+func TestErrorCount(t *testing.T) {
+
+	m := NewErrorRatePerEndpoint()
+
+	requests := map[string][]int{
+		"log":    {500, 404, 200, 200},
+		"search": {200, 200},
+	}
+	for endpoint, statusCodes := range requests {
+		for _, statusCode := range statusCodes {
+			m.Update(map[string]interface{}{"endpointName": endpoint, "statusCode": statusCode})
+		}
+	}
+
+	values := m.ValueMap()
+	expected := map[string]float32{
+		"Component/ErrorCount/log[errors]":               2,
+		"Component/ErrorCount/search[errors]":            0,
+		"Component/ErrorCount/overall[errors]":           2,
+		"Component/ErrorRatePerEndpoint/log[percent]":    0.5,
+		"Component/ErrorRatePerEndpoint/search[percent]": 0,
+		"Component/ErrorRate/overall[percent]":           float32(2) / 6,
+	}
+	for name, value := range expected {
+		if values[name] != value {
+			t.Errorf("error: expected %s to be %f, got %f", name, value, values[name])
+		}
+	}
+}
+
+func TestRateLimited(t *testing.T) {
+
+	m := NewRateLimitedPerEndpoint()
+	errorRate := NewErrorRatePerEndpoint()
+	errorRate.SetIgnoreRateLimited(true)
+
+	for _, statusCode := range []int{429, 429, 200, 500} {
+		params := map[string]interface{}{"endpointName": endpointName, "statusCode": statusCode}
+		m.Update(params)
+		errorRate.Update(params)
+	}
+
+	values := m.ValueMap()
+	if value := values["Component/RateLimited/log[requests]"]; value != 2 {
+		t.Errorf("error: expected %f, got %f", 2., value)
+	}
+	if value := values["Component/RateLimited/overall[requests]"]; value != 2 {
+		t.Errorf("error: expected %f, got %f", 2., value)
+	}
+
+	// only the 500 is counted as an error
+	if value := errorRate.ValueMap()["Component/ErrorCount/log[errors]"]; value != 1 {
+		t.Errorf("error: expected %f, got %f", 1., value)
+	}
+}
+
+func TestErrorRateOverallAggregation(t *testing.T) {
+
+	tests := []struct {
+		aggregation OverallAggregation
+		expected    float32
+	}{
+		// 14 errors out of 100 requests overall
+		{AggregateWeighted, 0.14},
+		// mean of 0.5 and 0.125
+		{AggregateMean, 0.3125},
+	}
+
+	for _, test := range tests {
+		m := NewErrorRatePerEndpoint()
+		m.SetOverallAggregation(test.aggregation)
+
+		for i := 0; i < 4; i++ {
+			m.Update(map[string]interface{}{"endpointName": "small", "statusCode": 200 + 300*(i%2)})
+		}
+		for i := 0; i < 96; i++ {
+			statusCode := 200
+			if i < 12 {
+				statusCode = 500
+			}
+			m.Update(map[string]interface{}{"endpointName": "large", "statusCode": statusCode})
+		}
+
+		if value := m.ValueMap()["Component/ErrorRate/overall[percent]"]; value != test.expected {
+			t.Errorf("error: expected %f, got %f", test.expected, value)
+		}
+	}
+}
+
+func TestErrorRateFormat(t *testing.T) {
+
+	formats := []struct {
+		format   RateFormat
+		unit     string
+		expected float32
+	}{
+		{RateLegacy, "[percent]", 0.25},
+		{RatePercent, "[percent]", 25},
+		{RateRatio, "[ratio]", 0.25},
+	}
+
+	for _, f := range formats {
+		m := NewErrorRatePerEndpoint()
+		m.SetRateFormat(f.format)
+
+		params := map[string]interface{}{"endpointName": endpointName}
+		for i := 0; i < 4; i++ {
+			params["statusCode"] = 200
+			if i == 0 {
+				params["statusCode"] = 500
+			}
+			m.Update(params)
+		}
+
+		values := m.ValueMap()
+		if _, ok := values["Component/ErrorRate/overall"+f.unit]; !ok {
+			t.Errorf("error: missing overall metric with unit %s", f.unit)
+		}
+		checkCalcUnit(t, values, f.unit, f.expected)
+	}
+}
+
 func TestResponseTimeValueMap(t *testing.T) {
 
 	setup()
@@ -125,3 +332,1212 @@ func TestResponseTimeValueMap(t *testing.T) {
 	checkCalc(t, values, 0.15)
 	checkIsCleared(t, m)
 }
+
+func TestMetricSummary(t *testing.T) {
+
+	summary := NewMetricSummary([]float32{0.2, 0.1, 0.4})
+
+	if summary.Count != 3 {
+		t.Errorf("error: expected count %d, got %d", 3, summary.Count)
+	}
+	if summary.Min != 0.1 || summary.Max != 0.4 {
+		t.Errorf("error: expected min/max %f/%f, got %f/%f", 0.1, 0.4, summary.Min, summary.Max)
+	}
+	if summary.Total != float32(0.2)+float32(0.1)+float32(0.4) {
+		t.Errorf("error: unexpected total %f", summary.Total)
+	}
+	if diff := summary.SumOfSquares - 0.21; diff > 1e-6 || diff < -1e-6 {
+		t.Errorf("error: expected sum of squares %f, got %f", 0.21, summary.SumOfSquares)
+	}
+
+	empty := NewMetricSummary(nil)
+	if empty.Count != 0 || empty.Min != 0 || empty.Max != 0 {
+		t.Errorf("error: expected empty summary, got %+v", empty)
+	}
+}
+
+func TestResponseTimeInvalidStartTime(t *testing.T) {
+
+	_, restore := captureLog()
+	defer restore()
+
+	m := NewResponseTimePerEndpoint()
+
+	params := map[string]interface{}{"endpointName": endpointName}
+
+	// start time in future is clamped to 0
+	params["reqStartTime"] = time.Now().Add(time.Minute)
+	m.Update(params)
+
+	// absurdly old start time is ignored
+	params["reqStartTime"] = time.Now().Add(-24 * time.Hour)
+	m.Update(params)
+
+	if count := m.reqCount[endpointName]; count != 1 {
+		t.Errorf("error: expected %d request, got %d", 1, count)
+	}
+
+	values := m.ValueMap()
+	if value := values["Component/ResponseTimePerEndpoint/log[ms]"]; value != 0 {
+		t.Errorf("error: expected %f, got %f", 0., value)
+	}
+}
+
+func TestResponseTimeSampling(t *testing.T) {
+
+	m := NewResponseTimePerEndpoint()
+	m.SetSampleRate(0.5)
+
+	// record every second request
+	var calls int
+	m.random = func() float64 {
+		calls++
+		if calls%2 == 0 {
+			return 0.9
+		}
+		return 0.1
+	}
+
+	params := map[string]interface{}{"endpointName": endpointName}
+	for i := 0; i < 10; i++ {
+		params["reqStartTime"] = time.Now()
+		m.Update(params)
+	}
+
+	if count := m.reqCount[endpointName]; count != 10 {
+		t.Errorf("error: expected %d requests, got %d", 10, count)
+	}
+	if samples := len(m.responseTimeMap[endpointName]); samples != 5 {
+		t.Errorf("error: expected %d samples, got %d", 5, samples)
+	}
+
+	// the average is computed from the samples only
+	m.Clear()
+	for _, value := range []float32{0.1, 0.2, 0.1, 0.2} {
+		m.addSample(endpointName, value)
+	}
+	checkCalcUnit(t, m.ValueMap(), "[ms]", 0.15)
+}
+
+func TestResponseTimeSamples(t *testing.T) {
+
+	m := NewResponseTimePerEndpoint()
+	m.responseTimeMap[endpointName] = []float32{0.1, 0.2}
+
+	samples := m.Samples()
+	if len(samples[endpointName]) != 2 || samples[endpointName][0] != 0.1 || samples[endpointName][1] != 0.2 {
+		t.Errorf("error: unexpected samples %v", samples[endpointName])
+	}
+
+	// modifying the snapshot does not affect the metric
+	samples[endpointName][0] = 10
+	samples[endpointName] = append(samples[endpointName], 10)
+	if values := m.Samples()[endpointName]; len(values) != 2 || values[0] != 0.1 {
+		t.Errorf("error: expected the samples to be unchanged, got %v", values)
+	}
+}
+
+func TestPeek(t *testing.T) {
+
+	metrics := []AppMetric{NewReqPerEndpoint(), NewErrorRatePerEndpoint(), NewResponseTimePerEndpoint()}
+	expected := []string{
+		"Component/ReqPerEndpoint/log[requests]",
+		"Component/ErrorCount/log[errors]",
+		"Component/ResponseTimePerEndpoint/log[ms]",
+	}
+
+	for i, m := range metrics {
+		m.Update(map[string]interface{}{
+			"endpointName": endpointName,
+			"statusCode":   500,
+			"reqStartTime": time.Now().Add(-time.Millisecond),
+		})
+
+		peeker := m.(Peeker)
+		first, second := peeker.Peek(), peeker.Peek()
+		if first[expected[i]] == 0 {
+			t.Errorf("error: expected %s to be reported, got %v", expected[i], first)
+		}
+		if first[expected[i]] != second[expected[i]] {
+			t.Errorf("error: expected Peek to be idempotent, got %f and %f", first[expected[i]], second[expected[i]])
+		}
+
+		if values := m.ValueMap(); values[expected[i]] != first[expected[i]] {
+			t.Errorf("error: expected ValueMap to report %f, got %f", first[expected[i]], values[expected[i]])
+		}
+		if value := peeker.Peek()[expected[i]]; value != 0 {
+			t.Errorf("error: expected ValueMap to reset %s, got %f", expected[i], value)
+		}
+	}
+}
+
+func TestResponseTimeMaxSamples(t *testing.T) {
+
+	for _, policy := range []OverflowPolicy{OverflowDrop, OverflowReservoir} {
+		m := NewResponseTimePerEndpoint()
+		m.SetMaxSamples(10, policy)
+
+		params := map[string]interface{}{"endpointName": endpointName}
+		for i := 0; i < 100; i++ {
+			params["reqStartTime"] = time.Now()
+			m.Update(params)
+		}
+
+		if count := m.reqCount[endpointName]; count != 100 {
+			t.Errorf("error: expected %d requests, got %d", 100, count)
+		}
+		if samples := len(m.responseTimeMap[endpointName]); samples != 10 {
+			t.Errorf("error: expected %d samples, got %d", 10, samples)
+		}
+
+		// the report releases the samples of the interval
+		m.ValueMap()
+		if samples := m.responseTimeMap[endpointName]; cap(samples) != 0 {
+			t.Errorf("error: expected no samples kept, got capacity %d", cap(samples))
+		}
+	}
+}
+
+func TestResponseTimeReservoir(t *testing.T) {
+
+	m := NewResponseTimePerEndpoint()
+	m.SetMaxSamples(2, OverflowReservoir)
+
+	// always replace the first sample
+	m.random = func() float64 { return 0 }
+	for _, value := range []float32{1, 2, 3, 4} {
+		m.addSample(endpointName, value)
+	}
+	if samples := m.responseTimeMap[endpointName]; samples[0] != 4 || samples[1] != 2 {
+		t.Errorf("error: expected samples [4 2], got %v", samples)
+	}
+
+	// never replace
+	m.random = func() float64 { return 0.99 }
+	m.addSample(endpointName, 5)
+	if samples := m.responseTimeMap[endpointName]; samples[0] != 4 || samples[1] != 2 {
+		t.Errorf("error: expected samples [4 2], got %v", samples)
+	}
+}
+
+func TestMetricNames(t *testing.T) {
+
+	metrics := []struct {
+		metric  *StandardMetric
+		name    string
+		overall string
+	}{
+		{NewReqPerEndpoint().StandardMetric, "Component/ReqPerEndpoint/log[requests]", "Component/Req/overall[requests]"},
+		{NewErrorRatePerEndpoint().StandardMetric, "Component/ErrorRatePerEndpoint/log[percent]", "Component/ErrorRate/overall[percent]"},
+		{NewServerErrorRatePerEndpoint().StandardMetric, "Component/ServerErrorRatePerEndpoint/log[percent]", "Component/ServerErrorRate/overall[percent]"},
+		{NewRateLimitedPerEndpoint().StandardMetric, "Component/RateLimited/log[requests]", "Component/RateLimited/overall[requests]"},
+		{NewResponseTimePerEndpoint().StandardMetric, "Component/ResponseTimePerEndpoint/log[ms]", "Component/ResponseTime/overall[ms]"},
+	}
+
+	for _, m := range metrics {
+		if name := m.metric.name(endpointName); name != m.name {
+			t.Errorf("error: expected name %s, got %s", m.name, name)
+		}
+		if name := m.metric.overallName(); name != m.overall {
+			t.Errorf("error: expected overall name %s, got %s", m.overall, name)
+		}
+	}
+}
+
+func TestCustomParamKeys(t *testing.T) {
+
+	keys := ParamKeys{EndpointName: "route", StatusCode: "status", ReqStartTime: "start"}
+	params := map[string]interface{}{"route": endpointName, "status": 500, "start": time.Now()}
+
+	reqPerEndpoint := NewReqPerEndpoint()
+	errorRate := NewErrorRatePerEndpoint()
+	responseTime := NewResponseTimePerEndpoint()
+	for _, m := range []*StandardMetric{reqPerEndpoint.StandardMetric, errorRate.StandardMetric, responseTime.StandardMetric} {
+		m.SetParamKeys(keys)
+	}
+
+	reqPerEndpoint.Update(params)
+	errorRate.Update(params)
+	if err := responseTime.Update(params); err != nil {
+		t.Fatal(err)
+	}
+
+	if value := reqPerEndpoint.ValueMap()["Component/ReqPerEndpoint/log[requests]"]; value != 1 {
+		t.Errorf("error: expected %f, got %f", 1., value)
+	}
+	if value := errorRate.ValueMap()["Component/ErrorCount/log[errors]"]; value != 1 {
+		t.Errorf("error: expected %f, got %f", 1., value)
+	}
+	if samples := responseTime.Samples()[endpointName]; len(samples) != 1 {
+		t.Errorf("error: expected %d sample, got %d", 1, len(samples))
+	}
+
+	// the default keys are not read anymore
+	if err := responseTime.Update(map[string]interface{}{ParamReqStartTime: time.Now()}); err == nil {
+		t.Error("error: expected error for missing start time")
+	}
+}
+
+func TestResponseTimeInSeconds(t *testing.T) {
+
+	m := NewResponseTimePerEndpoint()
+	if err := m.SetTimeUnit(time.Minute); err == nil {
+		t.Error("error: expected error for unsupported unit")
+	}
+	if err := m.SetTimeUnit(time.Second); err != nil {
+		t.Fatal(err)
+	}
+
+	m.Update(map[string]interface{}{"endpointName": endpointName, "reqStartTime": time.Now().Add(-100 * time.Millisecond)})
+
+	values := m.ValueMap()
+	value, ok := values["Component/ResponseTimePerEndpoint/log[sec]"]
+	if !ok || value < 0.1 || value > 0.15 {
+		t.Errorf("error: expected about %f, got %f", 0.1, value)
+	}
+	if _, ok := values["Component/ResponseTime/overall[sec]"]; !ok {
+		t.Error("error: expected overall response time in seconds")
+	}
+}
+
+func TestExcludeEndpoint(t *testing.T) {
+
+	reqPerEndpoint := NewReqPerEndpoint()
+	errorRate := NewErrorRatePerEndpoint()
+	responseTime := NewResponseTimePerEndpoint()
+	metrics := []AppMetric{reqPerEndpoint, errorRate, responseTime}
+
+	update := func(endpoint string) {
+		params := DefaultReqParams(endpoint)
+		CollectParamsOnReqEnd(params, 500)
+		for _, m := range metrics {
+			m.Update(params)
+		}
+	}
+
+	// samples recorded before the exclusion are dropped as well
+	update("healthz")
+	for _, m := range []*StandardMetric{reqPerEndpoint.StandardMetric, errorRate.StandardMetric, responseTime.StandardMetric} {
+		m.Exclude("healthz")
+	}
+	update("healthz")
+	update(endpointName)
+
+	for _, m := range metrics {
+		for name := range m.ValueMap() {
+			if strings.Contains(name, "healthz") {
+				t.Errorf("error: excluded endpoint reported as %s", name)
+			}
+		}
+	}
+
+	update(endpointName)
+	values := reqPerEndpoint.ValueMap()
+	if value := values["Component/Req/overall[requests]"]; value != 1 {
+		t.Errorf("error: expected %f, got %f", 1., value)
+	}
+}
+
+func TestStatusCodeExcludeNestedEndpoint(t *testing.T) {
+
+	m := NewStatusCodePerEndpoint()
+	for _, endpoint := range []string{"api", "api/users", "api/orders"} {
+		m.Update(CollectParamsOnReqEnd(DefaultReqParams(endpoint), 200))
+	}
+	m.Exclude("api")
+	if count := m.BufferedCount(); count != 2 {
+		t.Errorf("error: expected the %d requests of the nested endpoints to be buffered, got %d", 2, count)
+	}
+
+	values := m.ValueMap()
+	for _, endpoint := range []string{"api/users", "api/orders"} {
+		var reported bool
+		for name, value := range values {
+			if strings.Contains(name, "/"+endpoint+"/200") && value == 1 {
+				reported = true
+			}
+		}
+		if !reported {
+			t.Errorf("error: expected the nested endpoint %s to be reported, got %v", endpoint, values)
+		}
+	}
+}
+
+func TestHTTPEndpointMetric(t *testing.T) {
+
+	_, restore := captureLog()
+	defer restore()
+
+	composite := NewHTTPEndpointMetric()
+	separate := []AppMetric{NewReqPerEndpoint(), NewErrorRatePerEndpoint(), NewResponseTimePerEndpoint()}
+
+	start := time.Now().Add(-10 * time.Millisecond)
+	for i, statusCode := range []int{200, 200, 404, 500} {
+		params := map[string]interface{}{"endpointName": endpointName, "reqStartTime": start, "statusCode": statusCode}
+		if i == 0 {
+			params["endpointName"] = "search"
+		}
+		composite.Update(params)
+		for _, m := range separate {
+			m.Update(params)
+		}
+	}
+
+	if count := composite.BufferedCount(); count != 4 {
+		t.Errorf("error: expected %d buffered requests, got %d", 4, count)
+	}
+
+	expected := make(map[string]float32)
+	for _, m := range separate {
+		for name, value := range m.ValueMap() {
+			expected[name] = value
+		}
+	}
+	values := composite.ValueMap()
+	if count := composite.BufferedCount(); count != 0 {
+		t.Errorf("error: expected no buffered requests after the report, got %d", count)
+	}
+
+	for name, value := range expected {
+		if strings.Contains(name, "/other[") {
+			// the separate metrics report the unknown endpoint up front
+			continue
+		}
+		actual, ok := values[name]
+		if !ok {
+			t.Errorf("error: expected %s to be reported", name)
+			continue
+		}
+		if strings.HasSuffix(name, "[ms]") {
+			if actual < 10 || actual > 50 {
+				t.Errorf("error: %s expected about %f, got %f", name, value, actual)
+			}
+		} else if actual != value {
+			t.Errorf("error: %s expected %f, got %f", name, value, actual)
+		}
+	}
+
+	// missing response time is reported but the request is counted
+	if err := composite.Update(map[string]interface{}{"endpointName": endpointName, "statusCode": 200}); err == nil {
+		t.Error("error: expected error for missing start time")
+	}
+	composite.Update(map[string]interface{}{"endpointName": "search", "statusCode": 200})
+	composite.ClearEndpoint("search")
+	if count := composite.BufferedCount(); count != 1 {
+		t.Errorf("error: expected %d buffered request after clearing the endpoint, got %d", 1, count)
+	}
+	if value := composite.ValueMap()["Component/Req/overall[requests]"]; value != 1 {
+		t.Errorf("error: expected %f, got %f", 1., value)
+	}
+}
+
+func benchmarkUpdate(b *testing.B, metrics []AppMetric) {
+	params := map[string]interface{}{"endpointName": endpointName, "reqStartTime": time.Now(), "statusCode": 200}
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			for _, m := range metrics {
+				m.Update(params)
+			}
+		}
+	})
+}
+
+func BenchmarkUpdateSeparateMetrics(b *testing.B) {
+	benchmarkUpdate(b, []AppMetric{NewReqPerEndpoint(), NewErrorRatePerEndpoint(), NewResponseTimePerEndpoint()})
+}
+
+func BenchmarkUpdateHTTPEndpointMetric(b *testing.B) {
+	benchmarkUpdate(b, []AppMetric{NewHTTPEndpointMetric()})
+}
+
+func TestResponseTimeSum(t *testing.T) {
+
+	m := NewResponseTimePerEndpoint()
+	m.SetReportSum(true)
+
+	m.lock.Lock()
+	for endpoint, ts := range map[string][]float32{endpointName: {10, 20, 60}, "search": {30}} {
+		for _, value := range ts {
+			m.addSample(endpoint, value)
+			m.countRequest(endpoint)
+		}
+	}
+	m.lock.Unlock()
+
+	values := m.ValueMap()
+	expected := map[string]float32{
+		"Component/ResponseTimeSum/log[ms]":             90,
+		"Component/ResponseTimeCount/log[requests]":     3,
+		"Component/ResponseTimeSum/search[ms]":          30,
+		"Component/ResponseTimeCount/search[requests]":  1,
+		"Component/ResponseTimeSum/overall[ms]":         120,
+		"Component/ResponseTimeCount/overall[requests]": 4,
+		"Component/ResponseTime/overall[ms]":            30,
+	}
+	for name, value := range expected {
+		if values[name] != value {
+			t.Errorf("error: expected %s to be %f, got %f", name, value, values[name])
+		}
+	}
+
+	m.SetReportSum(false)
+	if _, ok := m.ValueMap()["Component/ResponseTimeSum/overall[ms]"]; ok {
+		t.Error("error: expected no sum when disabled")
+	}
+}
+
+func TestResponseTimeSummary(t *testing.T) {
+
+	m := NewResponseTimePerEndpoint()
+	if summaries := m.SummaryMap(); len(summaries) != 0 {
+		t.Errorf("error: expected no summaries by default, got %v", summaries)
+	}
+	m.SetReportSummary(true)
+
+	m.lock.Lock()
+	for endpoint, ts := range map[string][]float32{endpointName: {10, 20, 60}, "search": {30}} {
+		for _, value := range ts {
+			m.addSample(endpoint, value)
+			m.countRequest(endpoint)
+		}
+	}
+	m.lock.Unlock()
+
+	summaries := m.SummaryMap()
+	expected := map[string]MetricSummary{
+		"Component/ResponseTimePerEndpoint/log[ms]":    {Total: 90, Count: 3, Min: 10, Max: 60, SumOfSquares: 4100},
+		"Component/ResponseTimePerEndpoint/search[ms]": {Total: 30, Count: 1, Min: 30, Max: 30, SumOfSquares: 900},
+		"Component/ResponseTime/overall[ms]":           {Total: 120, Count: 4, Min: 10, Max: 60, SumOfSquares: 5000},
+	}
+	for name, summary := range expected {
+		if summaries[name] == nil || *summaries[name] != summary {
+			t.Errorf("error: expected %s to be %+v, got %+v", name, summary, summaries[name])
+		}
+	}
+	if len(summaries) != len(expected) {
+		t.Errorf("error: expected %d summaries, got %d", len(expected), len(summaries))
+	}
+
+	// the report computes the summaries together with the values
+	values, reported := m.freezeSummaries()()
+	if overall := reported["Component/ResponseTime/overall[ms]"]; overall == nil || overall.Count != 4 {
+		t.Errorf("error: expected the overall summary of %d response times, got %+v", 4, overall)
+	}
+	if value := values["Component/ResponseTime/overall[ms]"]; value != 30 {
+		t.Errorf("error: expected overall response time %f, got %f", 30., value)
+	}
+
+	// and clears them
+	if summaries := m.SummaryMap(); len(summaries) != 0 {
+		t.Errorf("error: expected no summaries after the report, got %v", summaries)
+	}
+}
+
+func TestErrorClasses(t *testing.T) {
+
+	m := NewErrorRatePerEndpoint()
+	m.SetReportErrorClasses(true)
+
+	for _, statusCode := range []int{200, 404, 404, 503, 200, 200, 200, 200} {
+		params := DefaultReqParams(endpointName)
+		CollectParamsOnReqEnd(params, statusCode)
+		m.Update(params)
+	}
+
+	values := m.ValueMap()
+	expected := map[string]float32{
+		"Component/ErrorRate/ClientErrorRate/log[ratio]":     0.25,
+		"Component/ErrorRate/ServerErrorRate/log[ratio]":     0.125,
+		"Component/ErrorRate/ClientErrorRate/overall[ratio]": 0.25,
+		"Component/ErrorRate/ServerErrorRate/overall[ratio]": 0.125,
+		"Component/ErrorRatePerEndpoint/log[percent]":        0.375,
+	}
+	for name, value := range expected {
+		if values[name] != value {
+			t.Errorf("error: expected %s to be %f, got %f", name, value, values[name])
+		}
+	}
+
+	m.SetReportErrorClasses(false)
+	if _, ok := m.ValueMap()["Component/ErrorRate/ClientErrorRate/overall[ratio]"]; ok {
+		t.Error("error: expected no error classes when disabled")
+	}
+}
+
+func TestSuccessRate(t *testing.T) {
+
+	m := NewErrorRatePerEndpoint()
+	m.SetRateFormat(RateRatio)
+	m.SetReportSuccessRate(true)
+
+	for endpoint, statusCodes := range map[string][]int{
+		endpointName: {200, 301, 404, 503, 200, 399, 400, 200},
+		"search":     {200, 500, 500},
+	} {
+		for _, statusCode := range statusCodes {
+			params := DefaultReqParams(endpoint)
+			CollectParamsOnReqEnd(params, statusCode)
+			m.Update(params)
+		}
+	}
+	m.Update(map[string]interface{}{"endpointName": "idle", "statusCode": 200})
+	m.ValueMap()
+
+	m.Update(map[string]interface{}{"endpointName": endpointName, "statusCode": 200})
+	m.Update(map[string]interface{}{"endpointName": endpointName, "statusCode": 500})
+	m.Update(map[string]interface{}{"endpointName": "search", "statusCode": 404})
+	values := m.ValueMap()
+
+	for _, endpoint := range []string{endpointName, "search", "overall"} {
+		success := values["Component/ErrorRate/SuccessRate/"+endpoint+"[ratio]"]
+		errorRate := values["Component/ErrorRatePerEndpoint/"+endpoint+"[ratio]"]
+		if endpoint == "overall" {
+			errorRate = values["Component/ErrorRate/overall[ratio]"]
+		}
+		if math.Abs(float64(success+errorRate-1)) > 1e-6 {
+			t.Errorf("error: expected the success and error rates of %s to sum to 1, got %f and %f", endpoint, success, errorRate)
+		}
+	}
+	if value := values["Component/ErrorRate/SuccessRate/log[ratio]"]; value != .5 {
+		t.Errorf("error: expected %f, got %f", .5, value)
+	}
+
+	// no success rate without requests
+	if _, ok := values["Component/ErrorRate/SuccessRate/idle[ratio]"]; ok {
+		t.Error("error: expected no success rate for an endpoint without requests")
+	}
+}
+
+func TestBurnRate(t *testing.T) {
+
+	m := NewErrorRatePerEndpoint()
+	if err := m.SetReportBurnRate(2); err == nil {
+		t.Error("error: expected error for a budget above 1")
+	}
+	if err := m.SetReportBurnRate(0.01); err != nil {
+		t.Fatal(err)
+	}
+
+	// 2% errors on a budget of 1%
+	for i := 0; i < 100; i++ {
+		statusCode := 200
+		if i < 2 {
+			statusCode = 500
+		}
+		m.Update(map[string]interface{}{"endpointName": endpointName, "statusCode": statusCode})
+	}
+	m.Update(map[string]interface{}{"endpointName": "search", "statusCode": 200})
+	m.Update(map[string]interface{}{"endpointName": "search", "statusCode": 200})
+
+	values := m.ValueMap()
+	expected := map[string]float32{
+		"Component/ErrorRate/BurnRate/log[ratio]":     2,
+		"Component/ErrorRate/BurnRate/search[ratio]":  0,
+		"Component/ErrorRate/BurnRate/overall[ratio]": 2. / 102 / 0.01,
+	}
+	for name, value := range expected {
+		if math.Abs(float64(values[name]-value)) > 1e-5 {
+			t.Errorf("error: expected %s to be %f, got %f", name, value, values[name])
+		}
+	}
+
+	// no traffic burns no budget
+	values = m.ValueMap()
+	if value, ok := values["Component/ErrorRate/BurnRate/log[ratio]"]; !ok || value != 0 {
+		t.Errorf("error: expected a burn rate of %f without requests, got %f", 0., value)
+	}
+}
+
+func TestErrorRateNamesPerMetric(t *testing.T) {
+
+	metrics := []*ErrorRatePerEndpoint{NewErrorRatePerEndpoint(), NewServerErrorRatePerEndpoint()}
+	names := make(map[string]bool)
+	for _, m := range metrics {
+		m.SetRateFormat(RateRatio)
+		m.SetReportErrorClasses(true)
+		m.SetReportSuccessRate(true)
+		if err := m.SetReportBurnRate(0.01); err != nil {
+			t.Fatal(err)
+		}
+		m.Update(CollectParamsOnReqEnd(DefaultReqParams(endpointName), 503))
+
+		// the rates of one metric don't collide with the ones of the other
+		for name := range m.ValueMap() {
+			if names[name] {
+				t.Errorf("error: expected %s to be reported by a single error rate metric", name)
+			}
+			names[name] = true
+		}
+	}
+	if !names["Component/ServerErrorRate/BurnRate/log[ratio]"] {
+		t.Errorf("error: expected the burn rate of the server error rate under its own name, got %v", names)
+	}
+}
+
+func TestSlowRequestCount(t *testing.T) {
+
+	m := NewSlowRequestCount(500 * time.Millisecond)
+
+	now := time.Now()
+	for endpoint, elapsed := range map[string][]time.Duration{
+		endpointName: {10 * time.Millisecond, 600 * time.Millisecond, 2 * time.Second, 100 * time.Millisecond},
+		"search":     {50 * time.Millisecond},
+	} {
+		for _, e := range elapsed {
+			m.Update(map[string]interface{}{"endpointName": endpoint, "reqStartTime": now.Add(-e)})
+		}
+	}
+
+	values := m.ValueMap()
+	expected := map[string]float32{
+		"Component/SlowRequests/log[count]":     2,
+		"Component/SlowRequests/search[count]":  0,
+		"Component/SlowRequests/overall[count]": 2,
+	}
+	for name, value := range expected {
+		if values[name] != value {
+			t.Errorf("error: expected %s to be %f, got %f", name, value, values[name])
+		}
+	}
+
+	if err := m.Update(map[string]interface{}{"endpointName": endpointName}); err == nil {
+		t.Error("error: expected error for missing start time")
+	}
+}
+
+func TestFakeClock(t *testing.T) {
+
+	start := time.Date(2020, 1, 1, 12, 0, 0, 0, time.UTC)
+	now := start
+	nowFunc = func() time.Time { return now }
+	defer func() { nowFunc = time.Now }()
+
+	m := NewResponseTimePerEndpoint()
+	params := DefaultReqParams(endpointName)
+
+	now = start.Add(123 * time.Millisecond)
+	m.Update(params)
+
+	if value := m.ValueMap()["Component/ResponseTimePerEndpoint/log[ms]"]; value != 123 {
+		t.Errorf("error: expected %f, got %f", 123., value)
+	}
+}
+
+func TestOverallRate(t *testing.T) {
+
+	start := time.Date(2020, 1, 1, 12, 0, 0, 0, time.UTC)
+	now := start
+	nowFunc = func() time.Time { return now }
+	defer func() { nowFunc = time.Now }()
+
+	m := NewReqPerEndpoint()
+	m.SetReportOverallRate(true)
+
+	for i := 0; i < 90; i++ {
+		m.Update(DefaultReqParams(endpointName))
+	}
+	for i := 0; i < 30; i++ {
+		m.Update(DefaultReqParams("search"))
+	}
+
+	now = start.Add(time.Minute)
+	values := m.ValueMap()
+	if value := values["Component/Req/overall[requests/sec]"]; value != 2 {
+		t.Errorf("error: expected %f, got %f", 2., value)
+	}
+	if value := values["Component/Req/overall[requests]"]; value != 120 {
+		t.Errorf("error: expected %f, got %f", 120., value)
+	}
+
+	// the next interval starts with the report
+	m.Update(DefaultReqParams(endpointName))
+	now = now.Add(10 * time.Second)
+	if value := m.ValueMap()["Component/Req/overall[requests/sec]"]; value != 0.1 {
+		t.Errorf("error: expected %f, got %f", 0.1, value)
+	}
+}
+
+func TestReqPerContentType(t *testing.T) {
+
+	m := NewReqPerContentType()
+	for _, contentType := range []string{
+		"application/json",
+		"application/json; charset=utf-8",
+		"Text/HTML; charset=ISO-8859-1",
+		"application/octet-stream",
+		"",
+		"not a content type;;",
+	} {
+		m.Update(map[string]interface{}{ParamContentType: contentType})
+	}
+	m.Update(map[string]interface{}{})
+
+	values := m.ValueMap()
+	expected := map[string]float32{
+		"Component/ContentType/application/json[requests]":         2,
+		"Component/ContentType/text/html[requests]":                1,
+		"Component/ContentType/application/octet-stream[requests]": 1,
+		"Component/ContentType/other[requests]":                    3,
+		"Component/ContentType/overall[requests]":                  7,
+	}
+	for name, value := range expected {
+		if values[name] != value {
+			t.Errorf("error: expected %s to be %f, got %f", name, value, values[name])
+		}
+	}
+}
+
+func TestMinResponseTime(t *testing.T) {
+
+	start := time.Date(2020, 1, 1, 12, 0, 0, 0, time.UTC)
+	now := start
+	nowFunc = func() time.Time { return now }
+	defer func() { nowFunc = time.Now }()
+
+	m := NewResponseTimePerEndpoint()
+
+	update := func(elapsed time.Duration) {
+		params := DefaultReqParams(endpointName)
+		now = start.Add(elapsed)
+		m.Update(params)
+		now = start
+	}
+
+	update(2 * time.Microsecond)
+	if value := m.ValueMap()["Component/ResponseTimePerEndpoint/log[ms]"]; value != 0.002 {
+		t.Errorf("error: expected %f by default, got %f", 0.002, value)
+	}
+
+	m.SetMinResponseTime(time.Microsecond * 10)
+	update(2 * time.Microsecond)
+	update(10 * time.Microsecond)
+	if value := m.ValueMap()["Component/ResponseTimePerEndpoint/log[ms]"]; value != 0.005 {
+		t.Errorf("error: expected %f, got %f", 0.005, value)
+	}
+}
+
+func TestStatusCodePerEndpoint(t *testing.T) {
+
+	m := NewStatusCodePerEndpoint()
+	for _, statusCode := range []int{200, 200, 301, 404, 502, 502, 504} {
+		m.Update(map[string]interface{}{"endpointName": endpointName, "statusCode": statusCode})
+	}
+
+	values := m.ValueMap()
+	expected := map[string]float32{
+		"Component/StatusCode/log/200[requests]": 2,
+		"Component/StatusCode/log/301[requests]": 1,
+		"Component/StatusCode/log/404[requests]": 1,
+		"Component/StatusCode/log/502[requests]": 2,
+		"Component/StatusCode/log/504[requests]": 1,
+		"Component/StatusCode/overall[requests]": 7,
+	}
+	for name, value := range expected {
+		if values[name] != value {
+			t.Errorf("error: expected %s to be %f, got %f", name, value, values[name])
+		}
+	}
+
+	// the codes beyond the cap are folded into other
+	m = NewStatusCodePerEndpoint()
+	if err := m.SetMaxStatusCodes(0); err == nil {
+		t.Error("error: expected error for no status codes")
+	}
+	m.SetMaxStatusCodes(3)
+	for _, statusCode := range []int{200, 301, 404, 502, 504, 200} {
+		m.Update(map[string]interface{}{"endpointName": endpointName, "statusCode": statusCode})
+	}
+
+	values = m.ValueMap()
+	expected = map[string]float32{
+		"Component/StatusCode/log/200[requests]":   2,
+		"Component/StatusCode/log/301[requests]":   1,
+		"Component/StatusCode/log/404[requests]":   1,
+		"Component/StatusCode/log/other[requests]": 2,
+	}
+	for name, value := range expected {
+		if values[name] != value {
+			t.Errorf("error: expected %s to be %f, got %f", name, value, values[name])
+		}
+	}
+	if _, ok := values["Component/StatusCode/log/502[requests]"]; ok {
+		t.Error("error: expected 502 to be folded into other")
+	}
+}
+
+func TestResponseTimeEWMA(t *testing.T) {
+
+	start := time.Date(2020, 1, 1, 12, 0, 0, 0, time.UTC)
+	now := start
+	nowFunc = func() time.Time { return now }
+	defer func() { nowFunc = time.Now }()
+
+	m := NewResponseTimePerEndpoint()
+	if err := m.SetEWMA(1.5); err == nil {
+		t.Error("error: expected error for alpha above 1")
+	}
+	if err := m.SetEWMA(.5); err != nil {
+		t.Fatal(err)
+	}
+
+	update := func(elapsed time.Duration) {
+		m.Update(map[string]interface{}{"endpointName": endpointName, "reqStartTime": now.Add(-elapsed)})
+	}
+	name := "Component/ResponseTimeEWMA/log[ms]"
+
+	update(0)
+	if value := m.ValueMap()[name]; value != 0 {
+		t.Errorf("error: expected the first average to be %f, got %f", 0., value)
+	}
+
+	// a steady response time of 100ms
+	var previous float32
+	for i := 0; i < 12; i++ {
+		update(100 * time.Millisecond)
+		value := m.ValueMap()[name]
+		if value <= previous || value > 100 {
+			t.Errorf("error: expected the average to approach %f from %f, got %f", 100., previous, value)
+		}
+		previous = value
+	}
+	if previous < 99.9 {
+		t.Errorf("error: expected the average to converge to %f, got %f", 100., previous)
+	}
+
+	// the average carries over an interval without requests
+	if value := m.ValueMap()[name]; value != previous {
+		t.Errorf("error: expected %f without requests, got %f", previous, value)
+	}
+
+	m.Clear()
+	if _, ok := m.ValueMap()[name]; ok {
+		t.Error("error: expected the average to be discarded by Clear")
+	}
+}
+
+func TestInvalidStartTime(t *testing.T) {
+
+	params := map[string]interface{}{"endpointName": endpointName, "reqStartTime": time.Now().Format(time.RFC3339)}
+	for _, m := range []AppMetric{NewResponseTimePerEndpoint(), NewSlowRequestCount(time.Second)} {
+		if err := m.Update(params); err == nil || err.Error() != "reqStart time should be time.Time" {
+			t.Errorf("error: expected error for a start time of type string, got %v", err)
+		}
+	}
+}
+
+func TestReqPerEndpointLabels(t *testing.T) {
+
+	m := NewReqPerEndpoint()
+	if err := m.SetReportLabels(0, "tenant"); err == nil {
+		t.Error("error: expected error for no label series")
+	}
+	if err := m.SetReportLabels(2, "tenant"); err != nil {
+		t.Fatal(err)
+	}
+
+	update := func(labels map[string]string) {
+		m.Update(map[string]interface{}{"endpointName": endpointName, ParamLabels: labels})
+	}
+	update(map[string]string{"tenant": "acme"})
+	update(map[string]string{"tenant": "acme", "version": "v1"})
+	update(map[string]string{"tenant": "globex"})
+	update(nil)
+
+	values := m.ValueMap()
+	expected := map[string]float32{
+		"Component/ReqPerEndpoint/log/tenant=acme[requests]":   2,
+		"Component/ReqPerEndpoint/log/tenant=globex[requests]": 1,
+		"Component/ReqPerEndpoint/log[requests]":               4,
+		"Component/Req/overall[requests]":                      4,
+	}
+	for name, value := range expected {
+		if values[name] != value {
+			t.Errorf("error: expected %s to be %f, got %f", name, value, values[name])
+		}
+	}
+
+	// the combinations beyond the cap are folded into other
+	update(map[string]string{"tenant": "initech"})
+	update(map[string]string{"tenant": "umbrella"})
+	update(map[string]string{"tenant": "acme"})
+
+	values = m.ValueMap()
+	expected = map[string]float32{
+		"Component/ReqPerEndpoint/log/tenant=acme[requests]": 1,
+		"Component/ReqPerEndpoint/log/other[requests]":       2,
+	}
+	for name, value := range expected {
+		if values[name] != value {
+			t.Errorf("error: expected %s to be %f, got %f", name, value, values[name])
+		}
+	}
+	if _, ok := values["Component/ReqPerEndpoint/log/tenant=initech[requests]"]; ok {
+		t.Error("error: expected the tenant beyond the cap to be folded into other")
+	}
+}
+
+func TestReqPerEndpointLabelsSanitized(t *testing.T) {
+
+	m := NewReqPerEndpoint()
+	if err := m.SetReportLabels(2, "tenant"); err != nil {
+		t.Fatal(err)
+	}
+	m.Update(map[string]interface{}{"endpointName": endpointName, ParamLabels: map[string]string{"tenant": "a/b[x]"}})
+
+	values := m.ValueMap()
+	name := "Component/ReqPerEndpoint/log/tenant=a_b_x_[requests]"
+	if values[name] != 1 {
+		t.Errorf("error: expected %s to be 1, got %v", name, values)
+	}
+}
+
+func TestEmitOverallAndPerEndpoint(t *testing.T) {
+
+	for _, c := range []struct {
+		overall, perEndpoint bool
+	}{
+		{true, true},
+		{true, false},
+		{false, true},
+		{false, false},
+	} {
+		reqPerEndpoint := NewReqPerEndpoint()
+		responseTime := NewResponseTimePerEndpoint()
+		for _, m := range []*StandardMetric{reqPerEndpoint.StandardMetric, responseTime.StandardMetric} {
+			m.SetEmitOverall(c.overall)
+			m.SetEmitPerEndpoint(c.perEndpoint)
+		}
+
+		params := DefaultReqParams(endpointName)
+		reqPerEndpoint.Update(params)
+		responseTime.Update(params)
+
+		values := reqPerEndpoint.ValueMap()
+		for name, value := range responseTime.ValueMap() {
+			values[name] = value
+		}
+
+		for name, expected := range map[string]bool{
+			"Component/Req/overall[requests]":           c.overall,
+			"Component/ResponseTime/overall[ms]":        c.overall,
+			"Component/ReqPerEndpoint/log[requests]":    c.perEndpoint,
+			"Component/ResponseTimePerEndpoint/log[ms]": c.perEndpoint,
+		} {
+			if _, ok := values[name]; ok != expected {
+				t.Errorf("error: expected %s to be reported %t with overall %t and per endpoint %t",
+					name, expected, c.overall, c.perEndpoint)
+			}
+		}
+		if !c.overall && !c.perEndpoint && len(values) != 0 {
+			t.Errorf("error: expected no values, got %v", values)
+		}
+	}
+}
+
+func TestReqPerConnection(t *testing.T) {
+
+	m := NewReqPerConnection()
+
+	// without connection ids nothing is reported
+	m.Update(DefaultReqParams("log"))
+	if values := m.ValueMap(); len(values) != 0 {
+		t.Errorf("error: expected no values without connection ids, got %v", values)
+	}
+
+	// three requests on the first connection, one on the second
+	for _, id := range []uint64{1, 1, 2, 1} {
+		params := DefaultReqParams("log")
+		params[ParamConnectionID] = id
+		m.Update(params)
+	}
+	if value := m.Peek()["Component/ReqPerConnection/overall[requests/connection]"]; value != 2 {
+		t.Errorf("error: expected 2 requests per connection, got %f", value)
+	}
+	if value := m.ValueMap()["Component/ReqPerConnection/overall[requests/connection]"]; value != 2 {
+		t.Errorf("error: expected 2 requests per connection, got %f", value)
+	}
+	if values := m.ValueMap(); len(values) != 0 {
+		t.Errorf("error: expected no values after the report, got %v", values)
+	}
+}
+
+func TestReportQuietEndpoints(t *testing.T) {
+
+	m := NewReqPerEndpoint()
+	m.SetReportQuietEndpoints(2)
+
+	for _, endpoint := range []string{"log", "search", "search"} {
+		m.Update(CollectParamsOnReqEnd(DefaultReqParams(endpoint), 200))
+	}
+	values := m.ValueMap()
+	if values["Component/ReqPerEndpoint/log[requests]"] != 1 || values["Component/ReqPerEndpoint/search[requests]"] != 2 {
+		t.Errorf("error: unexpected values of the first interval %v", values)
+	}
+
+	// log goes quiet, users is beyond the cap
+	m.Update(CollectParamsOnReqEnd(DefaultReqParams("search"), 200))
+	m.Update(CollectParamsOnReqEnd(DefaultReqParams("users"), 200))
+	values = m.ValueMap()
+	value, ok := values["Component/ReqPerEndpoint/log[requests]"]
+	if !ok || value != 0 {
+		t.Errorf("error: expected the quiet endpoint to be reported as 0, got %v", values)
+	}
+	if values["Component/ReqPerEndpoint/search[requests]"] != 1 || values["Component/ReqPerEndpoint/users[requests]"] != 1 {
+		t.Errorf("error: unexpected values of the second interval %v", values)
+	}
+
+	values = m.ValueMap()
+	if _, ok := values["Component/ReqPerEndpoint/users[requests]"]; ok {
+		t.Errorf("error: expected endpoint beyond the cap not to be remembered, got %v", values)
+	}
+	if len(values) != 3 {
+		t.Errorf("error: expected the two remembered endpoints and overall, got %v", values)
+	}
+
+	m.SetReportQuietEndpoints(0)
+	if values := m.ValueMap(); len(values) != 1 {
+		t.Errorf("error: expected only overall once disabled, got %v", values)
+	}
+}
+
+func TestClearEndpoint(t *testing.T) {
+
+	percentiles, err := NewResponseTimePercentilePerEndpoint(PercentileExact)
+	if err != nil {
+		t.Fatal(err)
+	}
+	metrics := []interface {
+		AppMetric
+		ClearEndpoint(endpoint string)
+	}{
+		NewReqPerEndpoint(),
+		NewErrorRatePerEndpoint(),
+		NewStatusCodePerEndpoint(),
+		NewResponseTimePerEndpoint(),
+		NewHTTPEndpointMetric(),
+		percentiles,
+	}
+
+	for _, m := range metrics {
+		for _, endpoint := range []string{"log", "search"} {
+			m.Update(CollectParamsOnReqEnd(DefaultReqParams(endpoint), 500))
+		}
+		m.ClearEndpoint("log")
+
+		var search bool
+		for name := range m.ValueMap() {
+			if strings.Contains(name, "/log") {
+				t.Errorf("error: expected cleared endpoint not to be reported by %T, got %s", m, name)
+			}
+			search = search || strings.Contains(name, "/search")
+		}
+		if !search {
+			t.Errorf("error: expected the other endpoint to be reported by %T", m)
+		}
+	}
+}
+
+func TestRatioMetric(t *testing.T) {
+
+	if _, err := NewRatioMetric(" "); err == nil {
+		t.Error("error: expected error for an empty name")
+	}
+
+	m, err := NewRatioMetric("Cache")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 25; j++ {
+				m.RecordHit()
+				m.RecordHit()
+				m.RecordHit()
+				m.RecordMiss()
+			}
+		}()
+	}
+	wg.Wait()
+
+	values := m.ValueMap()
+	expected := map[string]float32{
+		"Component/Cache/HitRatio[ratio]": 0.75,
+		"Component/Cache/Hits[count]":     300,
+		"Component/Cache/Misses[count]":   100,
+	}
+	for name, value := range expected {
+		if values[name] != value {
+			t.Errorf("error: expected %s to be %f, got %f", name, value, values[name])
+		}
+	}
+
+	// reset each interval, without the ratio when nothing was recorded
+	values = m.ValueMap()
+	if _, ok := values["Component/Cache/HitRatio[ratio]"]; ok || values["Component/Cache/Hits[count]"] != 0 {
+		t.Errorf("error: expected the counts to be reset, got %v", values)
+	}
+}
+
+func TestResponseTimeMaxEndpoints(t *testing.T) {
+
+	m := NewResponseTimePerEndpoint()
+	if err := m.SetMaxEndpoints(-1); err == nil {
+		t.Error("error: expected error for a negative limit")
+	}
+	if err := m.SetMaxEndpoints(2); err != nil {
+		t.Fatal(err)
+	}
+
+	update := func(endpoint string, value float32) {
+		m.lock.Lock()
+		m.touch(endpoint)
+		m.countRequest(endpoint)
+		m.addSample(endpoint, value)
+		m.lock.Unlock()
+	}
+
+	// search is the least recently updated one when users arrives
+	update("log", 10)
+	update("search", 20)
+	update("log", 30)
+	update("users", 40)
+
+	values := m.Peek()
+	expected := map[string]float32{
+		"Component/ResponseTimePerEndpoint/log[ms]":   20,
+		"Component/ResponseTimePerEndpoint/users[ms]": 40,
+		"Component/ResponseTimePerEndpoint/other[ms]": 20,
+	}
+	for name, value := range expected {
+		if values[name] != value {
+			t.Errorf("error: expected %s to be %f, got %f", name, value, values[name])
+		}
+	}
+	if _, ok := values["Component/ResponseTimePerEndpoint/search[ms]"]; ok {
+		t.Errorf("error: expected the evicted endpoint not to be reported, got %v", values)
+	}
+	if m.BufferedCount() != 4 {
+		t.Errorf("error: expected the requests of the evicted endpoint to be kept, got %d", m.BufferedCount())
+	}
+
+	// it reappears, log is evicted now
+	m.ValueMap()
+	update("search", 50)
+	values = m.ValueMap()
+	if values["Component/ResponseTimePerEndpoint/search[ms]"] != 50 {
+		t.Errorf("error: expected the endpoint to be reported again, got %v", values)
+	}
+	if _, ok := values["Component/ResponseTimePerEndpoint/log[ms]"]; ok {
+		t.Errorf("error: expected the least recently updated endpoint to be evicted, got %v", values)
+	}
+	if len(m.responseTimeMap) > 3 {
+		t.Errorf("error: expected at most 2 endpoints and other, got %v", m.responseTimeMap)
+	}
+}
@@ -0,0 +1,107 @@
+package simplerelic
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"strings"
+	"sync/atomic"
+)
+
+// key of the connection id in the context of the requests
+type connectionIDKey struct{}
+
+// connectionIDs numbers the connections accepted by the servers using ConnContext
+var connectionIDs uint64
+
+// ConnContext adds an id of the connection to the context of its requests,
+// set it as the ConnContext of the http.Server to report ReqPerConnection
+func ConnContext(ctx context.Context, conn net.Conn) context.Context {
+	return context.WithValue(ctx, connectionIDKey{}, atomic.AddUint64(&connectionIDs, 1))
+}
+
+// ConnectionID returns the id of the connection added by ConnContext,
+// false when the server doesn't set it
+func ConnectionID(ctx context.Context) (uint64, bool) {
+	id, ok := ctx.Value(connectionIDKey{}).(uint64)
+	return id, ok
+}
+
+// EndpointNamer maps a request to the name of the endpoint its metrics
+// are reported under. It is the place to control the number of distinct
+// endpoints e.g. by collapsing ids in the path.
+type EndpointNamer func(r *http.Request) string
+
+// PathEndpointNamer names the endpoint after the URL path without
+// the leading and trailing slashes, the root path is named "root"
+func PathEndpointNamer(r *http.Request) string {
+	name := strings.Trim(r.URL.Path, "/")
+	if name == "" {
+		return "root"
+	}
+	return name
+}
+
+// DepthEndpointNamer names the endpoint after the first depth segments of the
+// URL path, e.g. api/users for /api/users/123/posts at depth 2, which bounds the
+// number of endpoints without collapsing the ids by hand. Empty segments are
+// skipped, the root path is named "root" like by PathEndpointNamer.
+func DepthEndpointNamer(depth int) EndpointNamer {
+	return func(r *http.Request) string {
+		return PathDepth(r.URL.Path, depth)
+	}
+}
+
+// PathDepth names the endpoint of the path like DepthEndpointNamer, e.g. for
+// DefaultReqParams in a handler of a framework. Depth below 1 keeps all the segments.
+func PathDepth(path string, depth int) string {
+	segments := make([]string, 0, 4)
+	for _, segment := range strings.Split(path, "/") {
+		if segment == "" {
+			continue
+		}
+		if depth > 0 && len(segments) == depth {
+			break
+		}
+		segments = append(segments, segment)
+	}
+
+	if len(segments) == 0 {
+		return "root"
+	}
+	return strings.Join(segments, "/")
+}
+
+// SetEndpointNamer sets how the middleware names the endpoints,
+// by default PathEndpointNamer is used
+func (reporter *Reporter) SetEndpointNamer(namer EndpointNamer) {
+	reporter.lock.Lock()
+	reporter.endpointNamer = namer
+	reporter.lock.Unlock()
+}
+
+// Handler wraps the http handler with a middleware updating
+// the metrics of the reporter on every request
+func (reporter *Reporter) Handler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// before naming the endpoint which may take a while
+		start := StartTimer()
+
+		reporter.lock.Lock()
+		namer := reporter.endpointNamer
+		reporter.lock.Unlock()
+
+		params := newReqParams(namer(r), start)
+		if id, ok := ConnectionID(r.Context()); ok {
+			params[ParamConnectionID] = id
+		}
+		reporter.startRequest(params)
+
+		recorder := WrapResponseWriter(w)
+		next.ServeHTTP(recorder, r)
+
+		CollectParamsOnReqEnd(params, recorder.Status())
+		params[ParamContentType] = recorder.Header().Get("Content-Type")
+		reporter.UpdateMetrics(params)
+	})
+}
@@ -0,0 +1,128 @@
+package simplerelic
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func serve(handler http.Handler, method string, path string) *httptest.ResponseRecorder {
+	recorder := httptest.NewRecorder()
+	req, _ := http.NewRequest(method, path, nil)
+	handler.ServeHTTP(recorder, req)
+	return recorder
+}
+
+func TestPathEndpointNamer(t *testing.T) {
+
+	paths := map[string]string{
+		"/":           "root",
+		"":            "root",
+		"/log":        "log",
+		"/users/123/": "users/123",
+	}
+	for path, expected := range paths {
+		req, _ := http.NewRequest("GET", "http://localhost"+path, nil)
+		if name := PathEndpointNamer(req); name != expected {
+			t.Errorf("error: expected endpoint %q for path %q, got %q", expected, path, name)
+		}
+	}
+}
+
+func TestDepthEndpointNamer(t *testing.T) {
+
+	paths := map[string][]string{
+		"/api/users/123/posts": {"api", "api/users", "api/users/123"},
+		"/api/users/":          {"api", "api/users", "api/users"},
+		"//api///users//123":   {"api", "api/users", "api/users/123"},
+		"/api":                 {"api", "api", "api"},
+		"/":                    {"root", "root", "root"},
+		"":                     {"root", "root", "root"},
+	}
+	for path, expected := range paths {
+		for i, name := range expected {
+			depth := i + 1
+			req, _ := http.NewRequest("GET", "http://localhost"+path, nil)
+			if got := DepthEndpointNamer(depth)(req); got != name {
+				t.Errorf("error: expected endpoint %q for path %q at depth %d, got %q", name, path, depth, got)
+			}
+		}
+	}
+
+	if name := PathDepth("/api/users/123", 0); name != "api/users/123" {
+		t.Errorf("error: expected all the segments at depth 0, got %q", name)
+	}
+}
+
+func TestHandler(t *testing.T) {
+
+	reporter, err := NewTestReporter("test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	reporter.AddMetric(NewReqPerEndpoint())
+	reporter.AddMetric(NewErrorRatePerEndpoint())
+	reporter.AddMetric(NewReqPerContentType())
+
+	// collapse the user ids
+	reporter.SetEndpointNamer(func(r *http.Request) string {
+		if strings.HasPrefix(r.URL.Path, "/users/") {
+			return "users/:id"
+		}
+		return PathEndpointNamer(r)
+	})
+
+	handler := reporter.Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/users/404" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		w.Write([]byte("ok"))
+	}))
+
+	for _, path := range []string{"/users/123", "/users/456", "/users/404", "/log"} {
+		serve(handler, "GET", path)
+	}
+	reporter.Flush()
+
+	values := reporter.LastValues()
+	expected := map[string]float32{
+		"Component/ReqPerEndpoint/users/:id[requests]": 3,
+		"Component/ReqPerEndpoint/log[requests]":       1,
+		"Component/ErrorCount/users/:id[errors]":       1,
+		"Component/ErrorCount/log[errors]":             0,
+		"Component/ContentType/text/plain[requests]":   3,
+		"Component/ContentType/other[requests]":        1,
+	}
+	for name, value := range expected {
+		if values[name] != value {
+			t.Errorf("error: expected %s to be %f, got %f", name, value, values[name])
+		}
+	}
+}
+
+func TestHandlerConnectionID(t *testing.T) {
+
+	reporter, err := NewTestReporter("test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	reporter.AddMetric(NewReqPerConnection())
+	handler := reporter.Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+	// two connections, the first one reused for three requests
+	first := ConnContext(context.Background(), nil)
+	second := ConnContext(context.Background(), nil)
+	for _, ctx := range []context.Context{first, first, first, second} {
+		req, _ := http.NewRequest("GET", "/log", nil)
+		handler.ServeHTTP(httptest.NewRecorder(), req.WithContext(ctx))
+	}
+	reporter.Flush()
+
+	if value := reporter.LastValues()["Component/ReqPerConnection/overall[requests/connection]"]; value != 2 {
+		t.Errorf("error: expected 2 requests per connection, got %f", value)
+	}
+}
@@ -0,0 +1,347 @@
+package simplerelic
+
+import (
+	"errors"
+	"math"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// PercentileBackend selects how the percentiles are calculated
+type PercentileBackend int
+
+const (
+	// PercentileExact stores all the response times of the interval and sorts them,
+	// exact but the memory grows with the number of requests
+	PercentileExact PercentileBackend = iota
+
+	// PercentileStreaming estimates the percentiles with the P² algorithm
+	// in constant memory per endpoint regardless of the throughput
+	PercentileStreaming
+)
+
+// defaultPercentiles are reported when no percentiles are specified
+var defaultPercentiles = []float64{50, 95, 99}
+
+// ResponseTimePercentilePerEndpoint tracks percentiles of the response time per endpoint,
+// e.g. Component/ResponseTimeP95PerEndpoint/log[ms]
+type ResponseTimePercentilePerEndpoint struct {
+	*StandardMetric
+	backend     PercentileBackend
+	percentiles []float64
+
+	quantiles        map[string]quantiles
+	overallQuantiles quantiles
+}
+
+// NewResponseTimePercentilePerEndpoint creates new ResponseTimePercentilePerEndpoint metric
+// reporting the given percentiles (e.g. 50, 95, 99), by default the median, 95th and 99th
+func NewResponseTimePercentilePerEndpoint(backend PercentileBackend, percentiles ...float64) (*ResponseTimePercentilePerEndpoint, error) {
+
+	if backend != PercentileExact && backend != PercentileStreaming {
+		return nil, errors.New("Please specify PercentileExact or PercentileStreaming as backend")
+	}
+
+	if len(percentiles) == 0 {
+		percentiles = defaultPercentiles
+	}
+	for _, p := range percentiles {
+		if !(p > 0 && p < 100) {
+			return nil, errors.New("Please specify percentiles between 0 and 100")
+		}
+	}
+
+	metric := &ResponseTimePercentilePerEndpoint{
+		StandardMetric: &StandardMetric{
+			reqCount:   make(map[string]int),
+			metricUnit: "[ms]",
+		},
+		backend:     backend,
+		percentiles: append([]float64(nil), percentiles...),
+		quantiles:   make(map[string]quantiles),
+	}
+	metric.overallQuantiles = metric.newQuantiles()
+
+	return metric, nil
+}
+
+func (m *ResponseTimePercentilePerEndpoint) newQuantiles() quantiles {
+	if m.backend == PercentileStreaming {
+		return newStreamingQuantiles(m.percentiles)
+	}
+	return newExactQuantiles(m.percentiles)
+}
+
+// percentileName is the name of the percentile of the endpoint
+func (m *ResponseTimePercentilePerEndpoint) percentileName(p float64, endpoint string) string {
+	return "Component/ResponseTimeP" + strconv.FormatFloat(p, 'f', -1, 64) + "PerEndpoint/" + endpoint + m.metricUnit
+}
+
+// overallPercentileName is the name of the percentile of all the endpoints
+func (m *ResponseTimePercentilePerEndpoint) overallPercentileName(p float64) string {
+	return "Component/ResponseTimeP" + strconv.FormatFloat(p, 'f', -1, 64) + "/overall" + m.metricUnit
+}
+
+// Clear discards the response times recorded since the last report
+func (m *ResponseTimePercentilePerEndpoint) Clear() {
+	m.lock.Lock()
+	m.resetCounts()
+	m.quantiles = make(map[string]quantiles)
+	m.overallQuantiles = m.newQuantiles()
+	m.lock.Unlock()
+}
+
+// ClearEndpoint discards the response times of the endpoint,
+// they are still part of the overall percentiles of the interval
+func (m *ResponseTimePercentilePerEndpoint) ClearEndpoint(endpoint string) {
+	m.lock.Lock()
+	m.clearCounts(func(key string) bool { return key == endpoint })
+	delete(m.quantiles, endpoint)
+	m.lock.Unlock()
+}
+
+// Update the metric values
+func (m *ResponseTimePercentilePerEndpoint) Update(params map[string]interface{}) error {
+
+	elapsed, ok, err := m.responseTime(params)
+	if !ok {
+		return err
+	}
+
+	elaspsedTimeInMs := float64(elapsed) / float64(time.Millisecond)
+
+	endpointName, err := m.endpointName(params)
+	if err != nil {
+		return err
+	}
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	if m.isExcluded(endpointName) {
+		return nil
+	}
+
+	q, ok := m.quantiles[endpointName]
+	if !ok {
+		q = m.newQuantiles()
+		m.quantiles[endpointName] = q
+	}
+	q.add(elaspsedTimeInMs)
+	m.overallQuantiles.add(elaspsedTimeInMs)
+	m.countRequest(endpointName)
+
+	return nil
+}
+
+// ValueMap extract all the metrics to be reported
+func (m *ResponseTimePercentilePerEndpoint) ValueMap() map[string]float32 {
+	return m.freeze()()
+}
+
+// Peek returns the current values without clearing them
+func (m *ResponseTimePercentilePerEndpoint) Peek() map[string]float32 {
+	m.lock.Lock()
+	metrics, overall := m.values(m.quantiles, m.overallQuantiles)
+	m.lock.Unlock()
+
+	return m.emitted(metrics, overall)
+}
+
+// freeze takes the response times of the interval out of the metric, the returned
+// function computes the percentiles without blocking the updates
+func (m *ResponseTimePercentilePerEndpoint) freeze() func() map[string]float32 {
+	m.lock.Lock()
+	perEndpoint, overall := m.quantiles, m.overallQuantiles
+	m.resetCounts()
+	m.quantiles = make(map[string]quantiles)
+	m.overallQuantiles = m.newQuantiles()
+	m.lock.Unlock()
+
+	return func() map[string]float32 {
+		return m.emitted(m.values(perEndpoint, overall))
+	}
+}
+
+// values computes the percentiles, the percentiles and the unit never change
+// so the lock is only needed for the quantiles of the metric
+func (m *ResponseTimePercentilePerEndpoint) values(perEndpoint map[string]quantiles, overall quantiles) (map[string]float32, map[string]float32) {
+
+	metrics := make(map[string]float32)
+	for endpoint, q := range perEndpoint {
+		for i, value := range q.values() {
+			metrics[m.percentileName(m.percentiles[i], endpoint)] = float32(value)
+		}
+	}
+	overallMetrics := make(map[string]float32)
+	for i, value := range overall.values() {
+		overallMetrics[m.overallPercentileName(m.percentiles[i])] = float32(value)
+	}
+
+	return metrics, overallMetrics
+}
+
+// quantiles calculates a fixed set of quantiles over the added values
+type quantiles interface {
+	add(value float64)
+
+	// values returns the quantiles in the order they were requested, 0 without any values
+	values() []float64
+}
+
+// exactQuantiles keeps all the values and interpolates between the closest ranks
+type exactQuantiles struct {
+	percentiles []float64
+	samples     []float64
+}
+
+func newExactQuantiles(percentiles []float64) *exactQuantiles {
+	return &exactQuantiles{percentiles: percentiles}
+}
+
+func (q *exactQuantiles) add(value float64) {
+	q.samples = append(q.samples, value)
+}
+
+func (q *exactQuantiles) values() []float64 {
+	sorted := append([]float64(nil), q.samples...)
+	sort.Float64s(sorted)
+
+	values := make([]float64, len(q.percentiles))
+	for i, p := range q.percentiles {
+		values[i] = interpolate(sorted, p/100)
+	}
+	return values
+}
+
+// interpolate returns the quantile of the sorted values
+func interpolate(sorted []float64, quantile float64) float64 {
+	if len(sorted) == 0 {
+		return 0
+	}
+
+	pos := quantile * float64(len(sorted)-1)
+	lower := int(math.Floor(pos))
+	if lower+1 >= len(sorted) {
+		return sorted[len(sorted)-1]
+	}
+	return sorted[lower] + (pos-float64(lower))*(sorted[lower+1]-sorted[lower])
+}
+
+// streamingQuantiles estimates each quantile with its own P² estimator
+type streamingQuantiles []*p2Estimator
+
+func newStreamingQuantiles(percentiles []float64) streamingQuantiles {
+	q := make(streamingQuantiles, len(percentiles))
+	for i, p := range percentiles {
+		q[i] = newP2Estimator(p / 100)
+	}
+	return q
+}
+
+func (q streamingQuantiles) add(value float64) {
+	for _, estimator := range q {
+		estimator.add(value)
+	}
+}
+
+func (q streamingQuantiles) values() []float64 {
+	values := make([]float64, len(q))
+	for i, estimator := range q {
+		values[i] = estimator.value()
+	}
+	return values
+}
+
+// p2Estimator implements the P² algorithm of Jain and Chlamtac estimating
+// a quantile with five markers instead of storing the values
+type p2Estimator struct {
+	quantile float64
+	count    int
+
+	heights   [5]float64
+	positions [5]float64
+	desired   [5]float64
+	increment [5]float64
+}
+
+func newP2Estimator(quantile float64) *p2Estimator {
+	return &p2Estimator{
+		quantile:  quantile,
+		desired:   [5]float64{1, 1 + 2*quantile, 1 + 4*quantile, 3 + 2*quantile, 5},
+		increment: [5]float64{0, quantile / 2, quantile, (1 + quantile) / 2, 1},
+	}
+}
+
+func (e *p2Estimator) add(value float64) {
+
+	// the first five values are the initial markers
+	if e.count < 5 {
+		e.heights[e.count] = value
+		e.count++
+		if e.count == 5 {
+			sort.Float64s(e.heights[:])
+			for i := range e.positions {
+				e.positions[i] = float64(i + 1)
+			}
+		}
+		return
+	}
+	e.count++
+
+	// find the cell of the value, extending the extremes if needed
+	var k int
+	switch {
+	case value < e.heights[0]:
+		e.heights[0] = value
+		k = 0
+	case value >= e.heights[4]:
+		e.heights[4] = value
+		k = 3
+	default:
+		for k = 0; k < 3 && value >= e.heights[k+1]; k++ {
+		}
+	}
+
+	for i := k + 1; i < 5; i++ {
+		e.positions[i]++
+	}
+	for i := range e.desired {
+		e.desired[i] += e.increment[i]
+	}
+
+	// adjust the heights of the middle markers
+	for i := 1; i <= 3; i++ {
+		d := e.desired[i] - e.positions[i]
+		if (d >= 1 && e.positions[i+1]-e.positions[i] > 1) || (d <= -1 && e.positions[i-1]-e.positions[i] < -1) {
+			sign := math.Copysign(1, d)
+			height := e.parabolic(i, sign)
+			if e.heights[i-1] < height && height < e.heights[i+1] {
+				e.heights[i] = height
+			} else {
+				e.heights[i] = e.linear(i, sign)
+			}
+			e.positions[i] += sign
+		}
+	}
+}
+
+func (e *p2Estimator) parabolic(i int, d float64) float64 {
+	n, q := e.positions, e.heights
+	return q[i] + d/(n[i+1]-n[i-1])*((n[i]-n[i-1]+d)*(q[i+1]-q[i])/(n[i+1]-n[i])+(n[i+1]-n[i]-d)*(q[i]-q[i-1])/(n[i]-n[i-1]))
+}
+
+func (e *p2Estimator) linear(i int, d float64) float64 {
+	j := i + int(d)
+	return e.heights[i] + d*(e.heights[j]-e.heights[i])/(e.positions[j]-e.positions[i])
+}
+
+// value returns the estimate, exact while there are at most five values
+func (e *p2Estimator) value() float64 {
+	if e.count <= 5 {
+		sorted := append([]float64(nil), e.heights[:e.count]...)
+		sort.Float64s(sorted)
+		return interpolate(sorted, e.quantile)
+	}
+	return e.heights[2]
+}
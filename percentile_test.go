@@ -0,0 +1,109 @@
+package simplerelic
+
+import (
+	"math"
+	"math/rand"
+	"testing"
+	"time"
+)
+
+func TestPercentileInvalid(t *testing.T) {
+
+	if _, err := NewResponseTimePercentilePerEndpoint(PercentileExact, 0); err == nil {
+		t.Error("error: expected error for percentile 0")
+	}
+	if _, err := NewResponseTimePercentilePerEndpoint(PercentileExact, 100); err == nil {
+		t.Error("error: expected error for percentile 100")
+	}
+	if _, err := NewResponseTimePercentilePerEndpoint(PercentileBackend(5)); err == nil {
+		t.Error("error: expected error for unknown backend")
+	}
+}
+
+func TestPercentileExact(t *testing.T) {
+
+	q := newExactQuantiles([]float64{50, 90})
+	for i := 1; i <= 11; i++ {
+		q.add(float64(i))
+	}
+
+	values := q.values()
+	if values[0] != 6 || values[1] != 10 {
+		t.Errorf("error: expected [6 10], got %v", values)
+	}
+
+	if values := newExactQuantiles([]float64{50}).values(); values[0] != 0 {
+		t.Errorf("error: expected 0 without values, got %f", values[0])
+	}
+}
+
+func TestPercentileStreaming(t *testing.T) {
+
+	percentiles := []float64{50, 95, 99}
+	random := rand.New(rand.NewSource(1))
+
+	distributions := map[string]func() float64{
+		"uniform":     func() float64 { return random.Float64() * 100 },
+		"exponential": func() float64 { return random.ExpFloat64() * 20 },
+		"normal":      func() float64 { return 100 + random.NormFloat64()*10 },
+	}
+
+	for name, next := range distributions {
+		exact := newExactQuantiles(percentiles)
+		streaming := newStreamingQuantiles(percentiles)
+		for i := 0; i < 10000; i++ {
+			value := next()
+			exact.add(value)
+			streaming.add(value)
+		}
+
+		expected, estimated := exact.values(), streaming.values()
+		for i, p := range percentiles {
+			// within 5% of the exact value
+			if math.Abs(estimated[i]-expected[i]) > 0.05*expected[i] {
+				t.Errorf("error: %s p%v expected about %f, got %f", name, p, expected[i], estimated[i])
+			}
+		}
+	}
+}
+
+func TestPercentileStreamingFewValues(t *testing.T) {
+
+	streaming := newStreamingQuantiles([]float64{50})
+	for _, value := range []float64{3, 1, 2} {
+		streaming.add(value)
+	}
+
+	if values := streaming.values(); values[0] != 2 {
+		t.Errorf("error: expected %f, got %f", 2., values[0])
+	}
+}
+
+func TestPercentileMetric(t *testing.T) {
+
+	for _, backend := range []PercentileBackend{PercentileExact, PercentileStreaming} {
+		m, err := NewResponseTimePercentilePerEndpoint(backend, 50, 99.9)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		m.Update(map[string]interface{}{"endpointName": endpointName, "reqStartTime": time.Now().Add(-100 * time.Millisecond)})
+
+		values := m.ValueMap()
+		for _, name := range []string{
+			"Component/ResponseTimeP50PerEndpoint/log[ms]",
+			"Component/ResponseTimeP99.9PerEndpoint/log[ms]",
+			"Component/ResponseTimeP50/overall[ms]",
+			"Component/ResponseTimeP99.9/overall[ms]",
+		} {
+			if value, ok := values[name]; !ok || value < 100 || value > 150 {
+				t.Errorf("error: expected %s to be about %f, got %f", name, 100., value)
+			}
+		}
+
+		// the values are reset after the report
+		if value := m.ValueMap()["Component/ResponseTimeP50/overall[ms]"]; value != 0 {
+			t.Errorf("error: expected %f, got %f", 0., value)
+		}
+	}
+}
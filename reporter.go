@@ -2,166 +2,1735 @@ package simplerelic
 
 import (
 	"bytes"
+	"compress/gzip"
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"hash/fnv"
+	"io"
 	"io/ioutil"
 	"log"
+	"math"
+	"math/rand"
 	"net/http"
 	"os"
+	"reflect"
+	"runtime/debug"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
+	"unicode"
 )
 
 const (
 	// url of the NewRelic plugin API
 	newrelicURL = "https://platform-api.newrelic.com/platform/v1/metrics"
 
+	// header used to authenticate with the licence
+	defaultAuthHeader = "X-License-Key"
+
+	// version of the plugin reported in the agent and the user agent
+	pluginVersion = "1.0.0"
+
+	// host reported when the hostname can not be determined
+	unknownHost = "unknown-host"
+
+	// pid reported when the pid can not be determined
+	unknownPid = 1
+
 	// default GUID that associate the metrics with a NewRelic plugin
 	defaultGUID = "com.github.domenp.SimpleRelic"
 
-	// how often we send the metrics to NewRelic
-	reportingFreq = time.Duration(60) * time.Second
+	// how often we send the metrics to NewRelic
+	reportingFreq = time.Duration(60) * time.Second
+
+	// the reporter stops after the licence key is rejected this many times in a row
+	maxAuthFailures = 3
+
+	// failed updates are logged at most once per interval, they fail on every request
+	updateErrorLogInterval = time.Minute
+
+	// payloads of partly sent reports kept to be sent again, beyond it the oldest are dropped
+	maxUnsent = 10
+)
+
+// Environment variables read by NewReporter when the licence or the app name is empty
+const (
+	EnvLicenceKey = "NEWRELIC_LICENSE_KEY"
+	EnvAppName    = "NEWRELIC_APP_NAME"
+)
+
+var (
+	// Log is a logger used in the package
+	Log *log.Logger
+
+	// NewRelic GUID for creating the NewRelic plugin
+	Guid string
+
+	httpClient = &http.Client{Timeout: 10 * time.Second, Transport: newTransport()}
+
+	// replaceable in tests
+	hostname = os.Hostname
+	getpid   = os.Getpid
+
+	// clock of the request start, the response times and the duration
+	// of the reports, replaceable in tests
+	nowFunc = time.Now
+
+	// delay before restarting the crashed reporting loop, doubled up to
+	// the max on every crash in a row, replaceable in tests
+	restartBackoff    = time.Second
+	maxRestartBackoff = time.Minute
+)
+
+// newTransport keeps the connection to NewRelic open between the reporting
+// cycles instead of opening a new one every minute
+func newTransport() *http.Transport {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.MaxIdleConns = 10
+	transport.MaxIdleConnsPerHost = 2
+	transport.IdleConnTimeout = 2 * reportingFreq
+	transport.ForceAttemptHTTP2 = true
+	return transport
+}
+
+func init() {
+	Guid = defaultGUID
+	Log = log.New(os.Stderr, "[simplerelic] ", log.Ldate|log.Ltime|log.Lshortfile)
+}
+
+// Sink is a destination the collected metrics are sent to
+type Sink interface {
+
+	// Send the marshaled NewRelic payload
+	Send(payload []byte) error
+}
+
+// DisabledMode selects what a reporter paused by SetEnabled does
+type DisabledMode int
+
+const (
+	// DisabledDiscard keeps updating the metrics and discards their values
+	// in every reporting cycle, so that the memory stays bounded
+	DisabledDiscard DisabledMode = iota
+
+	// DisabledSkip skips the reporting cycles and the updates of the
+	// metrics, which become a cheap no-op
+	DisabledSkip
+)
+
+// newRelicSink sends the payload to NewRelic plugin API
+type newRelicSink struct {
+	reporter *Reporter
+
+	// empty licence authenticates with the reporter's own licence
+	licence string
+}
+
+// Send the payload to NewRelic
+func (sink *newRelicSink) Send(payload []byte) error {
+	return sink.reporter.doRequest(payload, sink.licence)
+}
+
+// Reporter keeps track of the app metrics and sends them to NewRelic.
+// Its setters are safe to call at any time, also after Start,
+// while the exported fields must be set before calling Start.
+type Reporter struct {
+
+	// Metrics are the registered metrics. The slice is replaced, never
+	// modified in place, and must be changed only with AddMetric,
+	// RemoveMetric and ReplaceMetric.
+	Metrics     []AppMetric
+	metricsLock sync.RWMutex
+
+	// held by the updates and exclusively while the metrics are extracted,
+	// so that all of them cover the same requests
+	updateLock sync.RWMutex
+
+	// when set, it is called with the time every extraction held back
+	// the updates and the time it took, e.g. for the benchmarks
+	observeExtract func(held time.Duration, total time.Duration)
+
+	// Compress enables gzip compression of the payload sent to NewRelic
+	Compress bool
+
+	// DryRun collects the metrics (and logs them in verbose mode)
+	// as usual, but never sends them
+	DryRun bool
+
+	url     string
+	host    string
+	pid     int
+	guid    string
+	version string
+	appName string
+	licence string
+	verbose bool
+
+	authHeader string
+	authValue  string
+
+	// User-Agent header of the requests to NewRelic
+	userAgent string
+
+	// appended to the component name to tell e.g. staging and prod apart
+	environment string
+
+	// every collected payload is sent to all the sinks
+	sinks []Sink
+
+	lock    sync.Mutex
+	started bool
+	stopped bool
+	quit    chan struct{}
+
+	// closed by the reporting loop once it exited
+	done chan struct{}
+
+	// closed once no report is sent any more, after the final flush of StartContext
+	flushed chan struct{}
+
+	// cancelled on Stop to abort an in-flight request
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	breaker *circuitBreaker
+
+	// number of reports in a row rejected as unauthorized
+	authFailures int
+
+	// names the endpoints of requests handled by the middleware
+	endpointNamer EndpointNamer
+
+	// metrics are split into several requests above this count, 0 is no limit
+	maxMetricsPerRequest int
+
+	// fraction of the reporting interval the intervals vary by, 0 is none
+	jitter float64
+	random func() float64
+
+	// the reports are aligned to the multiples of it on the wall clock, 0 is none
+	alignment time.Duration
+
+	client *http.Client
+
+	// when set, the values are rounded to precision decimal places
+	round     bool
+	precision int
+
+	// renames the reported metrics, nil keeps the names
+	mapName func(name string) string
+
+	// flush early once the metrics buffer this many requests, 0 disables it.
+	// Read on every request so it is accessed atomically instead of taking the lock.
+	flushThreshold int64
+	flush          chan struct{}
+
+	// reporting is paused by SetEnabled, see DisabledMode
+	disabled     bool
+	disabledMode DisabledMode
+
+	// set while the updates are skipped, read on every request
+	// so it is accessed atomically instead of taking the lock
+	skipUpdates int32
+
+	// a test reporter records the values instead of sending them
+	record     bool
+	lastValues map[string]float32
+
+	// time of the last report delivered or spooled, also partly, or of the
+	// last Collect, the next report covers the metrics collected since then
+	lastReport time.Time
+
+	// error of the last report, nil after a successful one
+	lastErr error
+
+	// payloads which failed to be sent, nil when disabled
+	spool *spool
+
+	// payloads of partly sent reports which failed to be sent and weren't
+	// spooled, sent again after the next successful report, at most maxUnsent
+	unsent [][]byte
+
+	// names reported by more than one metric which were logged already
+	collisions map[string]bool
+
+	// when the failed updates were logged last (in unix nanoseconds) and how
+	// many were not logged since, accessed atomically as they fail on every request
+	updateErrorLogged      int64
+	suppressedUpdateErrors int64
+
+	// build metadata set by SetBuildInfo, logged on start and reported as buildID
+	buildInfo map[string]string
+	buildID   float32
+
+	// duration of the last request to NewRelic, reported in the next cycle
+	sendLatency    time.Duration
+	hasSendLatency bool
+}
+
+type newRelicData struct {
+	Agent      *newRelicAgent       `json:"agent"`
+	Components []*newRelicComponent `json:"components"`
+}
+
+type newRelicAgent struct {
+	Host    string `json:"host"`
+	Pid     int    `json:"pid"`
+	Version string `json:"version"`
+}
+
+type newRelicComponent struct {
+	Name     string                 `json:"name"`
+	Guid     string                 `json:"guid"`
+	Duration int                    `json:"duration"`
+	Metrics  map[string]interface{} `json:"metrics"`
+}
+
+// NewReporter creates a new Reporter. An empty licence or app name is read
+// from the NEWRELIC_LICENSE_KEY and NEWRELIC_APP_NAME environment variables,
+// so the licence doesn't have to be passed around in the code.
+func NewReporter(appName string, licence string, verbose bool) (*Reporter, error) {
+
+	host, err := hostname()
+	if err == nil && strings.TrimSpace(host) == "" {
+		err = errors.New("empty hostname")
+	}
+	if err != nil {
+		// e.g. a pod name exposed with the downward API in kubernetes
+		host = os.Getenv("POD_NAME")
+		if host == "" {
+			// set on Windows
+			host = os.Getenv("COMPUTERNAME")
+		}
+		if host == "" {
+			host = unknownHost
+		}
+		Log.Printf("Can not get hostname (%v), using %s instead", err, host)
+	}
+
+	pid := getpid()
+	if pid <= 0 {
+		Log.Printf("Can not get pid (got %d), using %d instead, see SetPID", pid, unknownPid)
+		pid = unknownPid
+	}
+
+	if licence == "" {
+		licence = os.Getenv(EnvLicenceKey)
+	}
+	if licence == "" {
+		return nil, errors.New("Please specify Newrelic licence")
+	}
+
+	if strings.TrimSpace(appName) == "" {
+		appName = os.Getenv(EnvAppName)
+	}
+	appName, err = normalizeAppName(appName)
+	if err != nil {
+		return nil, err
+	}
+
+	reporter := &Reporter{
+		url:        newrelicURL,
+		host:       host,
+		pid:        pid,
+		guid:       Guid,
+		lastReport: nowFunc(),
+		collisions: make(map[string]bool),
+		appName:    appName,
+		licence:    licence,
+		authHeader: defaultAuthHeader,
+		authValue:  licence,
+		version:    pluginVersion,
+		userAgent:  "simplerelic/" + pluginVersion,
+		verbose:    verbose,
+		Metrics:    make([]AppMetric, 0, 5),
+	}
+	reporter.sinks = []Sink{&newRelicSink{reporter: reporter}}
+	reporter.flush = make(chan struct{}, 1)
+	reporter.breaker = newCircuitBreaker()
+	reporter.client = httpClient
+	reporter.random = rand.Float64
+	reporter.endpointNamer = PathEndpointNamer
+	reporter.ctx, reporter.cancel = context.WithCancel(context.Background())
+
+	return reporter, nil
+}
+
+// normalizeAppName trims the app name and checks it can be used
+// as a NewRelic component name
+func normalizeAppName(appName string) (string, error) {
+	appName = strings.TrimSpace(appName)
+	if appName == "" {
+		return "", errors.New("Please specify app name")
+	}
+
+	for _, r := range appName {
+		if unicode.IsControl(r) {
+			return "", fmt.Errorf("App name %q contains invalid characters", appName)
+		}
+	}
+
+	return appName, nil
+}
+
+// Start sending metrics to NewRelic in the background until Stop is called.
+// Calling Start on an already started or a stopped reporter has no effect
+// but logging the error.
+func (reporter *Reporter) Start() {
+
+	quit, done, flushed, err := reporter.start()
+	if err != nil {
+		Log.Println(err)
+		return
+	}
+
+	go func() {
+		reporter.loop(quit, done)
+		close(flushed)
+	}()
+}
+
+// StartContext sends metrics to NewRelic until the ctx is cancelled or Stop
+// is called. It blocks, so it fits e.g. errgroup or the server shutdown.
+// When the ctx is cancelled the metrics collected so far are sent
+// before it returns. It fails when the reporter was started or stopped before.
+func (reporter *Reporter) StartContext(ctx context.Context) error {
+
+	quit, done, flushed, err := reporter.start()
+	if err != nil {
+		return err
+	}
+	defer close(flushed)
+
+	go reporter.loop(quit, done)
+
+	select {
+	case <-ctx.Done():
+	case <-done:
+		return nil
+	}
+
+	// stop the loop but keep the requests going for the final flush
+	reporter.lock.Lock()
+	final := !reporter.stopped
+	if final {
+		reporter.stopped = true
+		close(quit)
+	}
+	reporter.lock.Unlock()
+
+	<-done
+	if final {
+		reporter.sendMetrics()
+		reporter.cancel()
+	}
+
+	return nil
+}
+
+// start marks the reporter as started, it fails if it was started or stopped before
+func (reporter *Reporter) start() (quit chan struct{}, done chan struct{}, flushed chan struct{}, err error) {
+
+	reporter.lock.Lock()
+	defer reporter.lock.Unlock()
+
+	if reporter.started {
+		return nil, nil, nil, errors.New("SimpleRelic reporter already started")
+	}
+	if reporter.stopped {
+		// the requests of a stopped reporter are cancelled
+		return nil, nil, nil, errors.New("SimpleRelic reporter was stopped, it can't be started again")
+	}
+	reporter.started = true
+
+	quit, done, flushed = make(chan struct{}), make(chan struct{}), make(chan struct{})
+	reporter.quit, reporter.done, reporter.flushed = quit, done, flushed
+
+	if reporter.buildInfo != nil {
+		Log.Printf("SimpleRelic reporter started for build %s", formatBuildInfo(reporter.buildInfo))
+	}
+
+	return quit, done, flushed, nil
+}
+
+// loop runs the reporting loop until quit is closed, restarting it with
+// a backoff when it crashes. It closes done once it exited.
+func (reporter *Reporter) loop(quit chan struct{}, done chan struct{}) {
+
+	defer close(done)
+
+	// the spool is retried alongside, done waits for it as well
+	retried := make(chan struct{})
+	go reporter.retrySpool(quit, retried)
+	defer func() { <-retried }()
+
+	ticker := time.NewTicker(reporter.firstInterval())
+	defer ticker.Stop()
+
+	backoff := restartBackoff
+	for {
+		started := time.Now()
+		if reporter.run(ticker, quit) {
+			return
+		}
+
+		// a loop that ran for a while crashed on something transient
+		if time.Since(started) > maxRestartBackoff {
+			backoff = restartBackoff
+		}
+
+		Log.Printf("Restarting SimpleRelic reporter in %v", backoff)
+		select {
+		case <-time.After(backoff):
+		case <-quit:
+			return
+		}
+
+		backoff *= 2
+		if backoff > maxRestartBackoff {
+			backoff = maxRestartBackoff
+		}
+	}
+}
+
+// run is the reporting loop, it returns true when the reporter is stopped
+// and false when the loop crashed and should be restarted
+func (reporter *Reporter) run(ticker *time.Ticker, quit chan struct{}) (stopped bool) {
+
+	defer func() {
+		if r := recover(); r != nil {
+			Log.Printf("SimpleRelic reporter crashed: %v\n%s", r, debug.Stack())
+			stopped = false
+		}
+	}()
+
+	for {
+		select {
+		case <-ticker.C:
+			reporter.sendMetrics()
+			ticker.Reset(reporter.nextInterval())
+		case <-reporter.flush:
+			reporter.sendMetrics()
+			ticker.Reset(reporter.nextInterval())
+		case <-quit:
+			return true
+		}
+	}
+}
+
+// SetBuildInfo attaches build metadata, e.g. the git SHA and the build time,
+// to correlate the metrics with the deploys. The plugin API has no place for
+// text, so the metadata is logged when the reporter starts and reported as
+// Component/Build/Deployed[id], a number derived from all the keys and values.
+// The number has no meaning by itself, but it changes with the metadata
+// so that a step in its chart marks a deploy.
+func (reporter *Reporter) SetBuildInfo(info map[string]string) error {
+	if len(info) == 0 {
+		return errors.New("Please specify build info")
+	}
+
+	buildInfo := make(map[string]string, len(info))
+	for key, value := range info {
+		buildInfo[key] = value
+	}
+
+	reporter.lock.Lock()
+	reporter.buildInfo = buildInfo
+	reporter.buildID = buildID(buildInfo)
+	started := reporter.started
+	reporter.lock.Unlock()
+
+	if started {
+		Log.Printf("SimpleRelic reporter reporting build %s", formatBuildInfo(buildInfo))
+	}
+	return nil
+}
+
+// formatBuildInfo lists the build metadata sorted by the keys, e.g. "sha=a1b2, time=2020-01-01"
+func formatBuildInfo(info map[string]string) string {
+	pairs := make([]string, 0, len(info))
+	for key, value := range info {
+		pairs = append(pairs, key+"="+value)
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, ", ")
+}
+
+// buildID hashes the build metadata into a number float32 represents exactly
+func buildID(info map[string]string) float32 {
+	h := fnv.New32a()
+	h.Write([]byte(formatBuildInfo(info)))
+	return float32(h.Sum32() & (1<<24 - 1))
+}
+
+// SetJitter varies every reporting interval, also the first one, randomly
+// by up to the fraction of it, e.g. 0.1 reports every 54 to 66 seconds.
+// It spreads the reports of a large fleet started at the same time.
+// Jitter 0 (default) reports exactly every 60 seconds.
+func (reporter *Reporter) SetJitter(fraction float64) error {
+	if fraction < 0 || fraction >= 1 {
+		return errors.New("Please specify jitter between 0 and 1")
+	}
+
+	reporter.lock.Lock()
+	reporter.jitter = fraction
+	reporter.lock.Unlock()
+
+	return nil
+}
+
+// interval returns the time until the next report
+func (reporter *Reporter) interval() time.Duration {
+	reporter.lock.Lock()
+	defer reporter.lock.Unlock()
+
+	if reporter.jitter == 0 {
+		return reportingFreq
+	}
+	return time.Duration(float64(reportingFreq) * (1 + reporter.jitter*(2*reporter.random()-1)))
+}
+
+// SetAlignment aligns the reports to the multiples of the boundary on the
+// wall clock, e.g. time.Minute sends them at :00 seconds, so that the charts
+// of a fleet line up. The first report is sent at the next boundary after
+// Start, the later ones at the boundary closest to the reporting interval,
+// which is varied by the jitter if set. Boundary 0 (default) disables it.
+func (reporter *Reporter) SetAlignment(boundary time.Duration) error {
+	if boundary < 0 {
+		return errors.New("Please specify a positive alignment boundary")
+	}
+
+	reporter.lock.Lock()
+	reporter.alignment = boundary
+	reporter.lock.Unlock()
+
+	return nil
+}
+
+func (reporter *Reporter) getAlignment() time.Duration {
+	reporter.lock.Lock()
+	defer reporter.lock.Unlock()
+	return reporter.alignment
+}
+
+// firstInterval returns the time until the first report
+func (reporter *Reporter) firstInterval() time.Duration {
+	alignment := reporter.getAlignment()
+	if alignment == 0 {
+		return reporter.interval()
+	}
+
+	now := nowFunc()
+	return now.Truncate(alignment).Add(alignment).Sub(now)
+}
+
+// nextInterval returns the time until the next report, aligned when set
+func (reporter *Reporter) nextInterval() time.Duration {
+	interval := reporter.interval()
+	alignment := reporter.getAlignment()
+	if alignment == 0 {
+		return interval
+	}
+
+	// the closest boundary also absorbs the time the report took
+	now := nowFunc()
+	next := now.Add(interval).Round(alignment)
+	if !next.After(now) {
+		next = next.Add(alignment)
+	}
+	return next.Sub(now)
+}
+
+// SetVerbose enables or disables logging of the sent payloads
+func (reporter *Reporter) SetVerbose(verbose bool) {
+	reporter.lock.Lock()
+	reporter.verbose = verbose
+	reporter.lock.Unlock()
+}
+
+func (reporter *Reporter) isVerbose() bool {
+	reporter.lock.Lock()
+	defer reporter.lock.Unlock()
+	return reporter.verbose
+}
+
+// SetEnvironment reports the metrics as a separate NewRelic component
+// named after the app and the environment, e.g. "myapp (staging)"
+func (reporter *Reporter) SetEnvironment(env string) error {
+	env = strings.TrimSpace(env)
+	if env == "" {
+		return errors.New("Please specify environment")
+	}
+
+	reporter.lock.Lock()
+	reporter.environment = env
+	reporter.lock.Unlock()
+
+	return nil
+}
+
+// componentName is the name the metrics are reported under,
+// the lock must be held
+func (reporter *Reporter) componentName() string {
+	if reporter.environment == "" {
+		return reporter.appName
+	}
+	return reporter.appName + " (" + reporter.environment + ")"
+}
+
+// SetHost overrides the host reported to NewRelic with a meaningful and stable
+// identifier, e.g. the kubernetes node or pod. IPv6 addresses may be given
+// in brackets, they are reported without them.
+func (reporter *Reporter) SetHost(host string) error {
+	host = strings.TrimSpace(host)
+	if strings.HasPrefix(host, "[") && strings.HasSuffix(host, "]") {
+		host = strings.TrimSpace(host[1 : len(host)-1])
+	}
+	if host == "" {
+		return errors.New("Please specify host")
+	}
+
+	reporter.lock.Lock()
+	reporter.host = host
+	reporter.lock.Unlock()
+
+	return nil
+}
+
+// SetPID overrides the pid reported to NewRelic, e.g. to keep the identity of
+// the agent stable across restarts or when the pid of a container is meaningless
+func (reporter *Reporter) SetPID(pid int) error {
+	if pid <= 0 {
+		return errors.New("Please specify positive pid")
+	}
+
+	reporter.lock.Lock()
+	reporter.pid = pid
+	reporter.lock.Unlock()
+
+	return nil
+}
+
+// AddSink adds another destination the metrics are sent to.
+// The metrics are collected once per reporting cycle and the same
+// payload is sent to every sink.
+func (reporter *Reporter) AddSink(sink Sink) {
+	reporter.lock.Lock()
+	reporter.sinks = append(reporter.sinks, sink)
+	reporter.lock.Unlock()
+}
+
+// AddLicence reports the metrics also to the NewRelic account
+// with the given licence
+func (reporter *Reporter) AddLicence(licence string) error {
+	if licence == "" {
+		return errors.New("Please specify Newrelic licence")
+	}
+
+	reporter.AddSink(&newRelicSink{reporter: reporter, licence: licence})
+	return nil
+}
+
+// SetAuthHeader overrides the header used to authenticate with NewRelic,
+// by default the licence is sent in the X-License-Key header
+func (reporter *Reporter) SetAuthHeader(name string, value string) error {
+	if name == "" || value == "" {
+		return errors.New("Please specify both auth header name and value")
+	}
+
+	reporter.lock.Lock()
+	reporter.authHeader = name
+	reporter.authValue = value
+	reporter.lock.Unlock()
+
+	return nil
+}
+
+// SetUserAgent overrides the User-Agent header of the requests to NewRelic,
+// by default simplerelic/<version>
+func (reporter *Reporter) SetUserAgent(userAgent string) error {
+	userAgent = strings.TrimSpace(userAgent)
+	if userAgent == "" {
+		return errors.New("Please specify user agent")
+	}
+
+	reporter.lock.Lock()
+	reporter.userAgent = userAgent
+	reporter.lock.Unlock()
+
+	return nil
+}
+
+// SetCircuitBreaker stops sending to NewRelic for the cooldown after
+// threshold consecutive failed sends. The metrics collected meanwhile are
+// dropped. After the cooldown a single send tests whether NewRelic
+// recovered. Threshold 0 (default) disables the breaker.
+func (reporter *Reporter) SetCircuitBreaker(threshold int, cooldown time.Duration) {
+	reporter.breaker.configure(threshold, cooldown)
+}
+
+// BreakerState returns the state of the circuit breaker
+func (reporter *Reporter) BreakerState() BreakerState {
+	return reporter.breaker.State()
+}
+
+// SetHTTPClient sets the client used for the requests to NewRelic, e.g. with
+// a transport tuned for the fleet. The default client keeps the connection
+// alive between the reporting cycles, a custom one should have an
+// IdleConnTimeout longer than the reporting interval of 60s to do the same.
+func (reporter *Reporter) SetHTTPClient(client *http.Client) error {
+	if client == nil {
+		return errors.New("Please specify http client")
+	}
+
+	reporter.lock.Lock()
+	reporter.client = client
+	reporter.lock.Unlock()
+
+	return nil
+}
+
+// SetMaxMetricsPerRequest limits the number of metrics sent in a single
+// request to NewRelic. Above the limit the metrics are split into several
+// requests sent one after another, the first one including the overall
+// metrics. Zero (default) means no limit.
+func (reporter *Reporter) SetMaxMetricsPerRequest(max int) {
+	reporter.lock.Lock()
+	reporter.maxMetricsPerRequest = max
+	reporter.lock.Unlock()
+}
+
+// SetPrecision rounds the reported values to the number of decimal places,
+// e.g. 0.25000001 is reported as 0.25 with precision 3. A negative precision
+// (default) disables rounding. Summaries are reported as they are.
+func (reporter *Reporter) SetPrecision(decimals int) {
+	reporter.lock.Lock()
+	reporter.round = decimals >= 0
+	reporter.precision = decimals
+	reporter.lock.Unlock()
+}
+
+// SetMetricNameMapper renames the reported metrics, e.g. to keep the names
+// the dashboards were built for after a metric was renamed. The metric is
+// dropped when the mapper returns "", values mapped to the same name are summed.
+// A nil mapper (default) reports the names as they are.
+func (reporter *Reporter) SetMetricNameMapper(mapper func(name string) string) {
+	reporter.lock.Lock()
+	reporter.mapName = mapper
+	reporter.lock.Unlock()
+}
+
+// nameMapper returns the mapper of the names, nil when not set
+func (reporter *Reporter) nameMapper() func(name string) string {
+	reporter.lock.Lock()
+	defer reporter.lock.Unlock()
+
+	return reporter.mapName
+}
+
+// rounder returns the function rounding the values to the configured precision
+func (reporter *Reporter) rounder() func(value float32) float32 {
+	reporter.lock.Lock()
+	defer reporter.lock.Unlock()
+
+	if !reporter.round {
+		return func(value float32) float32 { return value }
+	}
+
+	scale := math.Pow(10, float64(reporter.precision))
+	return func(value float32) float32 {
+		return float32(math.Round(float64(value)*scale) / scale)
+	}
+}
+
+// SetFlushThreshold makes the reporter send the metrics before the next
+// reporting cycle once any metric implementing BufferedMetric buffers
+// more than threshold requests. Threshold 0 (default) disables it.
+func (reporter *Reporter) SetFlushThreshold(threshold int) {
+	atomic.StoreInt64(&reporter.flushThreshold, int64(threshold))
+}
+
+// checkFlushThreshold signals the reporting loop to flush
+// when the buffered requests exceed the threshold
+func (reporter *Reporter) checkFlushThreshold() {
+	threshold := int(atomic.LoadInt64(&reporter.flushThreshold))
+	if threshold <= 0 {
+		return
+	}
+
+	var count int
+	for _, metric := range reporter.metrics() {
+		if bufferedMetric, ok := metric.(BufferedMetric); ok {
+			if buffered := bufferedMetric.BufferedCount(); buffered > count {
+				count = buffered
+			}
+		}
+	}
+
+	if count > threshold {
+		select {
+		case reporter.flush <- struct{}{}:
+		default:
+			// flush already pending
+		}
+	}
+}
+
+// NewTestReporter creates a Reporter for unit tests that never sends
+// anything to NewRelic. Instead the values collected by the last Flush
+// are recorded and can be inspected with LastValues.
+func NewTestReporter(appName string) (*Reporter, error) {
+
+	reporter, err := NewReporter(appName, "test", false)
+	if err != nil {
+		return nil, err
+	}
+	reporter.record = true
+	reporter.lastValues = make(map[string]float32)
+
+	return reporter, nil
+}
+
+// Flush collects all metrics and sends them right away
+// without waiting for the next reporting cycle. The error tells why
+// the metrics were not sent, see RequestError for the failed requests.
+func (reporter *Reporter) Flush() error {
+	return reporter.sendMetrics()
+}
+
+// Validate checks that NewRelic accepts the licences by sending a payload
+// without any metrics, e.g. to fail fast on startup. It adds a request to
+// NewRelic per licence to the startup, so it is not done by NewReporter.
+// The error is a RequestError, ErrUnauthorized when a licence is rejected.
+// The other sinks are not validated.
+func (reporter *Reporter) Validate() error {
+	b, err := json.Marshal(reporter.prepareReqData())
+	if err != nil {
+		return err
+	}
+
+	reporter.lock.Lock()
+	sinks := append([]Sink(nil), reporter.sinks...)
+	reporter.lock.Unlock()
+
+	for _, sink := range sinks {
+		if sink, ok := sink.(*newRelicSink); ok {
+			if err := sink.Send(b); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// SetEnabled pauses (false) or resumes (true, the default) the reporting
+// at runtime, e.g. behind a feature flag. The reporting loop keeps running,
+// what happens meanwhile is set by SetDisabledMode. Once resumed the values
+// collected while paused are discarded and the next report covers the time
+// since resuming.
+func (reporter *Reporter) SetEnabled(enabled bool) {
+	reporter.lock.Lock()
+	resumed := enabled && reporter.disabled
+	reporter.lock.Unlock()
+
+	if resumed {
+		reporter.clearMetrics()
+	}
+
+	reporter.lock.Lock()
+	if resumed {
+		reporter.lastReport = nowFunc()
+	}
+	reporter.disabled = !enabled
+	reporter.setSkipUpdates()
+	reporter.lock.Unlock()
+}
+
+// SetDisabledMode sets what the reporter does while paused by SetEnabled,
+// DisabledDiscard by default
+func (reporter *Reporter) SetDisabledMode(mode DisabledMode) error {
+	if mode != DisabledDiscard && mode != DisabledSkip {
+		return errors.New("Please specify DisabledDiscard or DisabledSkip as disabled mode")
+	}
 
-	// for debugging purposes sending metrics can be disabled
-	sendMetrics = true
-)
+	reporter.lock.Lock()
+	reporter.disabledMode = mode
+	reporter.setSkipUpdates()
+	reporter.lock.Unlock()
+	return nil
+}
 
-var (
-	// Log is a logger used in the package
-	Log *log.Logger
+// setSkipUpdates turns the updates off while paused in DisabledSkip mode,
+// the lock must be held
+func (reporter *Reporter) setSkipUpdates() {
+	var skip int32
+	if reporter.disabled && reporter.disabledMode == DisabledSkip {
+		skip = 1
+	}
+	atomic.StoreInt32(&reporter.skipUpdates, skip)
+}
 
-	// NewRelic GUID for creating the NewRelic plugin
-	Guid string
+// isDisabled reports whether the reporting is paused and in which mode
+func (reporter *Reporter) isDisabled() (bool, DisabledMode) {
+	reporter.lock.Lock()
+	defer reporter.lock.Unlock()
 
-	httpClient = &http.Client{Timeout: 10 * time.Second}
-)
+	return reporter.disabled, reporter.disabledMode
+}
 
-func init() {
-	Guid = defaultGUID
-	Log = log.New(os.Stderr, "[simplerelic] ", log.Ldate|log.Ltime|log.Lshortfile)
+// clearMetrics discards the values of all the metrics
+func (reporter *Reporter) clearMetrics() {
+	for _, metric := range reporter.metrics() {
+		if clearer, ok := metric.(Clearer); ok {
+			clearer.Clear()
+		} else {
+			// extracting the values clears them
+			metric.ValueMap()
+		}
+	}
 }
 
-// Reporter keeps track of the app metrics and sends them to NewRelic
-type Reporter struct {
-	Metrics  []AppMetric
-	host     string
-	pid      int
-	guid     string
-	duration int
-	version  string
-	appName  string
-	licence  string
-	verbose  bool
+// Reset discards the values of all the metrics and the reporter's own
+// statistics. It is meant for isolating tests which share a reporter
+// (e.g. the Engine), not for use in production where it loses data.
+// To start over with a fresh Engine call InitDefaultReporter again.
+func (reporter *Reporter) Reset() {
+	reporter.clearMetrics()
+
+	reporter.lock.Lock()
+	reporter.lastValues = make(map[string]float32)
+	reporter.lastReport = nowFunc()
+	reporter.sendLatency = 0
+	reporter.hasSendLatency = false
+	reporter.lock.Unlock()
 }
 
-type newRelicData struct {
-	Agent      *newRelicAgent       `json:"agent"`
-	Components []*newRelicComponent `json:"components"`
+// LastValues returns a copy of the values collected by the last Flush
+// of a test reporter
+func (reporter *Reporter) LastValues() map[string]float32 {
+	reporter.lock.Lock()
+	defer reporter.lock.Unlock()
+
+	values := make(map[string]float32, len(reporter.lastValues))
+	for name, value := range reporter.lastValues {
+		values[name] = value
+	}
+	return values
 }
 
-type newRelicAgent struct {
-	Host    string `json:"host"`
-	Pid     int    `json:"pid"`
-	Version string `json:"version"`
+// LastReportTime returns the time of the last report delivered or spooled,
+// also partly, or of the last Collect, before the first one the time the
+// reporter was created.
+// A health check can tell from it whether the metrics are still flowing.
+func (reporter *Reporter) LastReportTime() time.Time {
+	reporter.lock.Lock()
+	defer reporter.lock.Unlock()
+
+	return reporter.lastReport
 }
 
-type newRelicComponent struct {
-	Name     string             `json:"name"`
-	Guid     string             `json:"guid"`
-	Duration int                `json:"duration"`
-	Metrics  map[string]float32 `json:"metrics"`
+// LastError returns why the last report failed, nil when it was sent
+func (reporter *Reporter) LastError() error {
+	reporter.lock.Lock()
+	defer reporter.lock.Unlock()
+
+	return reporter.lastErr
 }
 
-// NewReporter creates a new Reporter
-func NewReporter(appName string, licence string, verbose bool) (*Reporter, error) {
+// Stop sending metrics to NewRelic, aborting the request in progress, also
+// the one of the final flush of StartContext. It returns once the reporting
+// loop exited and the final flush is done, no report is sent after it.
+// A stopped reporter can't be started again.
+func (reporter *Reporter) Stop() {
+	if flushed := reporter.stop(); flushed != nil {
+		<-flushed
+	}
+}
 
-	host, err := os.Hostname()
-	if err != nil {
-		return nil, errors.New("Can not get hostname")
+// stop stops the reporting loop without waiting for it, e.g. from the loop
+// itself, and returns the channel closed once no report is sent any more,
+// nil when not started
+func (reporter *Reporter) stop() (flushed chan struct{}) {
+
+	reporter.lock.Lock()
+	defer reporter.lock.Unlock()
+
+	if !reporter.stopped {
+		reporter.stopped = true
+		if reporter.quit != nil {
+			close(reporter.quit)
+		}
 	}
+	// also when StartContext stopped the loop already for its final flush
+	reporter.cancel()
+	return reporter.flushed
+}
 
-	pid := os.Getpid()
+// AddMetric adds a new metric to be reported. It is safe to call at any time,
+// also while reporting, the metric is reported from the next cycle on.
+func (reporter *Reporter) AddMetric(metric AppMetric) {
+	reporter.metricsLock.Lock()
+	defer reporter.metricsLock.Unlock()
 
-	if licence == "" {
-		return nil, errors.New("Please specify Newrelic licence")
+	metrics := make([]AppMetric, 0, len(reporter.Metrics)+1)
+	reporter.Metrics = append(append(metrics, reporter.Metrics...), metric)
+}
+
+// RemoveMetric removes the metric, returns false if it was not registered
+func (reporter *Reporter) RemoveMetric(metric AppMetric) bool {
+	reporter.metricsLock.Lock()
+	defer reporter.metricsLock.Unlock()
+
+	for i, m := range reporter.Metrics {
+		if m == metric {
+			metrics := make([]AppMetric, 0, len(reporter.Metrics)-1)
+			metrics = append(metrics, reporter.Metrics[:i]...)
+			reporter.Metrics = append(metrics, reporter.Metrics[i+1:]...)
+			return true
+		}
 	}
 
-	reporter := &Reporter{
-		host:     host,
-		pid:      pid,
-		guid:     Guid,
-		duration: 60,
-		appName:  appName,
-		licence:  licence,
-		version:  "1.0.0",
-		verbose:  verbose,
-		Metrics:  make([]AppMetric, 0, 5),
+	return false
+}
+
+// ReplaceMetric replaces the old metric with the new one at the same position,
+// returns false if the old metric was not registered
+func (reporter *Reporter) ReplaceMetric(oldMetric AppMetric, newMetric AppMetric) bool {
+	reporter.metricsLock.Lock()
+	defer reporter.metricsLock.Unlock()
+
+	for i, m := range reporter.Metrics {
+		if m == oldMetric {
+			metrics := append([]AppMetric(nil), reporter.Metrics...)
+			metrics[i] = newMetric
+			reporter.Metrics = metrics
+			return true
+		}
 	}
 
-	return reporter, nil
+	return false
 }
 
-// Start sending metrics to NewRelic
-func (reporter *Reporter) Start() {
+// metrics returns the registered metrics, safe to iterate
+// while the metrics are being added or removed
+func (reporter *Reporter) metrics() []AppMetric {
+	reporter.metricsLock.RLock()
+	defer reporter.metricsLock.RUnlock()
+	return reporter.Metrics
+}
 
-	ticker := time.NewTicker(reportingFreq)
-	quit := make(chan struct{})
-	go func() {
+// startRequest notifies the metrics tracking the start of the requests
+func (reporter *Reporter) startRequest(params map[string]interface{}) {
+	if atomic.LoadInt32(&reporter.skipUpdates) != 0 {
+		return
+	}
+	for _, v := range reporter.metrics() {
+		if starter, ok := v.(RequestStarter); ok {
+			starter.RequestStarted(params)
+		}
+	}
+}
 
-		defer func() {
-			if r := recover(); r != nil {
-				Log.Println("SimpleRelic reporter crashed")
+// UpdateMetrics updates all the metrics of the reporter, usually in the end
+// of each request. The errors of the metrics, e.g. for a missing parameter,
+// are returned as UpdateErrors and logged at most once a minute.
+func (reporter *Reporter) UpdateMetrics(params map[string]interface{}) error {
+	if atomic.LoadInt32(&reporter.skipUpdates) != 0 {
+		return nil
+	}
+
+	var errs UpdateErrors
+	reporter.updateLock.RLock()
+	for _, v := range reporter.metrics() {
+		if err := v.Update(params); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	reporter.updateLock.RUnlock()
+
+	reporter.checkFlushThreshold()
+
+	if errs == nil {
+		return nil
+	}
+	reporter.logUpdateErrors(errs)
+	return errs
+}
+
+// logUpdateErrors logs the failed updates unless they were logged within
+// updateErrorLogInterval, the errors not logged are counted instead. The
+// errors are formatted only when logged, the others cost an atomic add.
+func (reporter *Reporter) logUpdateErrors(errs UpdateErrors) {
+	now := nowFunc().UnixNano()
+	logged := atomic.LoadInt64(&reporter.updateErrorLogged)
+	if logged != 0 && time.Duration(now-logged) < updateErrorLogInterval ||
+		!atomic.CompareAndSwapInt64(&reporter.updateErrorLogged, logged, now) {
+		// logged recently or by a concurrent update
+		atomic.AddInt64(&reporter.suppressedUpdateErrors, int64(len(errs)))
+		return
+	}
+	suppressed := atomic.SwapInt64(&reporter.suppressedUpdateErrors, 0)
+
+	if suppressed > 0 {
+		Log.Printf("%v, %d more errors since the last log", errs, suppressed)
+		return
+	}
+	Log.Println(errs)
+}
+
+// MetricNames returns the type names of the registered metrics
+// in the order they were added e.g. "ReqPerEndpoint"
+func (reporter *Reporter) MetricNames() []string {
+	metrics := reporter.metrics()
+	names := make([]string, 0, len(metrics))
+	for _, metric := range metrics {
+		metricType := reflect.TypeOf(metric)
+		for metricType.Kind() == reflect.Ptr {
+			metricType = metricType.Elem()
+		}
+		names = append(names, metricType.Name())
+	}
+	return names
+}
+
+// Collect extracts the values of all the metrics and the reporter's own
+// statistics as the report does, but returns them instead of sending them,
+// e.g. for a custom destination. The values of the metrics are cleared,
+// also the ones retained from failed reports (see SetMaxSnapshots), as they
+// are handed to the caller, and the next report covers the time since then.
+// Values reported by several metrics under the same name are summed up.
+func (reporter *Reporter) Collect() map[string]float32 {
+	values, _, _ := reporter.collect()
+	reporter.clearSnapshots()
+
+	// the next report covers only the values collected after these
+	reporter.lock.Lock()
+	reporter.lastReport = nowFunc()
+	reporter.lock.Unlock()
+	return values
+}
+
+// extract takes the values of all the metrics at once, holding back the updates
+// so that no request is counted by only some of the standard metrics. Those
+// only hand over their values meanwhile and compute them after the updates are
+// released, the other metrics are extracted only after the updates are released.
+// It returns also the names of the values aggregating all the endpoints.
+func (reporter *Reporter) extract() (map[string]float32, map[string]*MetricSummary, map[string]bool) {
+
+	values := make(map[string]float32)
+	summaries := make(map[string]*MetricSummary)
+	overall := make(map[string]bool)
+	var collisions []string
+	add := func(metric AppMetric, metricValues map[string]float32) {
+		overallReporter, _ := metric.(overallReporter)
+		for name, value := range metricValues {
+			if _, ok := values[name]; ok {
+				collisions = append(collisions, name)
 			}
+			values[name] += value
+			if overallReporter != nil && overallReporter.isOverall(name) {
+				overall[name] = true
+			}
+		}
+	}
+	addSummaries := func(metricSummaries map[string]*MetricSummary) {
+		for name, summary := range metricSummaries {
+			summaries[name] = summary
+		}
+	}
+
+	start := time.Now()
+	var held time.Duration
+
+	type frozenMetric struct {
+		metric  AppMetric
+		compute func() (map[string]float32, map[string]*MetricSummary)
+	}
+	var frozen []frozenMetric
+	func() {
+		reporter.updateLock.Lock()
+		locked := time.Now()
+		defer func() {
+			held = time.Since(locked)
+			reporter.updateLock.Unlock()
 		}()
 
-		for {
-			select {
-			case <-ticker.C:
-				reporter.sendMetrics()
-			case <-quit:
-				ticker.Stop()
-				return
+		for _, metric := range reporter.metrics() {
+			switch freezer := metric.(type) {
+			case summaryFreezer:
+				frozen = append(frozen, frozenMetric{metric, freezer.freezeSummaries()})
+			case freezer:
+				compute := freezer.freeze()
+				frozen = append(frozen, frozenMetric{metric, func() (map[string]float32, map[string]*MetricSummary) {
+					return compute(), nil
+				}})
+			default:
+				// the other metrics keep their own locks, e.g. a FuncMetric's
+				// callback may take a while, so they are extracted afterwards
+				frozen = append(frozen, frozenMetric{metric, extractor(metric)})
 			}
 		}
 	}()
+
+	for _, entry := range frozen {
+		metricValues, metricSummaries := entry.compute()
+		add(entry.metric, metricValues)
+		addSummaries(metricSummaries)
+	}
+	reporter.logCollisions(collisions)
+
+	if reporter.observeExtract != nil {
+		reporter.observeExtract(held, time.Since(start))
+	}
+
+	return values, summaries, overall
 }
 
-// AddMetric adds a new metric to be reported
-func (reporter *Reporter) AddMetric(metric AppMetric) {
-	reporter.Metrics = append(reporter.Metrics, metric)
+// extractor returns the function extracting the values and the summaries
+// of a metric which doesn't hand them over to be computed later
+func extractor(metric AppMetric) func() (map[string]float32, map[string]*MetricSummary) {
+	return func() (map[string]float32, map[string]*MetricSummary) {
+		var summaries map[string]*MetricSummary
+		if summaryMetric, ok := metric.(SummaryMetric); ok {
+			summaries = summaryMetric.SummaryMap()
+		}
+		return metric.ValueMap(), summaries
+	}
+}
+
+// logCollisions logs the names reported by more than one metric,
+// once per name as they collide in every report
+func (reporter *Reporter) logCollisions(names []string) {
+	reporter.lock.Lock()
+	var logged []string
+	for _, name := range names {
+		if !reporter.collisions[name] {
+			reporter.collisions[name] = true
+			logged = append(logged, name)
+		}
+	}
+	reporter.lock.Unlock()
+
+	if len(logged) > 0 {
+		sort.Strings(logged)
+		Log.Printf("metrics %s are reported by more than one metric, their values are summed", strings.Join(logged, ", "))
+	}
+}
+
+// collect extracts all the metrics to be sent to NewRelic
+// from the AppMetric data structures
+func (reporter *Reporter) collect() (map[string]float32, map[string]*MetricSummary, map[string]bool) {
+
+	values, summaries, overall := reporter.extract()
+	for name, value := range reporter.selfStats() {
+		values[name] += value
+	}
+
+	round := reporter.rounder()
+	for name, value := range values {
+		values[name] = round(value)
+	}
+
+	if mapName := reporter.nameMapper(); mapName != nil {
+		mapped := make(map[string]float32, len(values))
+		for name, value := range values {
+			if name = mapName(name); name != "" {
+				mapped[name] += value
+			}
+		}
+		values = mapped
+
+		mappedSummaries := make(map[string]*MetricSummary, len(summaries))
+		for name, summary := range summaries {
+			if name = mapName(name); name != "" {
+				mappedSummaries[name] = summary
+			}
+		}
+		summaries = mappedSummaries
+
+		mappedOverall := make(map[string]bool, len(overall))
+		for name := range overall {
+			if name = mapName(name); name != "" {
+				mappedOverall[name] = true
+			}
+		}
+		overall = mappedOverall
+	}
+
+	return values, summaries, overall
+}
+
+// sendMetrics sends the metrics and keeps the outcome for LastError
+func (reporter *Reporter) sendMetrics() error {
+	err := reporter.send()
+
+	reporter.lock.Lock()
+	reporter.lastErr = err
+	reporter.lock.Unlock()
+
+	return err
 }
 
 // extract and send metrics to NewRelic
-func (reporter *Reporter) sendMetrics() {
+func (reporter *Reporter) send() error {
+
+	if disabled, mode := reporter.isDisabled(); disabled {
+		if mode == DisabledDiscard {
+			reporter.clearMetrics()
+		}
+		return ErrDisabled
+	}
 
 	reqData := reporter.prepareReqData()
 
-	// extract all metrics to be sent to NewRelic
-	// from the AppMetric data structure
-	for _, metrics := range reporter.Metrics {
-		for name, value := range metrics.ValueMap() {
-			reqData.Components[0].Metrics[name] = value
+	values, summaries, overall := reporter.collect()
+	for name, value := range values {
+		reqData.Components[0].Metrics[name] = value
+	}
+	for name, summary := range summaries {
+		reqData.Components[0].Metrics[name] = summary
+	}
+
+	if reporter.record {
+		reporter.lock.Lock()
+		reporter.lastValues = values
+		reporter.lastReport = nowFunc()
+		reporter.lock.Unlock()
+		reporter.clearSnapshots()
+		return nil
+	}
+
+	if reporter.isVerbose() {
+		for _, violation := range validatePayload(reqData) {
+			Log.Println("invalid payload:", violation)
 		}
 	}
 
-	b, err := json.Marshal(reqData)
-	if err != nil {
-		fmt.Errorf("error marshaling json")
+	// a single invalid value would fail marshaling of the whole payload
+	sanitizePayload(reqData)
+
+	if !reporter.DryRun && !reporter.breaker.allow() {
+		// the collected metrics are dropped to keep the memory bounded,
+		// only the snapshots capped by SetMaxSnapshots are kept
+		return ErrCircuitOpen
+	}
+
+	reporter.lock.Lock()
+	maxMetrics := reporter.maxMetricsPerRequest
+	sinks := append([]Sink(nil), reporter.sinks...)
+	reporter.lock.Unlock()
+
+	// every chunk is either delivered, spooled or failed
+	sent, delivered, spooled := true, false, false
+	var failed [][]byte
+	var sendErr error
+	for _, chunk := range splitPayload(reqData, maxMetrics, overall) {
+		b, err := json.Marshal(chunk)
+		if err != nil {
+			Log.Println("error marshaling json")
+			Log.Println(err)
+			return err
+		}
+
+		if reporter.isVerbose() {
+			var out bytes.Buffer
+			json.Indent(&out, b, "", "\t")
+			Log.Println("sending metrics to NewRelic")
+			Log.Println(out.String())
+		}
+
+		if reporter.DryRun {
+			continue
+		}
+
+		chunkSent, err := sendChunk(sinks, b)
+		if chunkSent {
+			delivered = true
+			continue
+		}
+		sent = false
+		if sendErr == nil {
+			sendErr = err
+		}
+
+		if spool := reporter.getSpool(); spool != nil {
+			err := spool.write(b)
+			if err == nil {
+				spooled = true
+				continue
+			}
+			Log.Println("error spooling metrics:", err)
+		}
+		failed = append(failed, b)
+	}
+
+	if reporter.DryRun {
+		// the next dry run covers the same window a real report would
+		reporter.lock.Lock()
+		reporter.lastReport = nowFunc()
+		reporter.lock.Unlock()
+		reporter.clearSnapshots()
+		return nil
+	}
+
+	// NewRelic is reachable when it accepted any of the chunks
+	reporter.breaker.record(delivered)
+	reporter.checkAuthFailure(sendErr, delivered)
+
+	// the retained snapshots are reported again only when none of the chunks
+	// was delivered or spooled, otherwise those would be reported twice
+	// and the chunks which failed are kept to be sent again instead
+	if !delivered && !spooled {
+		return sendErr
+	}
+	reporter.clearSnapshots()
+
+	// the values of the interval are accounted for, the ones which failed
+	// are sent again with the duration of their own payload
+	reporter.lock.Lock()
+	reporter.lastReport = nowFunc()
+	reporter.lock.Unlock()
+
+	if !sent {
+		reporter.keepUnsent(failed...)
+		return sendErr
+	}
+
+	// NewRelic is reachable again
+	reporter.resendUnsent(sinks)
+	reporter.replaySpool()
+
+	return nil
+}
+
+// sendChunk sends the payload to all the sinks, it was sent when one of them
+// accepted it. The error is the one of the first sink which failed.
+func sendChunk(sinks []Sink, payload []byte) (bool, error) {
+	var sent bool
+	var sendErr error
+	for _, sink := range sinks {
+		if err := sink.Send(payload); err == nil {
+			sent = true
+		} else if sendErr == nil {
+			sendErr = err
+		}
+	}
+	return sent, sendErr
+}
+
+// keepUnsent keeps the payloads to be sent again, dropping the oldest beyond maxUnsent
+func (reporter *Reporter) keepUnsent(payloads ...[]byte) {
+	if len(payloads) == 0 {
+		return
+	}
+
+	reporter.lock.Lock()
+	defer reporter.lock.Unlock()
+
+	reporter.unsent = append(reporter.unsent, payloads...)
+	if len(reporter.unsent) > maxUnsent {
+		reporter.unsent = reporter.unsent[len(reporter.unsent)-maxUnsent:]
+	}
+}
+
+// resendUnsent sends the kept payloads oldest first,
+// keeping the ones from the first which fails to be sent
+func (reporter *Reporter) resendUnsent(sinks []Sink) {
+	reporter.lock.Lock()
+	unsent := reporter.unsent
+	reporter.unsent = nil
+	reporter.lock.Unlock()
+
+	for i, payload := range unsent {
+		if sent, _ := sendChunk(sinks, payload); !sent {
+			reporter.keepUnsent(unsent[i:]...)
+			return
+		}
+	}
+}
+
+// clearSnapshots discards the values retained by the metrics once they were sent
+func (reporter *Reporter) clearSnapshots() {
+	for _, metric := range reporter.metrics() {
+		if snapshotMetric, ok := metric.(SnapshotMetric); ok {
+			snapshotMetric.ClearSnapshots()
+		}
+	}
+}
+
+// checkAuthFailure stops the reporter once the licence key was rejected
+// repeatedly, retrying won't succeed until the licence key is fixed
+func (reporter *Reporter) checkAuthFailure(err error, sent bool) {
+	reporter.lock.Lock()
+	if sent || !errors.Is(err, ErrUnauthorized) {
+		reporter.authFailures = 0
+		reporter.lock.Unlock()
+		return
+	}
+	reporter.authFailures++
+	failures := reporter.authFailures
+	reporter.lock.Unlock()
+
+	if failures >= maxAuthFailures {
+		Log.Printf("NewRelic rejected the licence key %d times in a row, please check that it is valid. Stopping SimpleRelic reporter", failures)
+		reporter.stop()
+	}
+}
+
+// splitPayload splits the payload into payloads with at most maxMetrics
+// metrics each, the overall metrics go first. Zero maxMetrics means no limit.
+func splitPayload(data *newRelicData, maxMetrics int, overall map[string]bool) []*newRelicData {
+	metrics := data.Components[0].Metrics
+	if maxMetrics <= 0 || len(metrics) <= maxMetrics {
+		return []*newRelicData{data}
+	}
+
+	names := make([]string, 0, len(metrics))
+	for name := range metrics {
+		names = append(names, name)
+	}
+	sort.Slice(names, func(i, j int) bool {
+		iOverall, jOverall := overall[names[i]], overall[names[j]]
+		if iOverall != jOverall {
+			return iOverall
+		}
+		return names[i] < names[j]
+	})
+
+	var chunks []*newRelicData
+	for start := 0; start < len(names); start += maxMetrics {
+		end := start + maxMetrics
+		if end > len(names) {
+			end = len(names)
+		}
+
+		component := *data.Components[0]
+		component.Metrics = make(map[string]interface{}, end-start)
+		for _, name := range names[start:end] {
+			component.Metrics[name] = metrics[name]
+		}
+
+		chunks = append(chunks, &newRelicData{
+			Agent:      data.Agent,
+			Components: []*newRelicComponent{&component},
+		})
+	}
+
+	return chunks
+}
+
+// validatePayload checks the payload against the constraints
+// of NewRelic plugin API and returns the violations found
+func validatePayload(data *newRelicData) []string {
+	var violations []string
+
+	for _, component := range data.Components {
+		if component.Name == "" {
+			violations = append(violations, "empty component name")
+		}
+		if component.Guid == "" {
+			violations = append(violations, "empty component guid")
+		}
+		if component.Duration <= 0 {
+			violations = append(violations, fmt.Sprintf("duration %d is not positive", component.Duration))
+		}
+
+		for name, value := range component.Metrics {
+			if name == "" {
+				violations = append(violations, "empty metric name")
+			}
+
+			var values []float32
+			switch v := value.(type) {
+			case float32:
+				values = []float32{v}
+			case *MetricSummary:
+				values = []float32{v.Total, v.Min, v.Max, v.SumOfSquares}
+			}
+			for _, v := range values {
+				if isInvalidFloat(v) {
+					violations = append(violations, fmt.Sprintf("metric %s has invalid value %v", name, v))
+					break
+				}
+			}
+		}
+	}
+
+	return violations
+}
+
+// sanitizePayload replaces NaN and Inf values with 0
+func sanitizePayload(data *newRelicData) {
+	for _, component := range data.Components {
+		for name, value := range component.Metrics {
+			switch v := value.(type) {
+			case float32:
+				if isInvalidFloat(v) {
+					Log.Printf("metric %s has invalid value %v, reporting 0 instead", name, v)
+					component.Metrics[name] = float32(0)
+				}
+			case *MetricSummary:
+				if isInvalidFloat(v.Total) || isInvalidFloat(v.Min) || isInvalidFloat(v.Max) || isInvalidFloat(v.SumOfSquares) {
+					Log.Printf("metric %s has invalid summary %+v, reporting empty summary instead", name, *v)
+					component.Metrics[name] = &MetricSummary{}
+				}
+			}
+		}
+	}
+}
+
+// isInvalidFloat is true for values that can not be encoded in JSON
+func isInvalidFloat(value float32) bool {
+	return math.IsNaN(float64(value)) || math.IsInf(float64(value), 0)
+}
+
+// selfStats are the metrics about the reporter itself
+func (reporter *Reporter) selfStats() map[string]float32 {
+	stats := make(map[string]float32)
+	if reporter.breaker.enabled() {
+		stats["Component/Reporter/CircuitBreaker[state]"] = float32(reporter.breaker.State())
 	}
 
-	if reporter.verbose {
-		var out bytes.Buffer
-		json.Indent(&out, b, "", "\t")
-		Log.Println("sending metrics to NewRelic")
-		Log.Println(out.String())
+	// reported once a metric retains the unsent values, see SetMaxSnapshots
+	var snapshots int
+	var retaining bool
+	for _, metric := range reporter.metrics() {
+		if retainer, ok := metric.(interface{ retainsSnapshots() bool }); ok && retainer.retainsSnapshots() {
+			retaining = true
+			snapshots += metric.(SnapshotMetric).BufferedSnapshots()
+		}
+	}
+	if retaining {
+		stats["Component/Reporter/BufferedSnapshots[count]"] = float32(snapshots)
 	}
 
-	if sendMetrics {
-		reporter.doRequest(b)
+	reporter.lock.Lock()
+	defer reporter.lock.Unlock()
+
+	if reporter.hasSendLatency {
+		stats["Component/Reporter/SendLatency[ms]"] = milliseconds(reporter.sendLatency)
+	}
+	if reporter.buildInfo != nil {
+		stats["Component/Build/Deployed[id]"] = reporter.buildID
 	}
+
+	return stats
 }
 
 func (reporter *Reporter) prepareReqData() *newRelicData {
+	reporter.lock.Lock()
+	defer reporter.lock.Unlock()
+
+	// the time window the metrics cover, in whole seconds
+	duration := int((nowFunc().Sub(reporter.lastReport) + time.Second/2) / time.Second)
+	if duration < 1 {
+		duration = 1
+	}
+
 	reqData := &newRelicData{
 		Agent: &newRelicAgent{
 			Host:    reporter.host,
@@ -170,42 +1739,77 @@ func (reporter *Reporter) prepareReqData() *newRelicData {
 		},
 		Components: []*newRelicComponent{
 			&newRelicComponent{
-				Name:     reporter.appName,
+				Name:     reporter.componentName(),
 				Guid:     reporter.guid,
-				Duration: reporter.duration,
-				Metrics:  make(map[string]float32),
+				Duration: duration,
+				Metrics:  make(map[string]interface{}),
 			},
 		},
 	}
 
 	reqData.Components[0] = &newRelicComponent{
-		Name:     reporter.appName,
+		Name:     reporter.componentName(),
 		Guid:     reporter.guid,
-		Duration: reporter.duration,
-		Metrics:  make(map[string]float32),
+		Duration: duration,
+		Metrics:  make(map[string]interface{}),
 	}
 
 	return reqData
 }
 
-func (reporter *Reporter) doRequest(json []byte) {
-	req, err := http.NewRequest("POST", newrelicURL, bytes.NewReader(json))
+// doRequest posts the payload to NewRelic, authenticating with the given
+// licence or, when empty, with the reporter's own one
+func (reporter *Reporter) doRequest(json []byte, licence string) error {
+
+	body := json
+	if reporter.Compress {
+		var err error
+		body, err = compress(json)
+		if err != nil {
+			Log.Println("error compressing newrelic request")
+			return err
+		}
+	}
+
+	req, err := http.NewRequestWithContext(reporter.ctx, "POST", reporter.url, bytes.NewReader(body))
 	if err != nil {
 		Log.Println("error setting up newrelic request")
+		return err
+	}
+	reporter.lock.Lock()
+	if licence == "" {
+		licence = reporter.authValue
 	}
-	req.Header.Set("X-License-Key", reporter.licence)
+	req.Header.Set(reporter.authHeader, licence)
+	req.Header.Set("User-Agent", reporter.userAgent)
+	client := reporter.client
+	reporter.lock.Unlock()
 	req.Header.Set("Content-Type", "application/json")
 	req.Header.Set("Accept", "application/json")
+	if reporter.Compress {
+		req.Header.Set("Content-Encoding", "gzip")
+	}
+
+	sendStart := time.Now()
+	resp, err := client.Do(req)
+
+	reporter.lock.Lock()
+	reporter.sendLatency = time.Since(sendStart)
+	reporter.hasSendLatency = true
+	reporter.lock.Unlock()
 
-	resp, err := httpClient.Do(req)
 	if err != nil {
+		if reporter.ctx.Err() != nil {
+			// the reporter was stopped
+			return reporter.ctx.Err()
+		}
 		Log.Println("Post request to NewRelic failed")
 		Log.Println(err)
-		return
+		return &RequestError{Kind: ErrTransport, Err: err}
 	}
 	defer resp.Body.Close()
 
-	if reporter.verbose {
+	if reporter.isVerbose() {
 		responseJSON, err := ioutil.ReadAll(resp.Body)
 		if err != nil {
 			Log.Println("reading of NewRelic response failed")
@@ -214,7 +1818,26 @@ func (reporter *Reporter) doRequest(json []byte) {
 		Log.Println(string(responseJSON))
 	}
 
+	// the connection is reused only once the body is read to the end
+	io.Copy(ioutil.Discard, resp.Body)
+
 	if resp.StatusCode != http.StatusOK {
 		Log.Printf("Error in request to NewRelic, status code %d", resp.StatusCode)
+		return statusError(resp.StatusCode)
+	}
+
+	return nil
+}
+
+// compress gzips the payload
+func compress(data []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	w := gzip.NewWriter(&buf)
+	if _, err := w.Write(data); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
 	}
+	return buf.Bytes(), nil
 }
@@ -0,0 +1,2024 @@
+package simplerelic
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"errors"
+	"hash/fnv"
+	"io/ioutil"
+	"log"
+	"math"
+	"math/rand"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// captureLog redirects the package logger to a buffer until the returned
+// function is called
+func captureLog() (*bytes.Buffer, func()) {
+	var buf bytes.Buffer
+	logger := Log
+	Log = log.New(&buf, "", 0)
+	return &buf, func() { Log = logger }
+}
+
+func newTestServer(t *testing.T, handler func(r *http.Request)) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		handler(r)
+		w.WriteHeader(http.StatusOK)
+	}))
+}
+
+func newServerReporter(t *testing.T, url string) *Reporter {
+	reporter, err := NewReporter("test", "licence", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	reporter.url = url
+	return reporter
+}
+
+func TestCompressedRequest(t *testing.T) {
+
+	var received newRelicData
+	server := newTestServer(t, func(r *http.Request) {
+		if r.Header.Get("Content-Encoding") != "gzip" {
+			t.Errorf("error: expected gzip content encoding, got %q", r.Header.Get("Content-Encoding"))
+		}
+
+		gz, err := gzip.NewReader(r.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, err := ioutil.ReadAll(gz)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := json.Unmarshal(body, &received); err != nil {
+			t.Fatal(err)
+		}
+	})
+	defer server.Close()
+
+	reporter := newServerReporter(t, server.URL)
+	reporter.Compress = true
+
+	m := NewReqPerEndpoint()
+	m.Update(map[string]interface{}{"endpointName": endpointName})
+	reporter.AddMetric(m)
+	reporter.sendMetrics()
+
+	if len(received.Components) != 1 {
+		t.Fatalf("error: expected 1 component, got %d", len(received.Components))
+	}
+	if value := received.Components[0].Metrics["Component/ReqPerEndpoint/log[requests]"]; value != 1. {
+		t.Errorf("error: expected %f, got %v", 1., value)
+	}
+}
+
+func TestUncompressedRequest(t *testing.T) {
+
+	server := newTestServer(t, func(r *http.Request) {
+		if r.Header.Get("Content-Encoding") != "" {
+			t.Errorf("error: expected no content encoding, got %q", r.Header.Get("Content-Encoding"))
+		}
+
+		var received newRelicData
+		if err := json.NewDecoder(r.Body).Decode(&received); err != nil {
+			t.Error(err)
+		}
+	})
+	defer server.Close()
+
+	reporter := newServerReporter(t, server.URL)
+	reporter.AddMetric(NewReqPerEndpoint())
+	reporter.sendMetrics()
+}
+
+// summaryMetric reports the values it was updated with as a summary
+type summaryMetric struct {
+	values []float32
+}
+
+func (m *summaryMetric) Update(params map[string]interface{}) error {
+	m.values = append(m.values, params["value"].(float32))
+	return nil
+}
+
+func (m *summaryMetric) ValueMap() map[string]float32 {
+	m.values = nil
+	return map[string]float32{
+		"Component/Summary[ms]": 1.,
+		"Component/Scalar[ms]":  2.,
+	}
+}
+
+func (m *summaryMetric) SummaryMap() map[string]*MetricSummary {
+	return map[string]*MetricSummary{
+		"Component/Summary[ms]": NewMetricSummary(m.values),
+	}
+}
+
+func TestSummaryPayload(t *testing.T) {
+
+	var metrics map[string]interface{}
+	server := newTestServer(t, func(r *http.Request) {
+		var data struct {
+			Components []struct {
+				Metrics map[string]interface{} `json:"metrics"`
+			} `json:"components"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&data); err != nil {
+			t.Fatal(err)
+		}
+		metrics = data.Components[0].Metrics
+	})
+	defer server.Close()
+
+	reporter := newServerReporter(t, server.URL)
+	m := &summaryMetric{}
+	for _, v := range []float32{1, 2, 3} {
+		m.Update(map[string]interface{}{"value": v})
+	}
+	reporter.AddMetric(m)
+	reporter.sendMetrics()
+
+	if value := metrics["Component/Scalar[ms]"]; value != 2. {
+		t.Errorf("error: expected %f, got %v", 2., value)
+	}
+
+	summary, ok := metrics["Component/Summary[ms]"].(map[string]interface{})
+	if !ok {
+		t.Fatalf("error: expected summary object, got %v", metrics["Component/Summary[ms]"])
+	}
+	expected := map[string]float64{"total": 6, "count": 3, "min": 1, "max": 3, "sum_of_squares": 14}
+	for field, value := range expected {
+		if summary[field] != value {
+			t.Errorf("error: expected %s to be %f, got %v", field, value, summary[field])
+		}
+	}
+}
+
+func TestStartTwice(t *testing.T) {
+
+	buf, restore := captureLog()
+	defer restore()
+
+	reporter := newServerReporter(t, "")
+
+	reporter.Start()
+	quit := reporter.quit
+	reporter.Start()
+
+	// every started loop gets its own quit channel
+	if reporter.quit != quit {
+		t.Error("error: expected second Start not to start another loop")
+	}
+	if !strings.Contains(buf.String(), "already started") {
+		t.Errorf("error: expected warning on second Start, got %q", buf.String())
+	}
+
+	reporter.Stop()
+}
+
+func TestTestReporter(t *testing.T) {
+
+	reporter, err := NewTestReporter("test")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	m := NewReqPerEndpoint()
+	reporter.AddMetric(m)
+
+	for i := 0; i < 3; i++ {
+		m.Update(map[string]interface{}{"endpointName": endpointName})
+	}
+	reporter.Flush()
+
+	values := reporter.LastValues()
+	if value := values["Component/ReqPerEndpoint/log[requests]"]; value != 3 {
+		t.Errorf("error: expected %f, got %f", 3., value)
+	}
+	if value := values["Component/Req/overall[requests]"]; value != 3 {
+		t.Errorf("error: expected %f, got %f", 3., value)
+	}
+
+	// the returned map is a copy
+	values["Component/Req/overall[requests]"] = 0
+	if value := reporter.LastValues()["Component/Req/overall[requests]"]; value != 3 {
+		t.Errorf("error: expected %f, got %f", 3., value)
+	}
+}
+
+func TestAppNameValidation(t *testing.T) {
+
+	reporter, err := NewReporter("  my app\t", "licence", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reporter.appName != "my app" {
+		t.Errorf("error: expected trimmed app name, got %q", reporter.appName)
+	}
+
+	for _, appName := range []string{"", "   ", "my\napp", "my\x00app"} {
+		if _, err := NewReporter(appName, "licence", false); err == nil {
+			t.Errorf("error: expected error for app name %q", appName)
+		}
+	}
+}
+
+func TestEnvironmentConfig(t *testing.T) {
+
+	os.Setenv(EnvLicenceKey, "env licence")
+	os.Setenv(EnvAppName, "env app")
+	defer os.Unsetenv(EnvLicenceKey)
+	defer os.Unsetenv(EnvAppName)
+
+	reporter, err := NewReporter("", "", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reporter.licence != "env licence" || reporter.appName != "env app" {
+		t.Errorf("error: expected the licence and app name from the environment, got %q and %q", reporter.licence, reporter.appName)
+	}
+
+	// explicit arguments take precedence
+	reporter, err = NewReporter("my app", "licence", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reporter.licence != "licence" || reporter.appName != "my app" {
+		t.Errorf("error: expected the explicit licence and app name, got %q and %q", reporter.licence, reporter.appName)
+	}
+
+	os.Unsetenv(EnvLicenceKey)
+	if _, err := NewReporter("", "", false); err == nil || err.Error() != "Please specify Newrelic licence" {
+		t.Errorf("error: expected the missing licence error, got %v", err)
+	}
+}
+
+func TestSendLatency(t *testing.T) {
+
+	var metrics []map[string]interface{}
+	server := newTestServer(t, func(r *http.Request) {
+		var data newRelicData
+		if err := json.NewDecoder(r.Body).Decode(&data); err != nil {
+			t.Fatal(err)
+		}
+		metrics = append(metrics, data.Components[0].Metrics)
+		time.Sleep(20 * time.Millisecond)
+	})
+	defer server.Close()
+
+	reporter := newServerReporter(t, server.URL)
+	reporter.sendMetrics()
+	reporter.sendMetrics()
+
+	if _, ok := metrics[0]["Component/Reporter/SendLatency[ms]"]; ok {
+		t.Error("error: expected no send latency before the first send")
+	}
+	latency, ok := metrics[1]["Component/Reporter/SendLatency[ms]"].(float64)
+	if !ok || latency < 20 {
+		t.Errorf("error: expected send latency of at least %f, got %v", 20., metrics[1]["Component/Reporter/SendLatency[ms]"])
+	}
+}
+
+func TestAuthHeader(t *testing.T) {
+
+	var header http.Header
+	server := newTestServer(t, func(r *http.Request) {
+		header = r.Header
+	})
+	defer server.Close()
+
+	reporter := newServerReporter(t, server.URL)
+	reporter.sendMetrics()
+	if value := header.Get("X-License-Key"); value != "licence" {
+		t.Errorf("error: expected default auth header with licence, got %q", value)
+	}
+
+	if err := reporter.SetAuthHeader("Api-Key", "key"); err != nil {
+		t.Fatal(err)
+	}
+	reporter.sendMetrics()
+	if value := header.Get("Api-Key"); value != "key" {
+		t.Errorf("error: expected custom auth header, got %q", value)
+	}
+	if value := header.Get("X-License-Key"); value != "" {
+		t.Errorf("error: expected no default auth header, got %q", value)
+	}
+
+	if err := reporter.SetAuthHeader("", "key"); err == nil {
+		t.Error("error: expected error for empty header name")
+	}
+	if err := reporter.SetAuthHeader("Api-Key", ""); err == nil {
+		t.Error("error: expected error for empty header value")
+	}
+}
+
+func TestUserAgent(t *testing.T) {
+
+	var header http.Header
+	server := newTestServer(t, func(r *http.Request) {
+		header = r.Header
+	})
+	defer server.Close()
+
+	reporter := newServerReporter(t, server.URL)
+	reporter.sendMetrics()
+	if value := header.Get("User-Agent"); value != "simplerelic/"+pluginVersion {
+		t.Errorf("error: expected default user agent, got %q", value)
+	}
+
+	if err := reporter.SetUserAgent("myapp/2.0"); err != nil {
+		t.Fatal(err)
+	}
+	reporter.sendMetrics()
+	if value := header.Get("User-Agent"); value != "myapp/2.0" {
+		t.Errorf("error: expected custom user agent, got %q", value)
+	}
+
+	if err := reporter.SetUserAgent(" "); err == nil {
+		t.Error("error: expected error for empty user agent")
+	}
+}
+
+func TestHostnameFailure(t *testing.T) {
+
+	buf, restore := captureLog()
+	defer restore()
+
+	hostname = func() (string, error) { return "", errors.New("no hostname") }
+	defer func() { hostname = os.Hostname }()
+
+	os.Unsetenv("POD_NAME")
+	reporter, err := NewReporter("test", "licence", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reporter.host != unknownHost {
+		t.Errorf("error: expected host %q, got %q", unknownHost, reporter.host)
+	}
+	if !strings.Contains(buf.String(), "no hostname") {
+		t.Errorf("error: expected a warning, got %q", buf.String())
+	}
+
+	os.Setenv("POD_NAME", "pod-1")
+	defer os.Unsetenv("POD_NAME")
+	reporter, err = NewReporter("test", "licence", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reporter.host != "pod-1" {
+		t.Errorf("error: expected host %q, got %q", "pod-1", reporter.host)
+	}
+
+	if err := reporter.SetHost("node-1"); err != nil {
+		t.Fatal(err)
+	}
+	if host := reporter.prepareReqData().Agent.Host; host != "node-1" {
+		t.Errorf("error: expected host %q, got %q", "node-1", host)
+	}
+}
+
+func TestAgentIdentity(t *testing.T) {
+
+	_, restore := captureLog()
+	defer restore()
+
+	hostname = func() (string, error) { return "", nil }
+	getpid = func() int { return -1 }
+	defer func() {
+		hostname = os.Hostname
+		getpid = os.Getpid
+	}()
+
+	os.Unsetenv("POD_NAME")
+	os.Setenv("COMPUTERNAME", "WIN-1")
+	defer os.Unsetenv("COMPUTERNAME")
+
+	reporter, err := NewReporter("test", "licence", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if agent := reporter.prepareReqData().Agent; agent.Host != "WIN-1" || agent.Pid != unknownPid {
+		t.Errorf("error: expected host %q and pid %d, got %q and %d", "WIN-1", unknownPid, agent.Host, agent.Pid)
+	}
+
+	if err := reporter.SetPID(0); err == nil {
+		t.Error("error: expected error for pid 0")
+	}
+	if err := reporter.SetPID(4242); err != nil {
+		t.Fatal(err)
+	}
+	if err := reporter.SetHost("node-1"); err != nil {
+		t.Fatal(err)
+	}
+	if agent := reporter.prepareReqData().Agent; agent.Host != "node-1" || agent.Pid != 4242 {
+		t.Errorf("error: expected host %q and pid %d, got %q and %d", "node-1", 4242, agent.Host, agent.Pid)
+	}
+}
+
+func TestSetHost(t *testing.T) {
+
+	var received newRelicData
+	server := newTestServer(t, func(r *http.Request) {
+		json.NewDecoder(r.Body).Decode(&received)
+	})
+	defer server.Close()
+
+	reporter := newServerReporter(t, server.URL)
+
+	if err := reporter.SetHost(" "); err == nil {
+		t.Error("error: expected error for empty host")
+	}
+	if err := reporter.SetHost("[]"); err == nil {
+		t.Error("error: expected error for empty IPv6 host")
+	}
+
+	hosts := map[string]string{
+		"node-1":      "node-1",
+		"2001:db8::1": "2001:db8::1",
+		"[fe80::1]":   "fe80::1",
+	}
+	for host, expected := range hosts {
+		if err := reporter.SetHost(host); err != nil {
+			t.Fatal(err)
+		}
+		reporter.sendMetrics()
+		if received.Agent.Host != expected {
+			t.Errorf("error: expected host %q in the payload, got %q", expected, received.Agent.Host)
+		}
+	}
+}
+
+func TestConcurrentConfiguration(t *testing.T) {
+
+	_, restore := captureLog()
+	defer restore()
+
+	server := newTestServer(t, func(r *http.Request) {})
+	defer server.Close()
+
+	reporter := newServerReporter(t, server.URL)
+
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 10; i++ {
+			reporter.SetVerbose(i%2 == 0)
+			reporter.SetHost("host")
+			reporter.SetAuthHeader("X-License-Key", "licence")
+		}
+	}()
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 10; i++ {
+			reporter.sendMetrics()
+		}
+	}()
+	wg.Wait()
+}
+
+func TestValidatePayload(t *testing.T) {
+
+	reporter := newServerReporter(t, "")
+
+	data := reporter.prepareReqData()
+	data.Components[0].Metrics["Component/Valid[ms]"] = float32(1)
+	if violations := validatePayload(data); len(violations) != 0 {
+		t.Errorf("error: expected no violations, got %v", violations)
+	}
+
+	data.Components[0].Duration = 0
+	data.Components[0].Metrics["Component/NaN[ms]"] = float32(math.NaN())
+	data.Components[0].Metrics["Component/Inf[ms]"] = float32(math.Inf(1))
+	data.Components[0].Metrics["Component/Summary[ms]"] = &MetricSummary{Total: float32(math.Inf(-1)), Count: 1}
+	violations := validatePayload(data)
+	if len(violations) != 4 {
+		t.Errorf("error: expected %d violations, got %v", 4, violations)
+	}
+	for _, name := range []string{"duration", "Component/NaN[ms]", "Component/Inf[ms]", "Component/Summary[ms]"} {
+		if !strings.Contains(strings.Join(violations, "\n"), name) {
+			t.Errorf("error: expected violation for %s, got %v", name, violations)
+		}
+	}
+}
+
+func TestVerboseLogsInvalidPayload(t *testing.T) {
+
+	buf, restore := captureLog()
+	defer restore()
+
+	reporter := newServerReporter(t, "")
+	reporter.SetVerbose(true)
+	reporter.AddMetric(&nanMetric{})
+	reporter.sendMetrics()
+
+	if !strings.Contains(buf.String(), "metric Component/NaN[ms] has invalid value NaN") {
+		t.Errorf("error: expected the invalid value to be logged, got %q", buf.String())
+	}
+}
+
+// nanMetric always reports NaN
+type nanMetric struct{}
+
+func (m *nanMetric) Update(params map[string]interface{}) error {
+	return nil
+}
+
+func (m *nanMetric) ValueMap() map[string]float32 {
+	return map[string]float32{"Component/NaN[ms]": float32(math.NaN())}
+}
+
+func TestSanitizeInvalidValues(t *testing.T) {
+
+	buf, restore := captureLog()
+	defer restore()
+
+	var metrics map[string]interface{}
+	server := newTestServer(t, func(r *http.Request) {
+		var data newRelicData
+		if err := json.NewDecoder(r.Body).Decode(&data); err != nil {
+			t.Fatal(err)
+		}
+		metrics = data.Components[0].Metrics
+	})
+	defer server.Close()
+
+	reporter := newServerReporter(t, server.URL)
+	reporter.AddMetric(&nanMetric{})
+	m := NewReqPerEndpoint()
+	m.Update(map[string]interface{}{"endpointName": endpointName})
+	reporter.AddMetric(m)
+	reporter.sendMetrics()
+
+	if metrics == nil {
+		t.Fatal("error: expected the payload to be sent")
+	}
+	if value := metrics["Component/NaN[ms]"]; value != 0. {
+		t.Errorf("error: expected %f, got %v", 0., value)
+	}
+	if value := metrics["Component/ReqPerEndpoint/log[requests]"]; value != 1. {
+		t.Errorf("error: expected %f, got %v", 1., value)
+	}
+	if !strings.Contains(buf.String(), "Component/NaN[ms]") {
+		t.Errorf("error: expected the invalid metric to be logged, got %q", buf.String())
+	}
+}
+
+// recordingSink keeps all the payloads sent to it
+type recordingSink struct {
+	payloads [][]byte
+}
+
+func (sink *recordingSink) Send(payload []byte) error {
+	sink.payloads = append(sink.payloads, payload)
+	return nil
+}
+
+// countingMetric counts how many times its values were extracted
+type countingMetric struct {
+	extracted int
+}
+
+func (m *countingMetric) Update(params map[string]interface{}) error {
+	return nil
+}
+
+func (m *countingMetric) ValueMap() map[string]float32 {
+	m.extracted++
+	return map[string]float32{"Component/Extracted[count]": float32(m.extracted)}
+}
+
+func TestMultipleSinks(t *testing.T) {
+
+	var licences []string
+	server := newTestServer(t, func(r *http.Request) {
+		licences = append(licences, r.Header.Get("X-License-Key"))
+	})
+	defer server.Close()
+
+	reporter := newServerReporter(t, server.URL)
+	if err := reporter.AddLicence("central"); err != nil {
+		t.Fatal(err)
+	}
+	if err := reporter.AddLicence(""); err == nil {
+		t.Error("error: expected error for empty licence")
+	}
+
+	first, second := &recordingSink{}, &recordingSink{}
+	reporter.AddSink(first)
+	reporter.AddSink(second)
+
+	m := &countingMetric{}
+	reporter.AddMetric(m)
+	reporter.sendMetrics()
+
+	if m.extracted != 1 {
+		t.Errorf("error: expected the metrics to be collected once, got %d", m.extracted)
+	}
+	if len(first.payloads) != 1 || len(second.payloads) != 1 {
+		t.Fatalf("error: expected one payload per sink, got %d and %d", len(first.payloads), len(second.payloads))
+	}
+	if !bytes.Equal(first.payloads[0], second.payloads[0]) {
+		t.Errorf("error: expected identical payloads, got %s and %s", first.payloads[0], second.payloads[0])
+	}
+	if !strings.Contains(string(first.payloads[0]), "Component/Extracted[count]") {
+		t.Errorf("error: expected the metric in the payload, got %s", first.payloads[0])
+	}
+
+	expected := []string{"licence", "central"}
+	if strings.Join(licences, ",") != strings.Join(expected, ",") {
+		t.Errorf("error: expected licences %v, got %v", expected, licences)
+	}
+}
+
+func TestDurationSinceLastReport(t *testing.T) {
+
+	_, restore := captureLog()
+	defer restore()
+
+	var durations []int
+	statusCode := http.StatusInternalServerError
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var data newRelicData
+		if err := json.NewDecoder(r.Body).Decode(&data); err != nil {
+			t.Fatal(err)
+		}
+		durations = append(durations, data.Components[0].Duration)
+		w.WriteHeader(statusCode)
+	}))
+	defer server.Close()
+
+	reporter := newServerReporter(t, server.URL)
+	reporter.lastReport = time.Now().Add(-60 * time.Second)
+
+	// first send fails so the next one covers both intervals
+	reporter.sendMetrics()
+	reporter.lastReport = reporter.lastReport.Add(-60 * time.Second)
+	statusCode = http.StatusOK
+	reporter.sendMetrics()
+	reporter.sendMetrics()
+
+	expected := []int{60, 120, 1}
+	if len(durations) != len(expected) {
+		t.Fatalf("error: expected %d requests, got %d", len(expected), len(durations))
+	}
+	for i, duration := range durations {
+		if duration != expected[i] {
+			t.Errorf("error: expected duration %d, got %d", expected[i], duration)
+		}
+	}
+}
+
+func TestFlushDuration(t *testing.T) {
+
+	start := time.Date(2020, 1, 1, 12, 0, 0, 0, time.UTC)
+	now := start
+	nowFunc = func() time.Time { return now }
+	defer func() { nowFunc = time.Now }()
+
+	var duration int
+	server := newTestServer(t, func(r *http.Request) {
+		var data newRelicData
+		if err := json.NewDecoder(r.Body).Decode(&data); err != nil {
+			t.Error(err)
+		}
+		duration = data.Components[0].Duration
+	})
+	defer server.Close()
+
+	reporter := newServerReporter(t, server.URL)
+
+	// an off-cycle flush covers only the time since the last report
+	for _, elapsed := range []time.Duration{10 * time.Second, 25*time.Second + 400*time.Millisecond} {
+		now = now.Add(elapsed)
+		if err := reporter.Flush(); err != nil {
+			t.Fatal(err)
+		}
+		if expected := int(elapsed.Round(time.Second) / time.Second); duration != expected {
+			t.Errorf("error: expected duration %d, got %d", expected, duration)
+		}
+	}
+}
+
+func TestStopWaitsForLoop(t *testing.T) {
+
+	reporter, err := NewTestReporter("test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	reporter.Start()
+	reporter.Stop()
+
+	select {
+	case <-reporter.done:
+	default:
+		t.Error("error: expected the reporting loop to have exited once Stop returned")
+	}
+}
+
+func TestStopAbortsRequest(t *testing.T) {
+
+	buf, restore := captureLog()
+	defer restore()
+
+	release := make(chan struct{})
+	server := newTestServer(t, func(r *http.Request) {
+		<-release
+	})
+	defer server.Close()
+	defer close(release)
+
+	reporter := newServerReporter(t, server.URL)
+	reporter.Start()
+
+	done := make(chan struct{})
+	go func() {
+		reporter.sendMetrics()
+		close(done)
+	}()
+
+	time.Sleep(50 * time.Millisecond)
+	reporter.Stop()
+	reporter.Stop()
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("error: expected Stop to abort the request")
+	}
+	if strings.Contains(buf.String(), "failed") {
+		t.Errorf("error: expected cancellation not to be logged as error, got %q", buf.String())
+	}
+}
+
+func TestRemoveAndReplaceMetric(t *testing.T) {
+
+	reporter := newServerReporter(t, "")
+	reqPerEndpoint, errorRate, responseTime := NewReqPerEndpoint(), NewErrorRatePerEndpoint(), NewResponseTimePerEndpoint()
+	reporter.AddMetric(reqPerEndpoint)
+	reporter.AddMetric(errorRate)
+
+	if !reporter.ReplaceMetric(errorRate, responseTime) {
+		t.Error("error: expected the metric to be replaced")
+	}
+	if reporter.ReplaceMetric(errorRate, responseTime) {
+		t.Error("error: expected replacing an unregistered metric to fail")
+	}
+	if names := strings.Join(reporter.MetricNames(), ","); names != "ReqPerEndpoint,ResponseTimePerEndpoint" {
+		t.Errorf("error: unexpected metrics %s", names)
+	}
+
+	if !reporter.RemoveMetric(reqPerEndpoint) {
+		t.Error("error: expected the metric to be removed")
+	}
+	if reporter.RemoveMetric(reqPerEndpoint) {
+		t.Error("error: expected removing an unregistered metric to fail")
+	}
+	if names := strings.Join(reporter.MetricNames(), ","); names != "ResponseTimePerEndpoint" {
+		t.Errorf("error: unexpected metrics %s", names)
+	}
+}
+
+func TestConcurrentMetricChanges(t *testing.T) {
+
+	reporter, err := NewTestReporter("test")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 100; i++ {
+			m := NewReqPerEndpoint()
+			reporter.AddMetric(m)
+			reporter.ReplaceMetric(m, NewErrorRatePerEndpoint())
+			if i%2 == 0 {
+				reporter.RemoveMetric(reporter.metrics()[0])
+			}
+		}
+	}()
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 100; i++ {
+			reporter.Flush()
+		}
+	}()
+	wg.Wait()
+
+	if count := len(reporter.metrics()); count != 50 {
+		t.Errorf("error: expected %d metrics, got %d", 50, count)
+	}
+}
+
+func TestAddMetricWhileReporting(t *testing.T) {
+
+	reporter, err := NewTestReporter("test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	reporter.AddMetric(NewReqPerEndpoint())
+
+	// every request flushes in the background
+	reporter.SetFlushThreshold(1)
+	reporter.Start()
+	defer reporter.Stop()
+
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 100; i++ {
+			reporter.AddMetric(fixedMetric{"Component/Added/" + strconv.Itoa(i) + "[count]": 1})
+		}
+	}()
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 500; i++ {
+			params := DefaultReqParams(endpointName)
+			CollectParamsOnReqEnd(params, 200)
+			reporter.UpdateMetrics(params)
+		}
+	}()
+	wg.Wait()
+
+	reporter.Flush()
+	values := reporter.LastValues()
+	for i := 0; i < 100; i++ {
+		if name := "Component/Added/" + strconv.Itoa(i) + "[count]"; values[name] != 1 {
+			t.Errorf("error: expected %s to be reported, got %f", name, values[name])
+		}
+	}
+}
+
+func TestDryRun(t *testing.T) {
+
+	now := time.Date(2020, 1, 1, 12, 0, 0, 0, time.UTC)
+	nowFunc = func() time.Time { return now }
+	defer func() { nowFunc = time.Now }()
+
+	var requests int
+	server := newTestServer(t, func(r *http.Request) {
+		requests++
+	})
+	defer server.Close()
+
+	reporter := newServerReporter(t, server.URL)
+	reporter.DryRun = true
+	now = now.Add(time.Hour)
+
+	m := NewReqPerEndpoint()
+	m.Update(map[string]interface{}{"endpointName": endpointName})
+	reporter.AddMetric(m)
+	reporter.sendMetrics()
+
+	if requests != 0 {
+		t.Errorf("error: expected no request in dry run, got %d", requests)
+	}
+	// the metrics are still collected
+	if count := m.BufferedCount(); count != 0 {
+		t.Errorf("error: expected the metrics to be cleared, got %d buffered", count)
+	}
+	// the duration covers the time since the last dry run
+	now = now.Add(time.Minute)
+	if duration := reporter.prepareReqData().Components[0].Duration; duration != 60 {
+		t.Errorf("error: expected duration %d, got %d", 60, duration)
+	}
+}
+
+func TestEnvironment(t *testing.T) {
+
+	reporter := newServerReporter(t, "")
+	if name := reporter.prepareReqData().Components[0].Name; name != "test" {
+		t.Errorf("error: expected component name %q, got %q", "test", name)
+	}
+
+	if err := reporter.SetEnvironment(" "); err == nil {
+		t.Error("error: expected error for empty environment")
+	}
+	if err := reporter.SetEnvironment("staging"); err != nil {
+		t.Fatal(err)
+	}
+	if name := reporter.prepareReqData().Components[0].Name; name != "test (staging)" {
+		t.Errorf("error: expected component name %q, got %q", "test (staging)", name)
+	}
+}
+
+func TestReset(t *testing.T) {
+
+	reporter, err := NewTestReporter("test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	metrics := []AppMetric{NewReqPerEndpoint(), NewErrorRatePerEndpoint(), NewResponseTimePerEndpoint(), &countingMetric{}}
+	for _, m := range metrics {
+		reporter.AddMetric(m)
+		m.Update(map[string]interface{}{"endpointName": endpointName, "statusCode": 500, "reqStartTime": time.Now()})
+	}
+	reporter.Flush()
+
+	for _, m := range metrics[:3] {
+		m.Update(map[string]interface{}{"endpointName": endpointName, "statusCode": 500, "reqStartTime": time.Now()})
+	}
+	reporter.Reset()
+
+	if values := reporter.LastValues(); len(values) != 0 {
+		t.Errorf("error: expected no last values, got %v", values)
+	}
+	for _, m := range metrics[:3] {
+		for name, value := range m.(Peeker).Peek() {
+			if value != 0 {
+				t.Errorf("error: expected %s to be cleared, got %f", name, value)
+			}
+		}
+	}
+	// metrics without Clear are drained
+	if extracted := metrics[3].(*countingMetric).extracted; extracted != 2 {
+		t.Errorf("error: expected the metric to be drained, got %d extractions", extracted)
+	}
+}
+
+// manyMetric reports the given number of distinct metrics
+type manyMetric struct {
+	count int
+}
+
+func (m *manyMetric) Update(params map[string]interface{}) error {
+	return nil
+}
+
+func (m *manyMetric) ValueMap() map[string]float32 {
+	values := make(map[string]float32, m.count)
+	for i := 0; i < m.count; i++ {
+		values["Component/Many/"+strconv.Itoa(i)+"[count]"] = float32(i)
+	}
+	return values
+}
+
+func TestMaxMetricsPerRequest(t *testing.T) {
+
+	var chunks []map[string]interface{}
+	server := newTestServer(t, func(r *http.Request) {
+		var data newRelicData
+		if err := json.NewDecoder(r.Body).Decode(&data); err != nil {
+			t.Fatal(err)
+		}
+		chunks = append(chunks, data.Components[0].Metrics)
+	})
+	defer server.Close()
+
+	reporter := newServerReporter(t, server.URL)
+	reporter.SetMaxMetricsPerRequest(1000)
+	reporter.AddMetric(NewReqPerEndpoint())
+	// together with the request metrics 5000 metrics in total
+	reporter.AddMetric(&manyMetric{count: 4998})
+	reporter.sendMetrics()
+
+	if len(chunks) != 5 {
+		t.Fatalf("error: expected %d requests, got %d", 5, len(chunks))
+	}
+
+	var total int
+	for _, chunk := range chunks {
+		if len(chunk) != 1000 {
+			t.Errorf("error: expected %d metrics per request, got %d", 1000, len(chunk))
+		}
+		total += len(chunk)
+	}
+	if total != 5000 {
+		t.Errorf("error: expected %d metrics in total, got %d", 5000, total)
+	}
+	if _, ok := chunks[0]["Component/Req/overall[requests]"]; !ok {
+		t.Error("error: expected the overall metric in the first request")
+	}
+}
+
+func TestPartlySentReport(t *testing.T) {
+
+	_, restore := captureLog()
+	defer restore()
+
+	now := time.Date(2020, 1, 1, 12, 0, 0, 0, time.UTC)
+	nowFunc = func() time.Time { return now }
+	defer func() { nowFunc = time.Now }()
+
+	for _, spooling := range []bool{false, true} {
+		// the second request of the first report fails
+		var requests int
+		totals := make(map[string]float64)
+		durations := make(map[int]bool)
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			requests++
+			if requests == 2 {
+				w.WriteHeader(http.StatusServiceUnavailable)
+				return
+			}
+			var data newRelicData
+			if err := json.NewDecoder(r.Body).Decode(&data); err != nil {
+				t.Error(err)
+			}
+			durations[data.Components[0].Duration] = true
+			for name, value := range data.Components[0].Metrics {
+				if strings.HasPrefix(name, "Component/Req") {
+					totals[name] += value.(float64)
+				}
+			}
+		}))
+
+		reporter := newServerReporter(t, server.URL)
+		if spooling {
+			dir := newSpoolDir(t)
+			defer os.RemoveAll(dir)
+			if err := reporter.SetSpool(dir, time.Hour, 1<<20); err != nil {
+				t.Fatal(err)
+			}
+		}
+		// 8 metrics in 3 requests, 3 of them per endpoint
+		reporter.SetMaxMetricsPerRequest(3)
+		m := NewReqPerEndpoint()
+		m.SetMaxSnapshots(10)
+		reporter.AddMetric(m)
+		for _, endpoint := range []string{"a", "b", "c", "d", "e"} {
+			m.Update(DefaultReqParams(endpoint))
+		}
+
+		now = now.Add(time.Minute)
+		if err := reporter.sendMetrics(); err == nil {
+			t.Error("error: expected the partly sent report to fail")
+		}
+		if requests != 3 {
+			t.Errorf("error: expected %d requests, got %d", 3, requests)
+		}
+		if count := m.BufferedSnapshots(); count != 0 {
+			t.Errorf("error: expected the snapshots of the partly sent report to be cleared, got %d", count)
+		}
+
+		// the failed request is sent again with the next report,
+		// which covers only the interval since the partly sent one
+		now = now.Add(time.Minute)
+		if err := reporter.sendMetrics(); err != nil {
+			t.Error(err)
+		}
+		expected := map[string]float64{"Component/Req/overall[requests]": 5}
+		for _, endpoint := range []string{"a", "b", "c", "d", "e"} {
+			expected["Component/ReqPerEndpoint/"+endpoint+"[requests]"] = 1
+		}
+		for name, value := range expected {
+			if totals[name] != value {
+				t.Errorf("error: expected %s to be reported %f in total with spooling %t, got %f",
+					name, value, spooling, totals[name])
+			}
+		}
+		if len(durations) != 1 || !durations[60] {
+			t.Errorf("error: expected every request to cover %d seconds with spooling %t, got %v", 60, spooling, durations)
+		}
+		server.Close()
+	}
+}
+
+func TestOverallEndpointName(t *testing.T) {
+
+	var chunks []map[string]interface{}
+	server := newTestServer(t, func(r *http.Request) {
+		var data newRelicData
+		if err := json.NewDecoder(r.Body).Decode(&data); err != nil {
+			t.Fatal(err)
+		}
+		chunks = append(chunks, data.Components[0].Metrics)
+	})
+	defer server.Close()
+
+	reporter := newServerReporter(t, server.URL)
+	reporter.SetMaxMetricsPerRequest(1)
+	reqPerEndpoint := NewReqPerEndpoint()
+	reporter.AddMetric(reqPerEndpoint)
+	// the name of the endpoint alone doesn't make its count an overall metric
+	reqPerEndpoint.Update(DefaultReqParams("reports/overall"))
+
+	_, _, overall := reporter.collect()
+	if overall["Component/ReqPerEndpoint/reports/overall[requests]"] {
+		t.Error("error: expected the endpoint reports/overall not to be an overall metric")
+	}
+	if !overall["Component/Req/overall[requests]"] {
+		t.Error("error: expected Component/Req/overall[requests] to be an overall metric")
+	}
+
+	reqPerEndpoint.Update(DefaultReqParams("reports/overall"))
+	reporter.sendMetrics()
+
+	if len(chunks) != 2 {
+		t.Fatalf("error: expected %d requests, got %d", 2, len(chunks))
+	}
+	if _, ok := chunks[0]["Component/Req/overall[requests]"]; !ok {
+		t.Errorf("error: expected the overall metric in the first request, got %v", chunks[0])
+	}
+}
+
+type panicMetric struct {
+	panics int32
+}
+
+func (m *panicMetric) Update(params map[string]interface{}) error {
+	return nil
+}
+
+func (m *panicMetric) ValueMap() map[string]float32 {
+	if atomic.AddInt32(&m.panics, -1) >= 0 {
+		panic("metric failure")
+	}
+	return map[string]float32{"Component/Panic[count]": 1}
+}
+
+func TestRestartAfterPanic(t *testing.T) {
+
+	buf, restore := captureLog()
+	defer restore()
+
+	restartBackoff = 10 * time.Millisecond
+	defer func() { restartBackoff = time.Second }()
+
+	received := make(chan struct{}, 10)
+	server := newTestServer(t, func(r *http.Request) {
+		received <- struct{}{}
+	})
+	defer server.Close()
+
+	reporter := newServerReporter(t, server.URL)
+	reporter.AddMetric(&panicMetric{panics: 2})
+	reporter.Start()
+	defer reporter.Stop()
+
+	// crash twice, the flushes are picked up by the restarted loops
+	for i := 0; i < 3; i++ {
+		reporter.flush <- struct{}{}
+	}
+
+	select {
+	case <-received:
+	case <-time.After(5 * time.Second):
+		t.Fatal("error: expected reporting to resume after the panic")
+	}
+	if !strings.Contains(buf.String(), "metric failure") {
+		t.Errorf("error: expected the panic to be logged, got %q", buf.String())
+	}
+}
+
+func waitStarted(reporter *Reporter) {
+	for {
+		reporter.lock.Lock()
+		started := reporter.started
+		reporter.lock.Unlock()
+		if started {
+			return
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestStartContext(t *testing.T) {
+
+	received := make(chan struct{}, 1)
+	server := newTestServer(t, func(r *http.Request) {
+		received <- struct{}{}
+	})
+	defer server.Close()
+
+	reporter := newServerReporter(t, server.URL)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() {
+		done <- reporter.StartContext(ctx)
+	}()
+
+	waitStarted(reporter)
+	if err := reporter.StartContext(ctx); err == nil {
+		t.Error("error: expected error for already started reporter")
+	}
+
+	cancel()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Errorf("error: expected no error, got %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("error: expected StartContext to return after the cancel")
+	}
+
+	// the final flush is done before returning
+	select {
+	case <-received:
+	default:
+		t.Error("error: expected a final flush")
+	}
+}
+
+func TestStartContextStop(t *testing.T) {
+
+	reporter := newServerReporter(t, "")
+
+	done := make(chan error)
+	go func() {
+		done <- reporter.StartContext(context.Background())
+	}()
+
+	waitStarted(reporter)
+	reporter.Stop()
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("error: expected StartContext to return after Stop")
+	}
+}
+
+func TestStopDuringFinalFlush(t *testing.T) {
+
+	_, restore := captureLog()
+	defer restore()
+
+	received, release := make(chan struct{}), make(chan struct{})
+	server := newTestServer(t, func(r *http.Request) {
+		close(received)
+		<-release
+	})
+	defer server.Close()
+	defer close(release)
+
+	reporter := newServerReporter(t, server.URL)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() {
+		done <- reporter.StartContext(ctx)
+	}()
+
+	waitStarted(reporter)
+	cancel()
+	<-received
+
+	// Stop aborts the request of the final flush and waits for it
+	stopped := make(chan struct{})
+	go func() {
+		reporter.Stop()
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+	case <-time.After(5 * time.Second):
+		t.Fatal("error: expected Stop to abort the final flush")
+	}
+	select {
+	case <-done:
+	default:
+		t.Error("error: expected StartContext to have returned once Stop returned")
+	}
+}
+
+func TestStartAfterStop(t *testing.T) {
+
+	buf, restore := captureLog()
+	defer restore()
+
+	reporter := newServerReporter(t, "")
+	reporter.Stop()
+
+	if err := reporter.StartContext(context.Background()); err == nil {
+		t.Error("error: expected error starting a stopped reporter")
+	}
+	reporter.Start()
+	if !strings.Contains(buf.String(), "stopped") {
+		t.Errorf("error: expected error on Start of a stopped reporter, got %q", buf.String())
+	}
+	if reporter.started {
+		t.Error("error: expected the stopped reporter not to be started")
+	}
+}
+
+type fixedMetric map[string]float32
+
+func (m fixedMetric) Update(params map[string]interface{}) error {
+	return nil
+}
+
+func (m fixedMetric) ValueMap() map[string]float32 {
+	return m
+}
+
+func TestPrecision(t *testing.T) {
+
+	var body string
+	server := newTestServer(t, func(r *http.Request) {
+		b, _ := ioutil.ReadAll(r.Body)
+		body = string(b)
+	})
+	defer server.Close()
+
+	reporter := newServerReporter(t, server.URL)
+	reporter.AddMetric(fixedMetric{
+		"Component/Rate[ratio]":  0.25000001,
+		"Component/Third[ratio]": 1. / 3,
+		"Component/Count[count]": 7,
+	})
+
+	reporter.Flush()
+	if !strings.Contains(body, "0.33333334") {
+		t.Errorf("error: expected no rounding by default, got %s", body)
+	}
+
+	reporter.SetPrecision(3)
+	reporter.Flush()
+	for _, value := range []string{`"Component/Rate[ratio]":0.25`, `"Component/Third[ratio]":0.333`, `"Component/Count[count]":7`} {
+		if !strings.Contains(body, value) {
+			t.Errorf("error: expected %s in the payload, got %s", value, body)
+		}
+	}
+	if strings.Contains(body, "0.3333") || strings.Contains(body, "0.2500") {
+		t.Errorf("error: expected the values rounded, got %s", body)
+	}
+}
+
+func TestConnectionReuse(t *testing.T) {
+
+	var lock sync.Mutex
+	var connections int
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// too large to be drained by the transport on close
+		w.Write(bytes.Repeat([]byte(" "), 1<<20))
+	}))
+	server.Config.ConnState = func(conn net.Conn, state http.ConnState) {
+		if state == http.StateNew {
+			lock.Lock()
+			connections++
+			lock.Unlock()
+		}
+	}
+	server.Start()
+	defer server.Close()
+
+	reporter := newServerReporter(t, server.URL)
+	reporter.SetHTTPClient(&http.Client{Transport: newTransport()})
+
+	for i := 0; i < 3; i++ {
+		if err := reporter.Flush(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	lock.Lock()
+	defer lock.Unlock()
+	if connections != 1 {
+		t.Errorf("error: expected 1 connection for 3 sends, got %d", connections)
+	}
+
+	if err := reporter.SetHTTPClient(nil); err == nil {
+		t.Error("error: expected error for nil client")
+	}
+}
+
+func TestCollect(t *testing.T) {
+
+	reporter, err := NewTestReporter("test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	reporter.AddMetric(NewReqPerEndpoint())
+	reporter.AddMetric(NewErrorRatePerEndpoint())
+	reporter.AddMetric(NewResponseTimePerEndpoint())
+
+	for _, statusCode := range []int{200, 500} {
+		params := DefaultReqParams(endpointName)
+		CollectParamsOnReqEnd(params, statusCode)
+		reporter.UpdateMetrics(params)
+	}
+
+	values := reporter.Collect()
+	expected := map[string]float32{
+		"Component/ReqPerEndpoint/log[requests]":      2,
+		"Component/Req/overall[requests]":             2,
+		"Component/ErrorRatePerEndpoint/log[percent]": 0.5,
+		"Component/ErrorCount/overall[errors]":        1,
+	}
+	for name, value := range expected {
+		if values[name] != value {
+			t.Errorf("error: expected %s to be %f, got %f", name, value, values[name])
+		}
+	}
+	if _, ok := values["Component/ResponseTimePerEndpoint/log[ms]"]; !ok {
+		t.Error("error: expected the response time to be collected")
+	}
+
+	// collecting clears the values like a report
+	if value := reporter.Collect()["Component/Req/overall[requests]"]; value != 0 {
+		t.Errorf("error: expected %f, got %f", 0., value)
+	}
+}
+
+func TestCollectAdvancesDuration(t *testing.T) {
+
+	now := time.Date(2020, 1, 1, 12, 0, 0, 0, time.UTC)
+	nowFunc = func() time.Time { return now }
+	defer func() { nowFunc = time.Now }()
+
+	reporter, err := NewTestReporter("test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	now = now.Add(time.Hour)
+	reporter.Collect()
+
+	// the next report covers only the time since the values were collected
+	now = now.Add(time.Minute)
+	if duration := reporter.prepareReqData().Components[0].Duration; duration != 60 {
+		t.Errorf("error: expected duration %d, got %d", 60, duration)
+	}
+}
+
+func TestCollectSumsCollisions(t *testing.T) {
+
+	reporter, err := NewTestReporter("test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	reporter.AddMetric(fixedMetric{"Component/Shared[count]": 2, "Component/First[count]": 1})
+	reporter.AddMetric(fixedMetric{"Component/Shared[count]": 3})
+
+	values := reporter.Collect()
+	if values["Component/Shared[count]"] != 5 || values["Component/First[count]"] != 1 {
+		t.Errorf("error: expected the colliding values to be summed, got %v", values)
+	}
+}
+
+func TestMetricNameMapper(t *testing.T) {
+
+	reporter, err := NewTestReporter("test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	reporter.AddMetric(NewReqPerEndpoint())
+	reporter.SetMetricNameMapper(func(name string) string {
+		switch name {
+		case "Component/Req/overall[requests]":
+			return "Component/Requests/all[requests]"
+		case "Component/ReqPerEndpoint/other[requests]":
+			return ""
+		}
+		return name
+	})
+
+	params := DefaultReqParams(endpointName)
+	CollectParamsOnReqEnd(params, 200)
+	reporter.UpdateMetrics(params)
+
+	values := reporter.Collect()
+	if values["Component/Requests/all[requests]"] != 1 {
+		t.Errorf("error: expected the legacy name to be reported, got %v", values)
+	}
+	for _, name := range []string{"Component/Req/overall[requests]", "Component/ReqPerEndpoint/other[requests]"} {
+		if _, ok := values[name]; ok {
+			t.Errorf("error: expected %s not to be reported", name)
+		}
+	}
+	if values["Component/ReqPerEndpoint/log[requests]"] != 1 {
+		t.Errorf("error: expected the other names to be kept, got %v", values)
+	}
+}
+
+func TestCollisionsLogged(t *testing.T) {
+
+	logs, restore := captureLog()
+	defer restore()
+
+	reporter, err := NewTestReporter("test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	reporter.AddMetric(fixedMetric{"Component/Shared[count]": 2, "Component/Other[count]": 1, "Component/First[count]": 1})
+	reporter.AddMetric(fixedMetric{"Component/Shared[count]": 3, "Component/Other[count]": 1})
+
+	reporter.Collect()
+	expected := "metrics Component/Other[count], Component/Shared[count] are reported by more than one metric"
+	if !strings.Contains(logs.String(), expected) {
+		t.Errorf("error: expected the collisions to be logged, got %q", logs.String())
+	}
+
+	// logged only once
+	logs.Reset()
+	reporter.Collect()
+	if logs.Len() != 0 {
+		t.Errorf("error: expected the collisions to be logged once, got %q", logs.String())
+	}
+}
+
+func TestCrashLogsPanic(t *testing.T) {
+
+	buf, restore := captureLog()
+	defer restore()
+
+	reporter := newServerReporter(t, "")
+	reporter.AddMetric(&panicMetric{panics: 1})
+
+	ticker := time.NewTicker(time.Hour)
+	defer ticker.Stop()
+
+	reporter.flush <- struct{}{}
+	if stopped := reporter.run(ticker, make(chan struct{})); stopped {
+		t.Fatal("error: expected the loop to crash")
+	}
+
+	log := buf.String()
+	for _, detail := range []string{"SimpleRelic reporter crashed", "metric failure", "goroutine", "(*panicMetric).ValueMap"} {
+		if !strings.Contains(log, detail) {
+			t.Errorf("error: expected %q in the log, got %q", detail, log)
+		}
+	}
+}
+
+func TestJitter(t *testing.T) {
+
+	reporter := newServerReporter(t, "")
+	if interval := reporter.interval(); interval != reportingFreq {
+		t.Errorf("error: expected %v without jitter, got %v", reportingFreq, interval)
+	}
+
+	for _, fraction := range []float64{-0.1, 1} {
+		if err := reporter.SetJitter(fraction); err == nil {
+			t.Errorf("error: expected error for jitter %f", fraction)
+		}
+	}
+
+	if err := reporter.SetJitter(0.1); err != nil {
+		t.Fatal(err)
+	}
+
+	// the bounds
+	reporter.random = func() float64 { return 0 }
+	if interval := reporter.interval(); interval != 54*time.Second {
+		t.Errorf("error: expected %v, got %v", 54*time.Second, interval)
+	}
+	reporter.random = func() float64 { return 0.5 }
+	if interval := reporter.interval(); interval != reportingFreq {
+		t.Errorf("error: expected %v, got %v", reportingFreq, interval)
+	}
+
+	reporter.random = rand.New(rand.NewSource(1)).Float64
+	distinct := make(map[time.Duration]bool)
+	for i := 0; i < 100; i++ {
+		interval := reporter.interval()
+		if interval < 54*time.Second || interval > 66*time.Second {
+			t.Errorf("error: expected interval within 54s and 66s, got %v", interval)
+		}
+		distinct[interval] = true
+	}
+	if len(distinct) < 2 {
+		t.Error("error: expected the intervals to vary")
+	}
+}
+
+func TestAlignment(t *testing.T) {
+
+	now := time.Date(2020, 1, 1, 12, 0, 17, 0, time.UTC)
+	nowFunc = func() time.Time { return now }
+	defer func() { nowFunc = time.Now }()
+
+	reporter := newServerReporter(t, "")
+	if interval := reporter.firstInterval(); interval != reportingFreq {
+		t.Errorf("error: expected %v without alignment, got %v", reportingFreq, interval)
+	}
+
+	if err := reporter.SetAlignment(-time.Minute); err == nil {
+		t.Error("error: expected error for a negative boundary")
+	}
+	if err := reporter.SetAlignment(time.Minute); err != nil {
+		t.Fatal(err)
+	}
+
+	// the first report at the next whole minute
+	if interval := reporter.firstInterval(); interval != 43*time.Second {
+		t.Errorf("error: expected the first report in %v, got %v", 43*time.Second, interval)
+	}
+
+	// the time the report took is absorbed
+	now = time.Date(2020, 1, 1, 12, 1, 0, int(300*time.Millisecond), time.UTC)
+	if interval := reporter.nextInterval(); interval != 59700*time.Millisecond {
+		t.Errorf("error: expected the next report in %v, got %v", 59700*time.Millisecond, interval)
+	}
+
+	// also with the jitter
+	reporter.SetJitter(0.1)
+	reporter.random = func() float64 { return 1 }
+	if interval := reporter.nextInterval(); now.Add(interval).Second() != 0 {
+		t.Errorf("error: expected the next report at a whole minute, got %v", now.Add(interval))
+	}
+}
+
+func TestBufferedSnapshots(t *testing.T) {
+
+	_, restore := captureLog()
+	defer restore()
+
+	server := newStatusServer(http.StatusInternalServerError)
+	defer server.Close()
+
+	reporter := newServerReporter(t, server.URL)
+	metric := NewReqPerEndpoint()
+	metric.SetMaxSnapshots(3)
+	reporter.AddMetric(metric)
+
+	for i, expected := range []int{1, 2, 3, 3, 3} {
+		params := DefaultReqParams(endpointName)
+		CollectParamsOnReqEnd(params, 200)
+		reporter.UpdateMetrics(params)
+
+		if err := reporter.Flush(); err == nil {
+			t.Fatal("error: expected the send to fail")
+		}
+		if snapshots := metric.BufferedSnapshots(); snapshots != expected {
+			t.Errorf("error: expected %d snapshots after %d failed sends, got %d", expected, i+1, snapshots)
+		}
+		if value := reporter.selfStats()["Component/Reporter/BufferedSnapshots[count]"]; value != float32(expected) {
+			t.Errorf("error: expected %d buffered snapshots reported, got %f", expected, value)
+		}
+	}
+
+	// the oldest snapshots were dropped
+	if value := metric.Peek()["Component/Req/overall[requests]"]; value != 3 {
+		t.Errorf("error: expected %d requests retained, got %f", 3, value)
+	}
+}
+
+func TestResendRetainedSnapshots(t *testing.T) {
+
+	_, restore := captureLog()
+	defer restore()
+
+	var fail bool
+	var received newRelicData
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		received = newRelicData{}
+		if err := json.NewDecoder(r.Body).Decode(&received); err != nil {
+			t.Error(err)
+		}
+		if fail {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+	}))
+	defer server.Close()
+
+	reporter := newServerReporter(t, server.URL)
+	metric := NewErrorRatePerEndpoint()
+	metric.SetMaxSnapshots(10)
+	reporter.AddMetric(metric)
+
+	update := func(statusCode int) {
+		params := DefaultReqParams(endpointName)
+		CollectParamsOnReqEnd(params, statusCode)
+		reporter.UpdateMetrics(params)
+	}
+
+	fail = true
+	update(200)
+	update(500)
+	if err := reporter.Flush(); err == nil {
+		t.Fatal("error: expected the send to fail")
+	}
+	if snapshots := metric.BufferedSnapshots(); snapshots != 1 {
+		t.Fatalf("error: expected the failed report to be retained, got %d snapshots", snapshots)
+	}
+
+	// the retained counts are sent again together with the new ones
+	fail = false
+	update(500)
+	update(200)
+	if err := reporter.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	metrics := received.Components[0].Metrics
+	if value := metrics["Component/ErrorCount/overall[errors]"]; value != 2. {
+		t.Errorf("error: expected %f errors resent, got %v", 2., value)
+	}
+	if value := metrics["Component/ErrorRatePerEndpoint/log[percent]"]; value != .5 {
+		t.Errorf("error: expected an error rate of %f, got %v", .5, value)
+	}
+
+	// the snapshots are cleared once sent
+	if snapshots := metric.BufferedSnapshots(); snapshots != 0 {
+		t.Errorf("error: expected the snapshots to be cleared after the send, got %d", snapshots)
+	}
+	if err := reporter.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if value := received.Components[0].Metrics["Component/ErrorCount/overall[errors]"]; value != 0. {
+		t.Errorf("error: expected no errors after the successful send, got %v", value)
+	}
+}
+
+func TestCollectRetainedSnapshots(t *testing.T) {
+
+	reporter, err := NewTestReporter("test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	metric := NewReqPerEndpoint()
+	metric.SetMaxSnapshots(10)
+	reporter.AddMetric(metric)
+
+	params := DefaultReqParams(endpointName)
+	CollectParamsOnReqEnd(params, 200)
+	reporter.UpdateMetrics(params)
+
+	// the collected values are not retained for the next collection
+	for i, expected := range []float32{1, 0, 0} {
+		if value := reporter.Collect()["Component/Req/overall[requests]"]; value != expected {
+			t.Errorf("error: expected %f requests in collection %d, got %f", expected, i+1, value)
+		}
+	}
+	if snapshots := metric.BufferedSnapshots(); snapshots != 0 {
+		t.Errorf("error: expected no snapshots after the collection, got %d", snapshots)
+	}
+}
+
+func TestFuncMetric(t *testing.T) {
+
+	reporter, err := NewTestReporter("test")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var calls int
+	reporter.AddMetric(NewFuncMetric(func() map[string]float32 {
+		calls++
+		return map[string]float32{"Component/Cache/HitRatio[ratio]": .75}
+	}))
+
+	params := DefaultReqParams(endpointName)
+	CollectParamsOnReqEnd(params, 200)
+	reporter.UpdateMetrics(params)
+
+	values := reporter.Collect()
+	if values["Component/Cache/HitRatio[ratio]"] != .75 {
+		t.Errorf("error: expected %f, got %v", .75, values)
+	}
+	if calls != 1 {
+		t.Errorf("error: expected the callback to be called once per collection, got %d", calls)
+	}
+}
+
+func TestSlowFuncMetric(t *testing.T) {
+
+	reporter, err := NewTestReporter("test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	called := make(chan struct{})
+	release := make(chan struct{})
+	reporter.AddMetric(NewFuncMetric(func() map[string]float32 {
+		close(called)
+		<-release
+		return nil
+	}))
+
+	collected := make(chan struct{})
+	go func() {
+		reporter.Collect()
+		close(collected)
+	}()
+	<-called
+
+	// the callback delays the report, but not the requests
+	updated := make(chan struct{})
+	go func() {
+		params := DefaultReqParams(endpointName)
+		CollectParamsOnReqEnd(params, 200)
+		reporter.UpdateMetrics(params)
+		close(updated)
+	}()
+	select {
+	case <-updated:
+	case <-time.After(5 * time.Second):
+		t.Fatal("error: expected the update not to wait for the callback")
+	}
+
+	close(release)
+	<-collected
+}
+
+func TestConsistentCollect(t *testing.T) {
+
+	reporter, err := NewTestReporter("test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	responseTime := NewResponseTimePerEndpoint()
+	responseTime.SetReportSum(true)
+	reporter.AddMetric(NewReqPerEndpoint())
+	reporter.AddMetric(NewErrorRatePerEndpoint())
+	reporter.AddMetric(responseTime)
+
+	const requests = 2000
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < requests; i++ {
+			params := DefaultReqParams(endpointName)
+			CollectParamsOnReqEnd(params, 500)
+			reporter.UpdateMetrics(params)
+		}
+	}()
+
+	var total float32
+	check := func() {
+		values := reporter.Collect()
+		count := values["Component/Req/overall[requests]"]
+		if values["Component/ErrorCount/overall[errors]"] != count || values["Component/ResponseTimeCount/overall[requests]"] != count {
+			t.Errorf("error: expected all the metrics to cover the same %f requests, got %f errors and %f response times",
+				count, values["Component/ErrorCount/overall[errors]"], values["Component/ResponseTimeCount/overall[requests]"])
+		}
+		total += count
+	}
+
+	for running := true; running; {
+		select {
+		case <-done:
+			running = false
+		default:
+		}
+		check()
+	}
+	check()
+
+	if total != requests {
+		t.Errorf("error: expected %d requests in total, got %f", requests, total)
+	}
+}
+
+// blockingFreezer blocks computing its values until released
+type blockingFreezer struct {
+	computing chan struct{}
+	release   chan struct{}
+}
+
+func (m blockingFreezer) Update(params map[string]interface{}) error {
+	return nil
+}
+
+func (m blockingFreezer) ValueMap() map[string]float32 {
+	return m.freeze()()
+}
+
+func (m blockingFreezer) freeze() func() map[string]float32 {
+	return func() map[string]float32 {
+		select {
+		case m.computing <- struct{}{}:
+		default:
+		}
+		<-m.release
+		return nil
+	}
+}
+
+func TestCollectDoesNotBlockUpdates(t *testing.T) {
+
+	reporter, err := NewTestReporter("test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	metric := blockingFreezer{computing: make(chan struct{}, 1), release: make(chan struct{})}
+	reporter.AddMetric(NewReqPerEndpoint())
+	reporter.AddMetric(metric)
+
+	collected := make(chan map[string]float32)
+	go func() {
+		collected <- reporter.Collect()
+	}()
+	<-metric.computing
+
+	updated := make(chan struct{})
+	go func() {
+		params := DefaultReqParams(endpointName)
+		CollectParamsOnReqEnd(params, 200)
+		reporter.UpdateMetrics(params)
+		close(updated)
+	}()
+
+	select {
+	case <-updated:
+	case <-time.After(5 * time.Second):
+		t.Fatal("error: expected the update not to wait for the values to be computed")
+	}
+	close(metric.release)
+
+	if values := <-collected; values["Component/Req/overall[requests]"] != 0 {
+		t.Errorf("error: expected the update after the extraction not to be collected, got %v", values)
+	}
+	if values := reporter.Collect(); values["Component/Req/overall[requests]"] != 1 {
+		t.Errorf("error: expected the update in the next collection, got %v", values)
+	}
+}
+
+func TestSetEnabled(t *testing.T) {
+
+	reporter, err := NewTestReporter("test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := NewReqPerEndpoint()
+	reporter.AddMetric(m)
+	update := func() {
+		reporter.UpdateMetrics(CollectParamsOnReqEnd(DefaultReqParams(endpointName), 200))
+	}
+
+	// paused the values are counted and discarded
+	reporter.SetEnabled(false)
+	update()
+	if m.BufferedCount() != 1 {
+		t.Errorf("error: expected the request to be counted while disabled, got %d", m.BufferedCount())
+	}
+	if err := reporter.Flush(); !errors.Is(err, ErrDisabled) {
+		t.Errorf("error: expected %v, got %v", ErrDisabled, err)
+	}
+	if m.BufferedCount() != 0 || len(reporter.LastValues()) != 0 {
+		t.Errorf("error: expected the values to be discarded, got %d requests and %v", m.BufferedCount(), reporter.LastValues())
+	}
+
+	// skipping also the updates
+	if err := reporter.SetDisabledMode(DisabledSkip); err != nil {
+		t.Fatal(err)
+	}
+	update()
+	if m.BufferedCount() != 0 {
+		t.Errorf("error: expected the update to be skipped, got %d requests", m.BufferedCount())
+	}
+
+	// resumed
+	reporter.SetEnabled(true)
+	update()
+	if err := reporter.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if value := reporter.LastValues()["Component/ReqPerEndpoint/log[requests]"]; value != 1 {
+		t.Errorf("error: expected %f requests once enabled, got %f", 1., value)
+	}
+
+	if err := reporter.SetDisabledMode(DisabledMode(5)); err == nil {
+		t.Error("error: expected error for an invalid disabled mode")
+	}
+}
+
+func TestBuildInfo(t *testing.T) {
+
+	buf, restore := captureLog()
+	defer restore()
+
+	reporter, err := NewTestReporter("test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := reporter.SetBuildInfo(nil); err == nil {
+		t.Error("error: expected error for empty build info")
+	}
+
+	info := map[string]string{"sha": "a1b2c3", "time": "2020-01-01T12:00:00Z"}
+	if err := reporter.SetBuildInfo(info); err != nil {
+		t.Fatal(err)
+	}
+	reporter.Start()
+	defer reporter.Stop()
+	if !strings.Contains(buf.String(), "build sha=a1b2c3, time=2020-01-01T12:00:00Z") {
+		t.Errorf("error: expected the build info to be logged, got %q", buf.String())
+	}
+
+	h := fnv.New32a()
+	h.Write([]byte("sha=a1b2c3, time=2020-01-01T12:00:00Z"))
+	expected := float32(h.Sum32() & (1<<24 - 1))
+
+	reporter.Flush()
+	if value, ok := reporter.LastValues()["Component/Build/Deployed[id]"]; !ok || value != expected {
+		t.Errorf("error: expected build id %f, got %f", expected, value)
+	}
+
+	// changes with the build
+	info["sha"] = "d4e5f6"
+	reporter.SetBuildInfo(info)
+	reporter.Flush()
+	if value := reporter.LastValues()["Component/Build/Deployed[id]"]; value == expected {
+		t.Errorf("error: expected the build id to change with the build, got %f", value)
+	}
+}
@@ -1,16 +1,56 @@
 package simplerelic
 
 import (
+	"sync/atomic"
 	"time"
 )
 
 var (
 	// Engine reports metrics to NewRelic
 	Engine *Reporter
+
+	// the last request id assigned
+	requestIDs uint64
 )
 
-// InitDefaultReporter creates a new reporter and adds standard metrics
-func InitDefaultReporter(appname string, licence string, verbose bool) (*Reporter, error) {
+// MetricOption selects the metrics added by InitDefaultReporter
+type MetricOption func(*defaultMetrics)
+
+type defaultMetrics struct {
+	reqPerEndpoint bool
+	errorRate      bool
+	responseTime   bool
+	additional     []AppMetric
+}
+
+// WithoutReqPerEndpoint leaves out the requests per endpoint metric
+func WithoutReqPerEndpoint() MetricOption {
+	return func(m *defaultMetrics) { m.reqPerEndpoint = false }
+}
+
+// WithoutErrorRate leaves out the error rate per endpoint metric
+func WithoutErrorRate() MetricOption {
+	return func(m *defaultMetrics) { m.errorRate = false }
+}
+
+// WithoutResponseTime leaves out the response time per endpoint metric
+func WithoutResponseTime() MetricOption {
+	return func(m *defaultMetrics) { m.responseTime = false }
+}
+
+// WithMetric adds a metric after the standard ones
+func WithMetric(metric AppMetric) MetricOption {
+	return func(m *defaultMetrics) { m.additional = append(m.additional, metric) }
+}
+
+// InitDefaultReporter creates a new reporter and adds standard metrics.
+// Options can leave out some of the standard metrics or add other ones.
+func InitDefaultReporter(appname string, licence string, verbose bool, opts ...MetricOption) (*Reporter, error) {
+
+	metrics := &defaultMetrics{reqPerEndpoint: true, errorRate: true, responseTime: true}
+	for _, opt := range opts {
+		opt(metrics)
+	}
 
 	var err error
 	Engine, err = NewReporter(appname, licence, verbose)
@@ -18,9 +58,18 @@ func InitDefaultReporter(appname string, licence string, verbose bool) (*Reporte
 		return nil, err
 	}
 
-	Engine.AddMetric(NewReqPerEndpoint())
-	Engine.AddMetric(NewErrorRatePerEndpoint())
-	Engine.AddMetric(NewResponseTimePerEndpoint())
+	if metrics.reqPerEndpoint {
+		Engine.AddMetric(NewReqPerEndpoint())
+	}
+	if metrics.errorRate {
+		Engine.AddMetric(NewErrorRatePerEndpoint())
+	}
+	if metrics.responseTime {
+		Engine.AddMetric(NewResponseTimePerEndpoint())
+	}
+	for _, metric := range metrics.additional {
+		Engine.AddMetric(metric)
+	}
 
 	return Engine, nil
 }
@@ -28,26 +77,56 @@ func InitDefaultReporter(appname string, licence string, verbose bool) (*Reporte
 // DefaultReqParams creates and populates request parameters map to be used by default metrics
 // Called in the beginning of each request
 func DefaultReqParams(endpointName string) map[string]interface{} {
+	params := newReqParams(endpointName, StartTimer())
+	if Engine != nil {
+		Engine.startRequest(params)
+	}
+	return params
+}
+
+func newReqParams(endpointName string, start time.Time) map[string]interface{} {
 	params := make(map[string]interface{})
-	params["endpointName"] = endpointName
+	params[ParamEndpointName] = endpointName
 
 	// required by response time metric
-	params["reqStartTime"] = time.Now()
+	params[ParamReqStartTime] = start
+
+	// pairs the start and the end of the request
+	params[ParamRequestID] = atomic.AddUint64(&requestIDs, 1)
 
 	return params
 }
 
+// StartTimer returns the start of a request to be set as reqStartTime.
+// It should be called at the very top of the handler chain, the work done
+// before it is missing from the response time. The start carries the
+// monotonic clock, so the response time is not skewed by clock adjustments
+// as long as the start isn't serialized or rounded.
+func StartTimer() time.Time {
+	return nowFunc()
+}
+
+// ElapsedMs returns the milliseconds elapsed since the start
+// returned by StartTimer
+func ElapsedMs(start time.Time) float32 {
+	return milliseconds(nowFunc().Sub(start))
+}
+
+// milliseconds converts the duration to the milliseconds reported to NewRelic
+func milliseconds(d time.Duration) float32 {
+	return float32(d) / float32(time.Millisecond)
+}
+
 // CollectParamsOnReqEnd populates params map with additional data available when the request
 // processing is already done e.g. http response status code
 func CollectParamsOnReqEnd(params map[string]interface{}, statusCode int) map[string]interface{} {
 	// required by error rate metric
-	params["statusCode"] = statusCode
+	params[ParamStatusCode] = statusCode
 	return params
 }
 
-// UpdateMetricsOnReqEnd updates all defined metrics in the end of each request
-func UpdateMetricsOnReqEnd(params map[string]interface{}) {
-	for _, v := range Engine.Metrics {
-		v.Update(params)
-	}
+// UpdateMetricsOnReqEnd updates all defined metrics in the end of each request,
+// the errors of the metrics are logged and returned, see UpdateMetrics
+func UpdateMetricsOnReqEnd(params map[string]interface{}) error {
+	return Engine.UpdateMetrics(params)
 }
@@ -0,0 +1,266 @@
+package simplerelic
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestInitDefaultReporter(t *testing.T) {
+
+	reporter, err := InitDefaultReporter("test", "licence", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []string{"ReqPerEndpoint", "ErrorRatePerEndpoint", "ResponseTimePerEndpoint"}
+	if names := reporter.MetricNames(); !reflect.DeepEqual(names, expected) {
+		t.Errorf("error: expected metrics %v, got %v", expected, names)
+	}
+	if Engine != reporter {
+		t.Error("error: expected the default reporter to be the Engine")
+	}
+}
+
+func TestInitDefaultReporterOptions(t *testing.T) {
+
+	tests := []struct {
+		opts     []MetricOption
+		expected []string
+	}{
+		{
+			[]MetricOption{WithoutErrorRate()},
+			[]string{"ReqPerEndpoint", "ResponseTimePerEndpoint"},
+		},
+		{
+			[]MetricOption{WithoutReqPerEndpoint(), WithoutResponseTime(), WithMetric(NewRateLimitedPerEndpoint())},
+			[]string{"ErrorRatePerEndpoint", "RateLimitedPerEndpoint"},
+		},
+		{
+			[]MetricOption{WithMetric(NewServerErrorRatePerEndpoint())},
+			[]string{"ReqPerEndpoint", "ErrorRatePerEndpoint", "ResponseTimePerEndpoint", "ErrorRatePerEndpoint"},
+		},
+	}
+
+	for _, test := range tests {
+		reporter, err := InitDefaultReporter("test", "licence", false, test.opts...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if names := reporter.MetricNames(); !reflect.DeepEqual(names, test.expected) {
+			t.Errorf("error: expected metrics %v, got %v", test.expected, names)
+		}
+	}
+}
+
+// notifyingSink signals every payload sent to it
+type notifyingSink struct {
+	sent chan []byte
+}
+
+func (sink *notifyingSink) Send(payload []byte) error {
+	sink.sent <- payload
+	return nil
+}
+
+func TestFlushThreshold(t *testing.T) {
+
+	_, restore := captureLog()
+	defer restore()
+
+	reporter, err := InitDefaultReporter("test", "licence", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { Engine = nil }()
+
+	reporter.url = ""
+	sink := &notifyingSink{sent: make(chan []byte, 10)}
+	reporter.AddSink(sink)
+	reporter.SetFlushThreshold(2)
+	reporter.Start()
+	defer reporter.Stop()
+
+	params := CollectParamsOnReqEnd(DefaultReqParams("log"), 200)
+	UpdateMetricsOnReqEnd(params)
+	UpdateMetricsOnReqEnd(params)
+
+	select {
+	case <-sink.sent:
+		t.Fatal("error: expected no flush below the threshold")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	UpdateMetricsOnReqEnd(params)
+
+	select {
+	case <-sink.sent:
+	case <-time.After(time.Second):
+		t.Fatal("error: expected a flush above the threshold")
+	}
+}
+
+func BenchmarkUpdateMetricsOnReqEnd(b *testing.B) {
+
+	reporter, err := NewTestReporter("test")
+	if err != nil {
+		b.Fatal(err)
+	}
+	reporter.AddMetric(NewReqPerEndpoint())
+	reporter.AddMetric(NewErrorRatePerEndpoint())
+	reporter.AddMetric(NewResponseTimePerEndpoint())
+	reporter.SetFlushThreshold(1 << 30)
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			params := DefaultReqParams(endpointName)
+			CollectParamsOnReqEnd(params, 200)
+			reporter.UpdateMetrics(params)
+		}
+	})
+}
+
+// slowMetric is a custom metric taking a while to extract its values
+type slowMetric struct{}
+
+func (slowMetric) Update(params map[string]interface{}) error {
+	return nil
+}
+
+func (slowMetric) ValueMap() map[string]float32 {
+	time.Sleep(time.Millisecond)
+	return map[string]float32{"Component/Slow[count]": 1}
+}
+
+// benchmarkUpdateHarvest measures the updates, optionally while
+// the metrics are harvested every millisecond. It fails when the
+// harvests hold back the updates for most of their time.
+func benchmarkUpdateHarvest(b *testing.B, harvest bool) {
+
+	reporter, err := NewTestReporter("test")
+	if err != nil {
+		b.Fatal(err)
+	}
+	percentiles, err := NewResponseTimePercentilePerEndpoint(PercentileExact)
+	if err != nil {
+		b.Fatal(err)
+	}
+	reporter.AddMetric(NewReqPerEndpoint())
+	reporter.AddMetric(NewErrorRatePerEndpoint())
+	reporter.AddMetric(NewResponseTimePerEndpoint())
+	reporter.AddMetric(percentiles)
+	reporter.AddMetric(slowMetric{})
+
+	// written by the harvesting goroutine only, read once it exited
+	var held, total time.Duration
+	reporter.observeExtract = func(extractHeld time.Duration, extractTotal time.Duration) {
+		held += extractHeld
+		total += extractTotal
+	}
+
+	done := make(chan struct{})
+	stopped := make(chan struct{})
+	if harvest {
+		go func() {
+			defer close(stopped)
+			ticker := time.NewTicker(time.Millisecond)
+			defer ticker.Stop()
+			for {
+				select {
+				case <-done:
+					return
+				case <-ticker.C:
+					reporter.Collect()
+				}
+			}
+		}()
+	} else {
+		close(stopped)
+	}
+	defer func() {
+		close(done)
+		<-stopped
+		if held > total/2 {
+			b.Errorf("error: the harvests held back the updates for %v of %v", held, total)
+		}
+	}()
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			params := DefaultReqParams(endpointName)
+			CollectParamsOnReqEnd(params, 200)
+			reporter.UpdateMetrics(params)
+		}
+	})
+}
+
+func BenchmarkUpdate(b *testing.B) {
+	benchmarkUpdateHarvest(b, false)
+}
+
+func BenchmarkUpdateWhileHarvesting(b *testing.B) {
+	benchmarkUpdateHarvest(b, true)
+}
+
+func TestUnfinishedRequests(t *testing.T) {
+
+	start := time.Date(2020, 1, 1, 12, 0, 0, 0, time.UTC)
+	now := start
+	nowFunc = func() time.Time { return now }
+	defer func() { nowFunc = time.Now }()
+
+	reporter, err := InitDefaultReporter("test", "licence", false, WithMetric(NewUnfinishedRequests(time.Minute)))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	finished := DefaultReqParams(endpointName)
+	DefaultReqParams(endpointName) // never finishes
+	CollectParamsOnReqEnd(finished, 200)
+	UpdateMetricsOnReqEnd(finished)
+
+	unfinished := func() float32 {
+		return reporter.Collect()["Component/UnfinishedRequests[count]"]
+	}
+
+	if value := unfinished(); value != 0 {
+		t.Errorf("error: expected no unfinished requests before the timeout, got %f", value)
+	}
+
+	now = start.Add(2 * time.Minute)
+	if value := unfinished(); value != 1 {
+		t.Errorf("error: expected %f unfinished request, got %f", 1., value)
+	}
+
+	// reported only once
+	if value := unfinished(); value != 0 {
+		t.Errorf("error: expected %f, got %f", 0., value)
+	}
+}
+
+func TestElapsedMs(t *testing.T) {
+
+	now := time.Date(2020, 1, 1, 12, 0, 0, 0, time.UTC)
+	nowFunc = func() time.Time { return now }
+	defer func() { nowFunc = time.Now }()
+
+	start := StartTimer()
+	if value := DefaultReqParams(endpointName)[ParamReqStartTime]; value != start {
+		t.Errorf("error: expected the start %v, got %v", start, value)
+	}
+
+	now = now.Add(1500 * time.Microsecond)
+	if elapsed := ElapsedMs(start); elapsed != 1.5 {
+		t.Errorf("error: expected %f ms, got %f", 1.5, elapsed)
+	}
+
+	// the monotonic clock is used with the real clock
+	nowFunc = time.Now
+	if elapsed := ElapsedMs(StartTimer()); elapsed < 0 || elapsed > 1000 {
+		t.Errorf("error: expected a small elapsed time, got %f", elapsed)
+	}
+}
@@ -0,0 +1,235 @@
+package simplerelic
+
+import (
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// suffix of the spooled payloads
+const spoolSuffix = ".json.gz"
+
+var (
+	// delay between the background replays of the spool, doubled up to
+	// the max on every failed replay in a row, replaceable in tests
+	spoolRetry    = 30 * time.Second
+	maxSpoolRetry = 10 * time.Minute
+)
+
+// spool keeps the payloads which failed to be sent on disk, so that they
+// are sent later, also after a restart
+type spool struct {
+	dir      string
+	maxAge   time.Duration
+	maxBytes int64
+
+	// keeps the names unique within the same nanosecond
+	seq uint64
+
+	// held while writing and replaying so that a payload is not sent twice
+	lock sync.Mutex
+}
+
+// SetSpool enables spooling of the payloads which failed to be sent to the dir.
+// They are sent again, oldest first, after the next successful report and,
+// while the reporter is started, retried in the background with a backoff
+// also when the reports keep failing. They are deleted once sent. Payloads
+// older than maxAge are deleted, as are the oldest ones once all of them take
+// more than maxBytes. The replayed metrics are attributed by NewRelic to the
+// time they are sent. The snapshots retained by the metrics (see SetMaxSnapshots)
+// are cleared once their values are spooled, so they are not reported twice.
+func (reporter *Reporter) SetSpool(dir string, maxAge time.Duration, maxBytes int64) error {
+	if dir == "" {
+		return errors.New("Please specify spool directory")
+	}
+	if maxAge <= 0 || maxBytes <= 0 {
+		return errors.New("Please specify max age and size of the spool")
+	}
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return err
+	}
+
+	reporter.lock.Lock()
+	reporter.spool = &spool{dir: dir, maxAge: maxAge, maxBytes: maxBytes}
+	reporter.lock.Unlock()
+	return nil
+}
+
+// getSpool returns the spool, nil when spooling is disabled
+func (reporter *Reporter) getSpool() *spool {
+	reporter.lock.Lock()
+	defer reporter.lock.Unlock()
+
+	return reporter.spool
+}
+
+// write stores the payload compressed, the file is renamed once complete
+// so that a partial payload is never replayed
+func (s *spool) write(payload []byte) error {
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	if _, err := gz.Write(payload); err != nil {
+		return err
+	}
+	if err := gz.Close(); err != nil {
+		return err
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	name := fmt.Sprintf("%020d-%06d", nowFunc().UnixNano(), atomic.AddUint64(&s.seq, 1)%1000000)
+	tmp := filepath.Join(s.dir, name+".tmp")
+	if err := ioutil.WriteFile(tmp, buf.Bytes(), 0600); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, filepath.Join(s.dir, name+spoolSuffix)); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+
+	s.evict()
+	return nil
+}
+
+// files returns the spooled payloads, oldest first
+func (s *spool) files() []os.FileInfo {
+	infos, err := ioutil.ReadDir(s.dir)
+	if err != nil {
+		Log.Println("error reading the spool:", err)
+		return nil
+	}
+
+	files := infos[:0]
+	for _, info := range infos {
+		if info.Mode().IsRegular() && strings.HasSuffix(info.Name(), spoolSuffix) {
+			files = append(files, info)
+		}
+	}
+	return files
+}
+
+// evict deletes the payloads which are too old or beyond the size of the spool
+func (s *spool) evict() {
+	files := s.files()
+
+	var size int64
+	for _, file := range files {
+		size += file.Size()
+	}
+
+	for _, file := range files {
+		if size <= s.maxBytes && nowFunc().Sub(spooledAt(file.Name())) <= s.maxAge {
+			// the remaining files are newer
+			break
+		}
+		if err := os.Remove(filepath.Join(s.dir, file.Name())); err != nil {
+			Log.Println("error evicting spooled metrics:", err)
+		}
+		size -= file.Size()
+	}
+}
+
+// spooledAt is the time the payload was spooled, encoded in the name
+func spooledAt(name string) time.Time {
+	nanos, err := strconv.ParseInt(strings.SplitN(name, "-", 2)[0], 10, 64)
+	if err != nil {
+		return time.Time{}
+	}
+	return time.Unix(0, nanos)
+}
+
+// replay sends the spooled payloads oldest first, deleting the sent ones.
+// It stops at the first payload which fails to be sent and returns false.
+func (s *spool) replay(send func(payload []byte) bool) bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.evict()
+	for _, file := range s.files() {
+		path := filepath.Join(s.dir, file.Name())
+		payload, err := readSpooled(path)
+		if err != nil {
+			// a corrupt payload would block the ones after it
+			Log.Println("error reading spooled metrics, deleting them:", err)
+			os.Remove(path)
+			continue
+		}
+
+		if !send(payload) {
+			return false
+		}
+		if err := os.Remove(path); err != nil {
+			Log.Println("error deleting the sent spooled metrics:", err)
+		}
+	}
+	return true
+}
+
+// replaySpool sends the spooled payloads to the sinks,
+// it returns false when one of them failed to be sent
+func (reporter *Reporter) replaySpool() bool {
+	spool := reporter.getSpool()
+	if spool == nil {
+		return true
+	}
+
+	reporter.lock.Lock()
+	sinks := append([]Sink(nil), reporter.sinks...)
+	reporter.lock.Unlock()
+
+	return spool.replay(func(payload []byte) bool {
+		replayed, _ := sendChunk(sinks, payload)
+		return replayed
+	})
+}
+
+// retrySpool replays the spool in the background until quit is closed,
+// doubling the delay on every failed replay in a row. It closes done once it exited.
+func (reporter *Reporter) retrySpool(quit chan struct{}, done chan struct{}) {
+
+	defer close(done)
+
+	retry := spoolRetry
+	for {
+		select {
+		case <-time.After(retry):
+		case <-quit:
+			return
+		}
+
+		if disabled, _ := reporter.isDisabled(); disabled || reporter.DryRun || reporter.replaySpool() {
+			retry = spoolRetry
+			continue
+		}
+
+		retry *= 2
+		if retry > maxSpoolRetry {
+			retry = maxSpoolRetry
+		}
+	}
+}
+
+// readSpooled reads and decompresses the spooled payload
+func readSpooled(path string) ([]byte, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	gz, err := gzip.NewReader(f)
+	if err != nil {
+		return nil, err
+	}
+	return ioutil.ReadAll(gz)
+}
@@ -0,0 +1,195 @@
+package simplerelic
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func newSpoolDir(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "simplerelic-spool")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return dir
+}
+
+func spooledFiles(t *testing.T, dir string) []string {
+	files, err := filepath.Glob(filepath.Join(dir, "*"+spoolSuffix))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return files
+}
+
+func TestSpoolReplay(t *testing.T) {
+
+	_, restore := captureLog()
+	defer restore()
+
+	dir := newSpoolDir(t)
+	defer os.RemoveAll(dir)
+
+	fail := true
+	var received []newRelicData
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if fail {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		var data newRelicData
+		if err := json.NewDecoder(r.Body).Decode(&data); err != nil {
+			t.Error(err)
+		}
+		received = append(received, data)
+	}))
+	defer server.Close()
+
+	reporter := newServerReporter(t, server.URL)
+	if err := reporter.SetSpool("", time.Hour, 1<<20); err == nil {
+		t.Error("error: expected error for no spool directory")
+	}
+	if err := reporter.SetSpool(dir, time.Hour, 1<<20); err != nil {
+		t.Fatal(err)
+	}
+	m := NewReqPerEndpoint()
+	reporter.AddMetric(m)
+
+	// the failed payload is written to the spool
+	m.Update(map[string]interface{}{"endpointName": endpointName})
+	if err := reporter.Flush(); err == nil {
+		t.Fatal("error: expected the send to fail")
+	}
+	files := spooledFiles(t, dir)
+	if len(files) != 1 {
+		t.Fatalf("error: expected 1 spooled payload, got %d", len(files))
+	}
+	payload, err := readSpooled(files[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	var spooled newRelicData
+	if err := json.Unmarshal(payload, &spooled); err != nil {
+		t.Fatal(err)
+	}
+	if value := spooled.Components[0].Metrics["Component/ReqPerEndpoint/log[requests]"]; value != 1. {
+		t.Errorf("error: expected the spooled payload to hold %f requests, got %v", 1., value)
+	}
+
+	// it is replayed after the next successful send and deleted
+	fail = false
+	m.Update(map[string]interface{}{"endpointName": endpointName})
+	m.Update(map[string]interface{}{"endpointName": endpointName})
+	if err := reporter.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if len(received) != 2 {
+		t.Fatalf("error: expected the report and the replayed payload, got %d requests", len(received))
+	}
+	if value := received[1].Components[0].Metrics["Component/ReqPerEndpoint/log[requests]"]; value != 1. {
+		t.Errorf("error: expected the replayed payload to hold %f requests, got %v", 1., value)
+	}
+	if files := spooledFiles(t, dir); len(files) != 0 {
+		t.Errorf("error: expected the replayed payload to be deleted, got %v", files)
+	}
+}
+
+func TestSpoolRetry(t *testing.T) {
+
+	_, restore := captureLog()
+	defer restore()
+
+	spoolRetry, maxSpoolRetry = 5*time.Millisecond, 20*time.Millisecond
+	defer func() { spoolRetry, maxSpoolRetry = 30*time.Second, 10*time.Minute }()
+
+	dir := newSpoolDir(t)
+	defer os.RemoveAll(dir)
+
+	// NewRelic is unreachable for the first replays
+	var requests int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&requests, 1) <= 3 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+	}))
+	defer server.Close()
+
+	reporter := newServerReporter(t, server.URL)
+	if err := reporter.SetSpool(dir, time.Hour, 1<<20); err != nil {
+		t.Fatal(err)
+	}
+	if err := reporter.getSpool().write([]byte(`{"payload":0}`)); err != nil {
+		t.Fatal(err)
+	}
+
+	// the spool is retried without any successful report
+	reporter.Start()
+	deadline := time.Now().Add(5 * time.Second)
+	for len(spooledFiles(t, dir)) != 0 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	reporter.Stop()
+
+	if files := spooledFiles(t, dir); len(files) != 0 {
+		t.Errorf("error: expected the spooled payload to be replayed, got %v", files)
+	}
+	if count := atomic.LoadInt32(&requests); count != 4 {
+		t.Errorf("error: expected %d replays, got %d", 4, count)
+	}
+}
+
+func TestSpoolEviction(t *testing.T) {
+
+	start := time.Date(2020, 1, 1, 12, 0, 0, 0, time.UTC)
+	now := start
+	nowFunc = func() time.Time { return now }
+	defer func() { nowFunc = time.Now }()
+
+	dir := newSpoolDir(t)
+	defer os.RemoveAll(dir)
+
+	s := &spool{dir: dir, maxAge: 10 * time.Minute, maxBytes: 1 << 20}
+	for i := 0; i < 5; i++ {
+		if err := s.write([]byte(`{"payload":` + string(rune('0'+i)) + `}`)); err != nil {
+			t.Fatal(err)
+		}
+		now = now.Add(time.Minute)
+	}
+
+	// the payloads older than the max age are deleted
+	now = start.Add(12 * time.Minute)
+	s.evict()
+	if files := spooledFiles(t, dir); len(files) != 3 {
+		t.Errorf("error: expected %d payloads within the max age, got %d", 3, len(files))
+	}
+
+	// the oldest payloads are deleted beyond the size
+	size := fileSize(t, spooledFiles(t, dir)[0])
+	s.maxBytes = 2 * size
+	s.evict()
+	files := spooledFiles(t, dir)
+	if len(files) != 2 {
+		t.Fatalf("error: expected %d payloads within the size, got %d", 2, len(files))
+	}
+	payload, err := readSpooled(files[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(payload) != `{"payload":3}` {
+		t.Errorf("error: expected the newest payloads to be kept, got %s", payload)
+	}
+}
+
+func fileSize(t *testing.T, path string) int64 {
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return info.Size()
+}
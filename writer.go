@@ -0,0 +1,143 @@
+package simplerelic
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"net/http"
+)
+
+// ResponseRecorder is a http.ResponseWriter recording the status code
+// and the number of bytes written of the response. It implements Flush,
+// Hijack and ReadFrom only when the wrapped writer does, so feature detection
+// on the recorder gives the same answer as on the wrapped writer.
+type ResponseRecorder interface {
+	http.ResponseWriter
+	// Status returns the status code of the response, 200 if none was written explicitly
+	Status() int
+	// BytesWritten returns the number of bytes of the response body written so far
+	BytesWritten() int64
+}
+
+// WrapResponseWriter returns a ResponseRecorder writing to w
+func WrapResponseWriter(w http.ResponseWriter) ResponseRecorder {
+	recorder := &responseRecorder{ResponseWriter: w, status: http.StatusOK}
+
+	_, flusher := w.(http.Flusher)
+	_, hijacker := w.(http.Hijacker)
+	_, readerFrom := w.(io.ReaderFrom)
+
+	switch {
+	case flusher && hijacker && readerFrom:
+		return struct {
+			*responseRecorder
+			http.Flusher
+			http.Hijacker
+			io.ReaderFrom
+		}{recorder, flushRecorder{recorder}, hijackRecorder{recorder}, readFromRecorder{recorder}}
+	case flusher && hijacker:
+		return struct {
+			*responseRecorder
+			http.Flusher
+			http.Hijacker
+		}{recorder, flushRecorder{recorder}, hijackRecorder{recorder}}
+	case flusher && readerFrom:
+		return struct {
+			*responseRecorder
+			http.Flusher
+			io.ReaderFrom
+		}{recorder, flushRecorder{recorder}, readFromRecorder{recorder}}
+	case hijacker && readerFrom:
+		return struct {
+			*responseRecorder
+			http.Hijacker
+			io.ReaderFrom
+		}{recorder, hijackRecorder{recorder}, readFromRecorder{recorder}}
+	case flusher:
+		return struct {
+			*responseRecorder
+			http.Flusher
+		}{recorder, flushRecorder{recorder}}
+	case hijacker:
+		return struct {
+			*responseRecorder
+			http.Hijacker
+		}{recorder, hijackRecorder{recorder}}
+	case readerFrom:
+		return struct {
+			*responseRecorder
+			io.ReaderFrom
+		}{recorder, readFromRecorder{recorder}}
+	}
+	return recorder
+}
+
+// responseRecorder is the ResponseRecorder of a writer
+// supporting none of the optional interfaces
+type responseRecorder struct {
+	http.ResponseWriter
+	status       int
+	wroteHeader  bool
+	bytesWritten int64
+}
+
+// Status returns the status code of the response, 200 if none was written explicitly
+func (w *responseRecorder) Status() int {
+	return w.status
+}
+
+// BytesWritten returns the number of bytes of the response body written so far
+func (w *responseRecorder) BytesWritten() int64 {
+	return w.bytesWritten
+}
+
+// WriteHeader records the status code and writes it to the wrapped writer
+func (w *responseRecorder) WriteHeader(status int) {
+	if !w.wroteHeader {
+		w.status = status
+		w.wroteHeader = true
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+// Write writes to the wrapped writer counting the bytes written
+func (w *responseRecorder) Write(b []byte) (int, error) {
+	w.wroteHeader = true
+	n, err := w.ResponseWriter.Write(b)
+	w.bytesWritten += int64(n)
+	return n, err
+}
+
+// flushRecorder passes Flush through to a wrapped http.Flusher
+type flushRecorder struct {
+	*responseRecorder
+}
+
+// Flush flushes the wrapped writer
+func (w flushRecorder) Flush() {
+	w.wroteHeader = true
+	w.ResponseWriter.(http.Flusher).Flush()
+}
+
+// hijackRecorder passes Hijack through to a wrapped http.Hijacker
+type hijackRecorder struct {
+	*responseRecorder
+}
+
+// Hijack hijacks the connection of the wrapped writer
+func (w hijackRecorder) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	return w.ResponseWriter.(http.Hijacker).Hijack()
+}
+
+// readFromRecorder passes ReadFrom through to a wrapped io.ReaderFrom
+type readFromRecorder struct {
+	*responseRecorder
+}
+
+// ReadFrom copies from r to the wrapped writer counting the bytes written
+func (w readFromRecorder) ReadFrom(r io.Reader) (int64, error) {
+	w.wroteHeader = true
+	n, err := w.ResponseWriter.(io.ReaderFrom).ReadFrom(r)
+	w.bytesWritten += n
+	return n, err
+}
@@ -0,0 +1,129 @@
+package simplerelic
+
+import (
+	"bufio"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestResponseRecorderDefaultStatus(t *testing.T) {
+
+	w := WrapResponseWriter(httptest.NewRecorder())
+	w.Write([]byte("ok"))
+
+	if w.Status() != http.StatusOK {
+		t.Errorf("error: expected status %d, got %d", http.StatusOK, w.Status())
+	}
+
+	w = WrapResponseWriter(httptest.NewRecorder())
+	if w.Status() != http.StatusOK {
+		t.Errorf("error: expected status %d without a write, got %d", http.StatusOK, w.Status())
+	}
+}
+
+func TestResponseRecorderStatus(t *testing.T) {
+
+	w := WrapResponseWriter(httptest.NewRecorder())
+	w.WriteHeader(http.StatusNotFound)
+	w.WriteHeader(http.StatusInternalServerError)
+
+	if w.Status() != http.StatusNotFound {
+		t.Errorf("error: expected the first status %d, got %d", http.StatusNotFound, w.Status())
+	}
+}
+
+func TestResponseRecorderBytesWritten(t *testing.T) {
+
+	inner := httptest.NewRecorder()
+	w := WrapResponseWriter(inner)
+	w.Write([]byte("hello"))
+	w.Write([]byte(", "))
+	io.Copy(w, strings.NewReader("world"))
+
+	if w.BytesWritten() != 12 {
+		t.Errorf("error: expected 12 bytes written, got %d", w.BytesWritten())
+	}
+	if inner.Body.String() != "hello, world" {
+		t.Errorf("error: unexpected body %q", inner.Body.String())
+	}
+}
+
+func TestResponseRecorderHijack(t *testing.T) {
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hijacker, ok := WrapResponseWriter(w).(http.Hijacker)
+		if !ok {
+			t.Error("error: expected the recorder of a server response to be a http.Hijacker")
+			return
+		}
+		conn, rw, err := hijacker.Hijack()
+		if err != nil {
+			t.Errorf("error: hijack failed: %v", err)
+			return
+		}
+		defer conn.Close()
+		rw.WriteString("HTTP/1.1 200 OK\r\nContent-Length: 8\r\nConnection: close\r\n\r\nhijacked")
+		rw.Flush()
+	}))
+	defer server.Close()
+
+	resp, err := http.Get(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	body, _ := bufio.NewReader(resp.Body).ReadString('\n')
+	if body != "hijacked" {
+		t.Errorf("error: expected the hijacked response, got %q", body)
+	}
+
+	// httptest.ResponseRecorder can't be hijacked
+	if _, ok := WrapResponseWriter(httptest.NewRecorder()).(http.Hijacker); ok {
+		t.Error("error: expected the recorder of an unsupported writer not to be a http.Hijacker")
+	}
+}
+
+// plainWriter supports none of the optional interfaces
+type plainWriter struct {
+	http.ResponseWriter
+}
+
+func TestResponseRecorderInterfaces(t *testing.T) {
+
+	check := func(name string, w http.ResponseWriter, flusher, hijacker, readerFrom bool) {
+		recorder := WrapResponseWriter(w)
+		if _, ok := recorder.(http.Flusher); ok != flusher {
+			t.Errorf("error: expected the recorder of %s to be a http.Flusher %t", name, flusher)
+		}
+		if _, ok := recorder.(http.Hijacker); ok != hijacker {
+			t.Errorf("error: expected the recorder of %s to be a http.Hijacker %t", name, hijacker)
+		}
+		if _, ok := recorder.(io.ReaderFrom); ok != readerFrom {
+			t.Errorf("error: expected the recorder of %s to be an io.ReaderFrom %t", name, readerFrom)
+		}
+	}
+
+	check("a plain writer", plainWriter{httptest.NewRecorder()}, false, false, false)
+	check("httptest.ResponseRecorder", httptest.NewRecorder(), true, false, false)
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		check("a server response", w, true, true, true)
+
+		recorder := WrapResponseWriter(w)
+		recorder.(io.ReaderFrom).ReadFrom(strings.NewReader("hello"))
+		if recorder.BytesWritten() != 5 {
+			t.Errorf("error: expected 5 bytes written, got %d", recorder.BytesWritten())
+		}
+	}))
+	defer server.Close()
+
+	resp, err := http.Get(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+}